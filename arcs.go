@@ -0,0 +1,340 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"math"
+	"sort"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/index/rtree"
+)
+
+// snapCells is the distance, in grid cells, within which the
+// SharedVertices option snaps vertices to each other and onto
+// the segments of neighboring paths.
+const snapCells = 1e-6
+
+// arcTopology is the shared-arc topology of a set of paths. The
+// distinct vertices of the paths are divided into nodes, where paths
+// end, meet or turn back, and the interior vertices of arcs, which are
+// the chains of vertices between nodes. Each path is a sequence of
+// arcs, and a boundary shared by two polygons is a single arc, so
+// each of its vertices is stored, and transformed, once.
+type arcTopology struct {
+	// vertices holds the distinct vertices of the paths.
+	vertices geom.Path
+
+	// arcs holds the indices in vertices of the vertices of each
+	// arc, from its start node to its end node.
+	arcs [][]int
+
+	// paths holds the arcs that make up each path.
+	paths []arcPath
+}
+
+// arcPath is a path in an arcTopology.
+type arcPath struct {
+	arcs []arcRef
+
+	// n is the number of vertices in the path and m is the number
+	// that are distinct positions along it, which is one less than n
+	// if it is a ring whose last vertex repeats its first.
+	n, m int
+
+	// start is the index in the path of the start of its first arc,
+	// which is not zero if it is a ring whose first vertex is not
+	// a node.
+	start int
+}
+
+// arcRef is an arc of an arcPath, which is traversed from its end
+// node to its start node if reversed is true.
+type arcRef struct {
+	arc      int
+	reversed bool
+}
+
+// newArcTopology returns the shared-arc topology of paths, where
+// closed reports whether each path is a ring, whose last vertex
+// connects to its first. Vertices are shared if they are equal.
+func newArcTopology(paths []geom.Path, closed func(int) bool) *arcTopology {
+	t := &arcTopology{paths: make([]arcPath, len(paths))}
+	index := make(map[geom.Point]int)
+	ids := make([][]int, len(paths))
+	for i, p := range paths {
+		m := len(p)
+		if closed(i) && m > 1 && p[0] == p[m-1] {
+			m--
+		}
+		t.paths[i].n, t.paths[i].m = len(p), m
+		ids[i] = make([]int, m)
+		for j, v := range p[:m] {
+			k, ok := index[v]
+			if !ok {
+				k = len(t.vertices)
+				index[v] = k
+				t.vertices = append(t.vertices, v)
+			}
+			ids[i][j] = k
+		}
+	}
+
+	// A vertex is a node unless it has exactly two neighbors and
+	// every path through it passes from one to the other.
+	node := make([]bool, len(t.vertices))
+	neighbors := make([][2]int, len(t.vertices))
+	for k := range neighbors {
+		neighbors[k] = [2]int{-1, -1}
+	}
+	addNeighbor := func(k, n int) {
+		switch {
+		case neighbors[k][0] < 0 || neighbors[k][0] == n:
+			neighbors[k][0] = n
+		case neighbors[k][1] < 0 || neighbors[k][1] == n:
+			neighbors[k][1] = n
+		default:
+			node[k] = true
+		}
+	}
+	for i, p := range ids {
+		m := len(p)
+		for j, k := range p {
+			if !closed(i) && (j == 0 || j == m-1) {
+				node[k] = true
+				continue
+			}
+			prev, next := p[(j+m-1)%m], p[(j+1)%m]
+			addNeighbor(k, prev)
+			addNeighbor(k, next)
+			if prev == next {
+				node[k] = true
+			}
+		}
+	}
+	for k, n := range neighbors {
+		if n[1] < 0 {
+			node[k] = true
+		}
+	}
+	// A ring that meets no other path is a single arc.
+	for i, p := range ids {
+		if !closed(i) || len(p) == 0 {
+			continue
+		}
+		hasNode := false
+		for _, k := range p {
+			hasNode = hasNode || node[k]
+		}
+		if !hasNode {
+			node[p[0]] = true
+		}
+	}
+
+	// arcIndex holds the arc that starts with each pair of vertices,
+	// in either direction.
+	arcIndex := make(map[[2]int]arcRef)
+	for i, p := range ids {
+		path := &t.paths[i]
+		m := len(p)
+		if m == 0 {
+			continue
+		}
+		edges := m - 1
+		if closed(i) {
+			for !node[p[path.start]] {
+				path.start++
+			}
+			edges = m
+		}
+		if edges == 0 {
+			path.arcs = append(path.arcs, arcRef{arc: len(t.arcs)})
+			t.arcs = append(t.arcs, []int{p[0]})
+			continue
+		}
+		for e := 0; e < edges; {
+			a, b := p[(path.start+e)%m], p[(path.start+e+1)%m]
+			ref, ok := arcIndex[[2]int{a, b}]
+			if !ok {
+				arc := []int{a}
+				for f := e + 1; ; f++ {
+					k := p[(path.start+f)%m]
+					arc = append(arc, k)
+					if node[k] {
+						break
+					}
+				}
+				ref = arcRef{arc: len(t.arcs)}
+				t.arcs = append(t.arcs, arc)
+				arcIndex[[2]int{a, b}] = ref
+				back := [2]int{arc[len(arc)-1], arc[len(arc)-2]}
+				if _, ok := arcIndex[back]; !ok {
+					arcIndex[back] = arcRef{arc: ref.arc, reversed: true}
+				}
+			}
+			path.arcs = append(path.arcs, ref)
+			e += len(t.arcs[ref.arc]) - 1
+		}
+	}
+	return t
+}
+
+// assemble returns the paths of the receiver with their vertices
+// taken from v, which corresponds to the receiver's vertices field.
+func (t *arcTopology) assemble(v geom.Path) []geom.Path {
+	o := make([]geom.Path, len(t.paths))
+	for i, path := range t.paths {
+		p := make(geom.Path, path.n)
+		o[i] = p
+		var j int
+		for a, ref := range path.arcs {
+			arc := t.arcs[ref.arc]
+			for x := range arc {
+				if a > 0 && x == 0 {
+					continue // The end node of the previous arc.
+				}
+				k := arc[x]
+				if ref.reversed {
+					k = arc[len(arc)-1-x]
+				}
+				if j < path.m {
+					p[(path.start+j)%path.m] = v[k]
+				}
+				j++
+			}
+		}
+		if path.n > path.m {
+			p[path.n-1] = p[0]
+		}
+	}
+	return o
+}
+
+// snap returns a copy of paths in which vertices within snapCells
+// grid cells of each other are moved to the position of the first of
+// them, and vertices within snapCells of the interior of a segment are
+// inserted into it, so that neighboring polygons whose boundaries
+// were digitized separately share the same vertices along them. closed
+// is as for newArcTopology.
+func (c *Cartogram) snap(paths []geom.Path, closed func(int) bool) []geom.Path {
+	toGrid := func(p geom.Point) (x, y float64) {
+		return (p.X - c.b.Min.X) / c.dx, (p.Y - c.b.Min.Y) / c.dy
+	}
+	cell := func(x, y float64) [2]int64 {
+		return [2]int64{int64(math.Floor(x / snapCells)), int64(math.Floor(y / snapCells))}
+	}
+	cells := make(map[[2]int64][]geom.Point)
+	var distinct geom.Path
+	snapped := make(map[geom.Point]geom.Point)
+	o := make([]geom.Path, len(paths))
+	for i, p := range paths {
+		o[i] = make(geom.Path, len(p))
+		for j, v := range p {
+			s, ok := snapped[v]
+			if !ok {
+				s = v
+				x, y := toGrid(v)
+				cv := cell(x, y)
+			search:
+				for di := int64(-1); di <= 1; di++ {
+					for dj := int64(-1); dj <= 1; dj++ {
+						for _, w := range cells[[2]int64{cv[0] + di, cv[1] + dj}] {
+							if wx, wy := toGrid(w); math.Hypot(wx-x, wy-y) <= snapCells {
+								s = w
+								break search
+							}
+						}
+					}
+				}
+				if s == v {
+					cells[cv] = append(cells[cv], v)
+					distinct = append(distinct, v)
+				}
+				snapped[v] = s
+			}
+			o[i][j] = s
+		}
+	}
+
+	// segments calls f with the end points of each segment of path i.
+	segments := func(i int, f func(a, b geom.Point)) {
+		p := o[i]
+		n := len(p) - 1
+		if closed(i) && len(p) > 1 && p[0] != p[len(p)-1] {
+			n = len(p)
+		}
+		for j := 0; j < n; j++ {
+			f(p[j], p[(j+1)%len(p)])
+		}
+	}
+	segIndex := rtree.NewTree(25, 50)
+	seen := make(map[[2]geom.Point]bool)
+	for i := range o {
+		segments(i, func(a, b geom.Point) {
+			if pointLess(b, a) {
+				a, b = b, a
+			}
+			if a == b || seen[[2]geom.Point{a, b}] {
+				return
+			}
+			seen[[2]geom.Point{a, b}] = true
+			segIndex.Insert(&ringSegment{a: a, b: b})
+		})
+	}
+	// inserted holds the vertices to insert into segments, by their end
+	// points in canonical order, and their positions along them.
+	type insertion struct {
+		t float64
+		v geom.Point
+	}
+	inserted := make(map[[2]geom.Point][]insertion)
+	for _, v := range distinct {
+		x, y := toGrid(v)
+		r := geom.Point{X: snapCells * math.Abs(c.dx), Y: snapCells * math.Abs(c.dy)}
+		search := &geom.Bounds{Min: geom.Point{X: v.X - r.X, Y: v.Y - r.Y}, Max: geom.Point{X: v.X + r.X, Y: v.Y + r.Y}}
+		for _, item := range segIndex.SearchIntersect(search) {
+			s := item.(*ringSegment)
+			if v == s.a || v == s.b {
+				continue
+			}
+			ax, ay := toGrid(s.a)
+			bx, by := toGrid(s.b)
+			dx, dy := bx-ax, by-ay
+			t := ((x-ax)*dx + (y-ay)*dy) / (dx*dx + dy*dy)
+			if t <= 0 || t >= 1 || math.Hypot(ax+t*dx-x, ay+t*dy-y) > snapCells {
+				continue
+			}
+			key := [2]geom.Point{s.a, s.b}
+			inserted[key] = append(inserted[key], insertion{t: t, v: v})
+		}
+	}
+	if len(inserted) == 0 {
+		return o
+	}
+	for _, ins := range inserted {
+		sort.Slice(ins, func(i, j int) bool { return ins[i].t < ins[j].t })
+	}
+	for i, p := range o {
+		var q geom.Path
+		segments(i, func(a, b geom.Point) {
+			q = append(q, a)
+			if pointLess(a, b) {
+				for _, in := range inserted[[2]geom.Point{a, b}] {
+					q = append(q, in.v)
+				}
+				return
+			}
+			ins := inserted[[2]geom.Point{b, a}]
+			for k := len(ins) - 1; k >= 0; k-- {
+				q = append(q, ins[k].v)
+			}
+		})
+		if len(p) > 0 && (!closed(i) || len(p) == 1 || p[0] == p[len(p)-1]) {
+			q = append(q, p[len(p)-1])
+		}
+		o[i] = q
+	}
+	return o
+}
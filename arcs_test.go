@@ -0,0 +1,146 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+func TestArcTopology(t *testing.T) {
+	paths := []geom.Path{
+		// Two squares sharing the edge from (1,0) to (1,1), the first
+		// explicitly closed and the second starting partway along it.
+		{{X: 0, Y: 0}, {X: 1, Y: 0}, {X: 1, Y: 0.5}, {X: 1, Y: 1}, {X: 0, Y: 1}, {X: 0, Y: 0}},
+		{{X: 1, Y: 0.5}, {X: 1, Y: 0}, {X: 2, Y: 0}, {X: 2, Y: 1}, {X: 1, Y: 1}},
+		// A ring that meets no other path.
+		{{X: 5, Y: 5}, {X: 6, Y: 5}, {X: 6, Y: 6}},
+		// A line that ends on the shared edge and a single point.
+		{{X: 3, Y: 0.5}, {X: 1, Y: 0.5}},
+		{{X: 9, Y: 9}},
+	}
+	closed := func(i int) bool { return i < 3 }
+	topo := newArcTopology(paths, closed)
+	if n := len(topo.vertices); n != 12 {
+		t.Errorf("have %d distinct vertices, want 12", n)
+	}
+	if have := topo.assemble(topo.vertices); !reflect.DeepEqual(have, paths) {
+		t.Errorf("assembled paths:\nhave %v\nwant %v", have, paths)
+	}
+
+	// The shared edge is split at the end of the line into two arcs,
+	// each used once in each direction.
+	uses := make(map[int][2]int)
+	for _, p := range topo.paths {
+		for _, ref := range p.arcs {
+			u := uses[ref.arc]
+			if ref.reversed {
+				u[1]++
+			} else {
+				u[0]++
+			}
+			uses[ref.arc] = u
+		}
+	}
+	var shared int
+	for _, u := range uses {
+		if u == [2]int{1, 1} {
+			shared++
+		}
+	}
+	if shared != 2 {
+		t.Errorf("have %d arcs shared by the squares, want 2: %v", shared, topo.arcs)
+	}
+	if n := len(topo.arcs); n != 7 {
+		t.Errorf("have %d arcs, want 7: %v", n, topo.arcs)
+	}
+
+	// Each transformed vertex appears wherever it is used.
+	shifted := make(geom.Path, len(topo.vertices))
+	for i, v := range topo.vertices {
+		shifted[i] = geom.Point{X: v.X + 10, Y: v.Y}
+	}
+	for i, p := range topo.assemble(shifted) {
+		for j, v := range p {
+			if want := (geom.Point{X: paths[i][j].X + 10, Y: paths[i][j].Y}); v != want {
+				t.Errorf("path %d vertex %d: have %v, want %v", i, j, v, want)
+			}
+		}
+	}
+}
+
+func TestSharedVerticesGaps(t *testing.T) {
+	c := NewCartogram(testDensity(), 1, 30, 30)
+	defer c.Destroy()
+	// The square on the left has no vertex where the two on the right
+	// meet, and the corner of the lower right square is slightly off.
+	const eps = 1e-9
+	left := geom.Polygon{{{X: 0, Y: 1}, {X: 2, Y: 1}, {X: 2, Y: 3}, {X: 0, Y: 3}, {X: 0, Y: 1}}}
+	lower := geom.Polygon{{{X: 2 + eps, Y: 1}, {X: 3, Y: 1}, {X: 3, Y: 2}, {X: 2, Y: 2}, {X: 2 + eps, Y: 1}}}
+	upper := geom.Polygon{{{X: 2, Y: 2}, {X: 3, Y: 2}, {X: 3, Y: 3}, {X: 2, Y: 3}, {X: 2, Y: 2}}}
+	polygons := []geom.Polygon{left, lower, upper}
+
+	// gap returns the distance of the transformed vertices of the right
+	// squares on their shared boundary from the transformed left square.
+	gap := func(o []geom.Polygon) float64 {
+		var d float64
+		for _, v := range []geom.Point{o[1][0][0], o[1][0][3], o[2][0][3]} {
+			min := math.Inf(1)
+			ring := o[0][0]
+			for i := 0; i < len(ring)-1; i++ {
+				min = math.Min(min, distPointSegment(v, ring[i], ring[i+1]))
+			}
+			d = math.Max(d, min)
+		}
+		return d
+	}
+	if d := gap(c.TransformPolygons(polygons)); d < 1e-6 {
+		t.Errorf("gap without shared vertices is %g, which is too small to test", d)
+	}
+	c.SharedVertices = true
+	o := c.TransformPolygons(polygons)
+	if d := gap(o); d != 0 {
+		t.Errorf("gap with shared vertices: %g", d)
+	}
+	if n := len(o[0][0]); n != 6 {
+		t.Errorf("left square has %d vertices, want 6: %v", n, o[0][0])
+	}
+	if o[1][0][0] != o[0][0][1] {
+		t.Errorf("snapped corner %v differs from %v", o[1][0][0], o[0][0][1])
+	}
+}
+
+// distPointSegment returns the distance from p to the segment from a to b.
+func distPointSegment(p, a, b geom.Point) float64 {
+	dx, dy := b.X-a.X, b.Y-a.Y
+	t := ((p.X-a.X)*dx + (p.Y-a.Y)*dy) / (dx*dx + dy*dy)
+	t = math.Max(0, math.Min(1, t))
+	return math.Hypot(a.X+t*dx-p.X, a.Y+t*dy-p.Y)
+}
+
+func BenchmarkTransformSharedVertices(b *testing.B) {
+	f, err := ReadShapefile("testdata/WA_Population_2010.shp", "population", "county")
+	if err != nil {
+		b.Fatal(err)
+	}
+	var polygons []geom.Polygon
+	for _, p := range f.Polygons {
+		polygons = append(polygons, p.Polygons()...)
+	}
+	c := NewSquareCartogram(f, 20000, SquareCellSize(f, 20000, 64*128))
+	defer c.Destroy()
+	for _, shared := range []bool{false, true} {
+		b.Run(fmt.Sprintf("shared=%v", shared), func(b *testing.B) {
+			c.SharedVertices = shared
+			for i := 0; i < b.N; i++ {
+				c.TransformPolygons(polygons)
+			}
+		})
+	}
+}
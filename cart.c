@@ -12,6 +12,7 @@
 #include <math.h>
 #include <string.h>
 #include <fftw3.h>
+#include <pthread.h>
 
 #include "cart.h"
 
@@ -26,6 +27,8 @@
 
 #define PI 3.1415926535897932384626
 
+#define MINTHREADPOINTS 1000 // Minimum number of points per thread
+
 /* Globals */
 
 double *rhot[5];       // Pop density at time t (five snaps needed)
@@ -37,6 +40,8 @@ double **vyt[5];       // y-velocity at time t
 
 double *expky;         // Array needed for the Gaussian convolution
 
+char *pinned;          // Grid points whose velocity is held at zero, or NULL
+
 fftw_plan rhotplan[5]; // Plan for rho(t) back-transform at time t
 
 
@@ -93,6 +98,7 @@ void cart_makews(int xsize, int ysize)
   }
 
   expky = malloc(ysize*sizeof(double));
+  pinned = NULL;
 
   /* Make plans for the back transforms */
 
@@ -124,11 +130,24 @@ void cart_freews(int xsize, int ysize)
   }
 
   free(expky);
+  free(pinned);
+  pinned = NULL;
 
   for (i=0; i<5; i++) fftw_destroy_plan(rhotplan[i]);
 }
 
 
+/* Function to pin the grid point at (x,y), so that its velocity is always
+ * zero and points around it are held in place.  Space for the pins is
+ * allocated when the first one is set */
+
+void cart_pin(int x, int y, int xsize, int ysize)
+{
+  if (pinned==NULL) pinned = calloc((xsize+1)*(ysize+1),sizeof(char));
+  pinned[x*(ysize+1)+y] = 1;
+}
+
+
 /* Function to calculate the discrete cosine transform of the input data.
  * assumes its input is an fftw_malloced array in column-major form with
  * size xsize*ysize */
@@ -261,6 +280,16 @@ void cart_vgrid(int s, int xsize, int ysize)
       vyt[s][ix][iy] = -2*(r01-r00+r11-r10)/mid;
     }
   }
+
+  /* Hold the pinned points still */
+
+  if (pinned!=NULL) {
+    for (ix=0; ix<=xsize; ix++) {
+      for (iy=0; iy<=ysize; iy++) {
+        if (pinned[ix*(ysize+1)+iy]) vxt[s][ix][iy] = vyt[s][ix][iy] = 0.0;
+      }
+    }
+  }
 }
 
 
@@ -312,28 +341,31 @@ void cart_velocity(double rx, double ry, int s, int xsize, int ysize,
 }
 
 
-/* Function to integrate 2h time into the future two different ways using
- * four-order Runge-Kutta and compare the differences for the purposes of
- * the adaptive step size.  Parameters are:
- *   *pointx = array of x-coords of points
- *   *pointy = array of y-coords of points
- *   npoints = number of points
- *   t = current time, i.e., start time of these two steps
- *   h = delta t
- *   s = snapshot index of the initial time
- *   xsize, ysize = size of grid
- *   *errorp = the maximum integration error found for any polygon vertex for
- *             the complete two-step process
- *   *drp = maximum distance moved by any point
- *   *spp = the snapshot index for the final function evaluation
- */
+/* Arguments and results of cart_rksteps() for one block of points */
 
-void cart_twosteps(double *pointx, double *pointy, int npoints,
-		   double t, double h, int s, int xsize, int ysize,
-		   double *errorp, double *drp, int *spp)
-{
+typedef struct {
+  double *pointx, *pointy;
+  int npoints;
+  double h;
   int s0,s1,s2,s3,s4;
+  int xsize,ysize;
+  double esqmax;
+  double drsqmax;
+} rkblock_t;
+
+
+/* Function to do the Runge-Kutta steps of cart_twosteps() for a block
+ * of points, recording the maximum squared error and squared distance
+ * moved in the block.  It takes a pointer to an rkblock_t so that it can
+ * be run in its own thread */
+
+void *cart_rksteps(void *arg)
+{
+  rkblock_t *b = arg;
   int p;
+  double h = b->h;
+  int s0 = b->s0, s1 = b->s1, s2 = b->s2, s3 = b->s3, s4 = b->s4;
+  int xsize = b->xsize, ysize = b->ysize;
   double rx1,ry1;
   double rx2,ry2;
   double rx3,ry3;
@@ -353,34 +385,12 @@ void cart_twosteps(double *pointx, double *pointy, int npoints,
   double esq,esqmax;
   double drsq,drsqmax;
 
-  s0 = s;
-  s1 = (s+1)%5;
-  s2 = (s+2)%5;
-  s3 = (s+3)%5;
-  s4 = (s+4)%5;
-
-  /* Calculate the density field for the four new time slices */
-
-  cart_density(t+0.5*h,s1,xsize,ysize);
-  cart_density(t+1.0*h,s2,xsize,ysize);
-  cart_density(t+1.5*h,s3,xsize,ysize);
-  cart_density(t+2.0*h,s4,xsize,ysize);
-
-  /* Calculate the resulting velocity grids */
-
-  cart_vgrid(s1,xsize,ysize);
-  cart_vgrid(s2,xsize,ysize);
-  cart_vgrid(s3,xsize,ysize);
-  cart_vgrid(s4,xsize,ysize);
-
-  /* Do all three RK steps for each point in turn */
-
   esqmax = drsqmax = 0.0;
 
-  for (p=0; p<npoints; p++) {
+  for (p=0; p<b->npoints; p++) {
 
-    rx1 = pointx[p];
-    ry1 = pointy[p];
+    rx1 = b->pointx[p];
+    ry1 = b->pointy[p];
 
     /* Do the big combined (2h) RK step */
 
@@ -466,11 +476,111 @@ void cart_twosteps(double *pointx, double *pointy, int npoints,
     if (ry3<0) ry3 = 0;
     else if (ry3>ysize) ry3 = ysize;
 
-    pointx[p] = rx3;
-    pointy[p] = ry3;
+    b->pointx[p] = rx3;
+    b->pointy[p] = ry3;
 
   }
 
+  b->esqmax = esqmax;
+  b->drsqmax = drsqmax;
+  return NULL;
+}
+
+
+/* Function to integrate 2h time into the future two different ways using
+ * four-order Runge-Kutta and compare the differences for the purposes of
+ * the adaptive step size.  Parameters are:
+ *   *pointx = array of x-coords of points
+ *   *pointy = array of y-coords of points
+ *   npoints = number of points
+ *   t = current time, i.e., start time of these two steps
+ *   h = delta t
+ *   s = snapshot index of the initial time
+ *   xsize, ysize = size of grid
+ *   threads = maximum number of threads to divide the points between
+ *   *errorp = the maximum integration error found for any polygon vertex for
+ *             the complete two-step process
+ *   *drp = maximum distance moved by any point
+ *   *spp = the snapshot index for the final function evaluation
+ *
+ * Each point is integrated independently using the same velocity grids,
+ * and the maxima are the same however the points are divided, so the
+ * results do not depend on the number of threads */
+
+void cart_twosteps(double *pointx, double *pointy, int npoints,
+		   double t, double h, int s, int xsize, int ysize, int threads,
+		   double *errorp, double *drp, int *spp)
+{
+  int s0,s1,s2,s3,s4;
+  int i,n;
+  double esqmax,drsqmax;
+  rkblock_t *blocks;
+  pthread_t *tids;
+  int *created;
+
+  s0 = s;
+  s1 = (s+1)%5;
+  s2 = (s+2)%5;
+  s3 = (s+3)%5;
+  s4 = (s+4)%5;
+
+  /* Calculate the density field for the four new time slices */
+
+  cart_density(t+0.5*h,s1,xsize,ysize);
+  cart_density(t+1.0*h,s2,xsize,ysize);
+  cart_density(t+1.5*h,s3,xsize,ysize);
+  cart_density(t+2.0*h,s4,xsize,ysize);
+
+  /* Calculate the resulting velocity grids */
+
+  cart_vgrid(s1,xsize,ysize);
+  cart_vgrid(s2,xsize,ysize);
+  cart_vgrid(s3,xsize,ysize);
+  cart_vgrid(s4,xsize,ysize);
+
+  /* Divide the points into blocks and do all three RK steps for each
+   * block, in its own thread if there is more than one */
+
+  if (threads>npoints/MINTHREADPOINTS) threads = npoints/MINTHREADPOINTS;
+  if (threads<1) threads = 1;
+
+  blocks = malloc(threads*sizeof(rkblock_t));
+  tids = malloc(threads*sizeof(pthread_t));
+  created = malloc(threads*sizeof(int));
+  for (i=0; i<threads; i++) {
+    n = (long)npoints*i/threads;
+    blocks[i].pointx = pointx + n;
+    blocks[i].pointy = pointy + n;
+    blocks[i].npoints = (long)npoints*(i+1)/threads - n;
+    blocks[i].h = h;
+    blocks[i].s0 = s0;
+    blocks[i].s1 = s1;
+    blocks[i].s2 = s2;
+    blocks[i].s3 = s3;
+    blocks[i].s4 = s4;
+    blocks[i].xsize = xsize;
+    blocks[i].ysize = ysize;
+  }
+
+  /* A block whose thread can't be created is done on this thread
+   * instead, which gives the same results */
+
+  for (i=0; i<threads; i++) {
+    created[i] = threads>1 &&
+      pthread_create(&tids[i],NULL,cart_rksteps,&blocks[i])==0;
+    if (!created[i]) cart_rksteps(&blocks[i]);
+  }
+  for (i=0; i<threads; i++) if (created[i]) pthread_join(tids[i],NULL);
+
+  esqmax = drsqmax = 0.0;
+  for (i=0; i<threads; i++) {
+    if (blocks[i].esqmax>esqmax) esqmax = blocks[i].esqmax;
+    if (blocks[i].drsqmax>drsqmax) drsqmax = blocks[i].drsqmax;
+  }
+  free(blocks);
+  free(tids);
+  free(created);
+
   *errorp = sqrt(esqmax);
   *drp =  sqrt(drsqmax);
   *spp = s4;
@@ -533,26 +643,105 @@ void write_displacements(char *output_filename, double *gridx, double *gridy, in
 }
 
 void cart_makecartnooptions(double *pointx, double *pointy, int npoints,
-		   int xsize, int ysize, double blur)
+		   int xsize, int ysize, double blur, int threads)
 {
   options_t options = DEFAULT_OPTIONS;
   options.output_filename = "nofile";
   options.blur = blur;
+  options.threads = threads;
   //options.progress_mode = NONE;
   cart_makecart(pointx, pointy, npoints,xsize, ysize, &options);
 }
 
+/* Function to transform the given set of points to the cartogram and
+ * record their positions partway through, for animation.  Frame k is
+ * recorded at fraction fractions[k] of the diffusion time on a
+ * logarithmic scale, from the start time to the time at which the
+ * points stop moving, and stored in framex[k*npoints+i] and
+ * framey[k*npoints+i].  The time scale is found by transforming the
+ * points once, and the frames by transforming them again, stopping at
+ * each frame time.  Frames at fractions of zero or less hold the
+ * original points, and those at one or more hold the final points,
+ * which are also left in pointx and pointy as for cart_makecart */
+
+void cart_makecartframes(double *pointx, double *pointy, int npoints,
+			 int xsize, int ysize, double blur, int threads,
+			 double *fractions, int nframes, double *framex, double *framey)
+{
+  options_t options = DEFAULT_OPTIONS;
+  double *x0, *y0, *times;
+  double t0, tend;
+  int k;
+
+  options.output_filename = "nofile";
+  options.blur = blur;
+  options.threads = threads;
+
+  x0 = malloc(npoints * sizeof(double));
+  y0 = malloc(npoints * sizeof(double));
+  memcpy(x0, pointx, npoints * sizeof(double));
+  memcpy(y0, pointy, npoints * sizeof(double));
+  tend = cart_makecart(pointx, pointy, npoints, xsize, ysize, &options);
+
+  /* Frames at the ends are copied, and the others are marked with the
+   * time at which to record them */
+
+  t0 = 0.5*blur*blur;
+  times = malloc(nframes * sizeof(double));
+  for (k=0; k<nframes; k++) {
+    times[k] = NAN;
+    if (fractions[k]<=0.0) {
+      memcpy(framex + (long)k*npoints, x0, npoints * sizeof(double));
+      memcpy(framey + (long)k*npoints, y0, npoints * sizeof(double));
+    } else if (fractions[k]>=1.0 || tend<=t0+INITH) {
+      memcpy(framex + (long)k*npoints, pointx, npoints * sizeof(double));
+      memcpy(framey + (long)k*npoints, pointy, npoints * sizeof(double));
+    } else times[k] = t0 + INITH*pow((tend-t0)/INITH, fractions[k]);
+  }
+
+  options.nframes = nframes;
+  options.frametimes = times;
+  options.framex = framex;
+  options.framey = framey;
+  cart_makecart(x0, y0, npoints, xsize, ysize, &options);
+
+  free(x0);
+  free(y0);
+  free(times);
+}
+
+
+/* Function to copy the points into each frame, in options, that is
+ * due at or before time t and has not yet been recorded */
+
+void cart_recordframes(double *pointx, double *pointy, int npoints,
+		       double t, options_t *options)
+{
+  int k;
+
+  for (k=0; k<options->nframes; k++) {
+    if (isnan(options->frametimes[k]) || options->frametimes[k]>t) continue;
+    memcpy(options->framex + (long)k*npoints, pointx, npoints * sizeof(double));
+    memcpy(options->framey + (long)k*npoints, pointy, npoints * sizeof(double));
+    options->frametimes[k] = NAN;
+  }
+}
+
+
 /* Function to do the transformation of the given set of points
- * to the cartogram */
+ * to the cartogram.  It returns the time at which the points stopped
+ * moving.  If options holds frame times, the time-step is shortened
+ * where necessary to stop at each of them and record the points */
 
-void cart_makecart(double *pointx, double *pointy, int npoints,
-		   int xsize, int ysize, options_t *options)
+double cart_makecart(double *pointx, double *pointy, int npoints,
+		     int xsize, int ysize, options_t *options)
 {
-  int i;
+  int i,k;
   int s,sp;
   int step;
   int done;
-  double t,h,prev_h;
+  int clamped;
+  double t,h,prev_h,free_h,tframe;
   double error,dr;
   double desiredratio, chosenratio;
   double *pointx_copy, *pointy_copy;
@@ -575,11 +764,25 @@ void cart_makecart(double *pointx, double *pointy, int npoints,
 
   do {
 
+    /* Shorten the step if it would pass the time of the next frame */
+
+    free_h = h;
+    clamped = FALSE;
+    tframe = INFINITY;
+    for (k=0; k<options->nframes; k++) {
+      if (options->frametimes[k]<tframe) tframe = options->frametimes[k];
+    }
+    if (t+2.0*h>tframe) {
+      h = 0.5*(tframe-t);
+      clamped = TRUE;
+    }
+
     /* Do a combined (triple) integration step */
 
     memcpy(pointx_copy, pointx, npoints * sizeof(double));
     memcpy(pointy_copy, pointy, npoints * sizeof(double));
-    cart_twosteps(pointx,pointy,npoints,t,h,s,xsize,ysize,&error,&dr,&sp);
+    cart_twosteps(pointx,pointy,npoints,t,h,s,xsize,ysize,options->threads,
+                  &error,&dr,&sp);
 
     while(error > MAXERROR) {
       h /= 2;
@@ -588,7 +791,8 @@ void cart_makecart(double *pointx, double *pointy, int npoints,
 
       memcpy(pointx, pointx_copy, npoints * sizeof(double));
       memcpy(pointy, pointy_copy, npoints * sizeof(double));
-      cart_twosteps(pointx,pointy,npoints,t,h,s,xsize,ysize,&error,&dr,&sp);
+      cart_twosteps(pointx,pointy,npoints,t,h,s,xsize,ysize,options->threads,
+                  &error,&dr,&sp);
     }
 
     /* Increase the time by 2h and rotate snapshots */
@@ -596,6 +800,10 @@ void cart_makecart(double *pointx, double *pointy, int npoints,
     t += 2.0*h;
     step += 2;
     s = sp;
+    if (clamped) {
+      t = tframe;
+      cart_recordframes(pointx,pointy,npoints,t,options);
+    }
 
     /* Adjust the time-step.  Factor of 2 arises because the target for
      * the two-step process is twice the target for an individual step */
@@ -610,6 +818,10 @@ void cart_makecart(double *pointx, double *pointy, int npoints,
     else
       printf("h * chosenratio = %g, which is > max_h = %g\n", h * chosenratio, options->max_h);
 
+    /* A step shortened for a frame does not hold back the next one */
+
+    if (clamped && h<free_h) h = free_h;
+
     done = cart_complete(t);
     switch (options->progress_mode) {
       case NORMAL:
@@ -644,6 +856,10 @@ void cart_makecart(double *pointx, double *pointy, int npoints,
 
   } while (dr>0.0);
 
+  /* Any frames not yet recorded are of the final points */
+
+  cart_recordframes(pointx,pointy,npoints,INFINITY,options);
+
   switch (options->progress_mode) {
     case PERCENT:
       fprintf(stdout,"\n");
@@ -655,4 +871,6 @@ void cart_makecart(double *pointx, double *pointy, int npoints,
 
   free(pointx_copy);
   free(pointy_copy);
+
+  return t;
 }
@@ -18,18 +18,26 @@ typedef struct {
   char *output_filename;
   double blur;
   double max_h;
+  int threads;
+  int nframes;
+  double *frametimes;
+  double *framex, *framey;
 } options_t;
-#define DEFAULT_OPTIONS { NORMAL, FALSE, NULL, 0.0, INFINITY }
+#define DEFAULT_OPTIONS { NORMAL, FALSE, NULL, 0.0, INFINITY, 1, 0, NULL, NULL, NULL }
 
 double** cart_dmalloc(int xsize, int ysize);
 void cart_dfree(double **userrho);
 void cart_makews(int xsize, int ysize);
 void cart_freews(int xsize, int ysize);
 void cart_transform(double **userrho, int xsize, int ysize);
-void cart_makecart(double *pointx, double *pointy, int npoints,
-		   int xsize, int ysize, options_t *options);
+double cart_makecart(double *pointx, double *pointy, int npoints,
+		     int xsize, int ysize, options_t *options);
 void cart_makecartnooptions(double *pointx, double *pointy, int npoints,
-       int xsize, int ysize, double blur);
+       int xsize, int ysize, double blur, int threads);
+void cart_makecartframes(double *pointx, double *pointy, int npoints,
+       int xsize, int ysize, double blur, int threads,
+       double *fractions, int nframes, double *framex, double *framey);
 void cart_setrho(double **userrho, int x, int y, double rho);
+void cart_pin(int x, int y, int xsize, int ysize);
 
 #endif
@@ -1,19 +1,25 @@
 package tilegram
 
-// #cgo LDFLAGS: -lfftw3 -lm
-// #cgo CFLAGS: -O7
+// #cgo LDFLAGS: -lfftw3 -lm -lpthread
+// #cgo CFLAGS: -O7 -pthread
 // #include <cart.h>
 import "C"
 import (
+	"math"
+	"runtime"
 	"sync"
 	"unsafe"
 
 	"gonum.org/v1/gonum/mat"
 
 	"github.com/ctessum/geom"
-	"github.com/ctessum/geom/index/rtree"
 )
 
+// MaxCartograms is the number of cartograms that can exist at the
+// same time. The cartogram engine keeps its workspace in global state,
+// so NewCartogram blocks until any existing cartogram is destroyed.
+const MaxCartograms = 1
+
 var lock sync.Mutex
 
 // Cartogram holds information for cartogram creation.
@@ -21,12 +27,67 @@ type Cartogram struct {
 	density    **C.double
 	dens       *mat.Dense
 	rows, cols int
-	index      *rtree.Rtree
 	b          *geom.Bounds
 	dx, dy     float64
 
+	// live is true while the receiver holds the C workspace
+	// required for point integration.
+	live bool
+
+	// gridX and gridY hold the transformed locations of the
+	// (cols+1)×(rows+1) grid vertices, in grid units. When they
+	// are present and the C workspace is not, points are transformed
+	// by interpolating between them. gridBlur is the blur radius
+	// they were calculated with.
+	gridX, gridY []float64
+	gridBlur     float64
+
+	// pinned, if not nil, holds whether each of the grid vertices,
+	// in the same order as gridX, is held in place.
+	pinned []bool
+
 	// Blur is the radius (in pixels) for Gaussian blurring.
 	Blur float64
+
+	// Projection is the proj4 or WKT definition of the spatial
+	// reference of the grid, or empty if it is not known. It is not
+	// used to transform points, but Encode stores it so that features
+	// in other spatial references can be projected to match a decoded
+	// cartogram.
+	Projection string
+
+	// Threads is the maximum number of threads used to transform
+	// points. If it is zero, runtime.GOMAXPROCS(0) is used. The
+	// transformed points do not depend on the number of threads.
+	Threads int
+
+	// MaxSegment, if positive, is the maximum length, in grid cells,
+	// of the segments of paths and polygons before they are transformed.
+	// Longer segments are split by inserting vertices so that they bend
+	// with the cartogram instead of cutting across it.
+	MaxSegment float64
+
+	// Simplify, if positive, is the tolerance, in map units, to which
+	// the vertices inserted because of MaxSegment are simplified after
+	// transformation. The original vertices are always kept.
+	Simplify float64
+
+	// RepairPasses is the maximum number of times TransformPolygons
+	// transforms polygons again to repair the topology errors reported
+	// by ValidatePolygons after transformation. Before each pass, the
+	// segments that cross, and the segments nearest to vertices that are
+	// inside other polygons, are split into pieces of half their
+	// previous length so that they follow the cartogram more closely.
+	RepairPasses int
+
+	// SharedVertices, if true, makes the transform methods snap together
+	// vertices within a millionth of a grid cell of each other and
+	// transform each boundary shared by neighboring polygons once, so
+	// that there are no gaps or slivers between them. Vertices that lie
+	// on a segment of another path are inserted into that segment, so
+	// the transformed paths and polygons can have more vertices than the
+	// input and their vertices can't be matched to the input's by index.
+	SharedVertices bool
 }
 
 func (c *Cartogram) Dims() (cols, rows int) { return c.cols, c.rows }
@@ -41,13 +102,12 @@ type PolygonDensity interface {
 	Density(int) float64
 }
 
-type gridCell struct {
-	geom.Polygon
-	i, j int
-}
-
 // NewCartogram creates a cartogram with the given margin
 // added to each border of the matrix and the given numbers of rows and columns.
+// By default, grid cells that are not covered by shapes are assigned the
+// area-weighted average density of shapes; opts can change this.
+// Areas and densities are planar, so shapes in longitudes and latitudes
+// should first be projected; see Features.EqualArea.
 //
 // It applies the cartogram creation algorithm described in the
 // article below:
@@ -55,121 +115,264 @@ type gridCell struct {
 // Gastner, M. T., & Newman, M. E. J. (2004). Diffusion-based method for
 // producing density-equalizing maps. Proc. Nat. Acad. of Sci., 101(20),
 // 7499–7504. http://doi.org/10.1073/pnas.0400280101
-func NewCartogram(shapes PolygonDensity, margin float64, rows, cols int) *Cartogram {
+func NewCartogram(shapes PolygonDensity, margin float64, rows, cols int, opts ...Option) *Cartogram {
+	return newCartogram(shapes, marginBounds(shapes, margin), rows, cols, opts)
+}
+
+// NewSquareCartogram creates a cartogram whose grid cells are squares
+// with sides of length cellSize in map units, as assumed by the
+// diffusion algorithm. The bounds of shapes, with the given margin
+// added to each border, are expanded equally on each side so that the
+// numbers of rows and columns are multiples only of 2, 3 and 5, which
+// are fast to Fourier transform. Use SquareCellSize to choose
+// cellSize for a target number of grid cells. opts are as for NewCartogram.
+func NewSquareCartogram(shapes PolygonDensity, margin, cellSize float64, opts ...Option) *Cartogram {
+	b := marginBounds(shapes, margin)
+	rows, cols := squareGrid(b, cellSize)
+	return newCartogram(shapes, b, rows, cols, opts)
+}
+
+// SquareCellSize returns the approximate smallest cell size for which
+// NewSquareCartogram creates a grid with no more than maxCells cells.
+// The smallest grid has 2×2 cells, so it panics if maxCells is less than
+// 4, and it panics if the bounds of shapes with the given margin added
+// are empty or have no width or height, as they do for a single point
+// with no margin.
+func SquareCellSize(shapes PolygonDensity, margin float64, maxCells int) float64 {
+	if maxCells < 4 {
+		panic("tilegram: maxCells must be at least 4")
+	}
+	b := marginBounds(shapes, margin)
+	w, h := b.Max.X-b.Min.X, b.Max.Y-b.Min.Y
+	if !(w > 0 && h > 0) || math.IsInf(w, 0) || math.IsInf(h, 0) {
+		panic("tilegram: shapes and margin have empty or degenerate bounds")
+	}
+	cellSize := math.Sqrt(w * h / float64(maxCells))
+	for {
+		bb := *b
+		rows, cols := squareGrid(&bb, cellSize)
+		if rows*cols <= maxCells {
+			return cellSize
+		}
+		cellSize *= 1.01
+	}
+}
+
+// marginBounds returns the bounds of shapes with margin
+// added to each border.
+func marginBounds(shapes PolygonDensity, margin float64) *geom.Bounds {
 	b := geom.NewBounds()
-	var avgDens float64
-	var totalArea float64
 	for i := 0; i < shapes.Len(); i++ {
-		p := shapes.Polygon(i)
-		ap := p.Area()
-		b.Extend(p.Bounds())
-		avgDens += shapes.Density(i) * ap
-		totalArea += ap
+		b.Extend(shapes.Polygon(i).Bounds())
 	}
-	avgDens /= totalArea
-
 	b.Min.X -= margin
 	b.Min.Y -= margin
 	b.Max.X += margin
 	b.Max.Y += margin
+	return b
+}
 
-	o := Cartogram{
-		b:     b,
-		dx:    (b.Max.X - b.Min.X) / float64(cols),
-		dy:    (b.Max.Y - b.Min.Y) / float64(rows),
-		index: rtree.NewTree(25, 50),
-		rows:  rows,
-		cols:  cols,
+// squareGrid returns FFT-friendly grid dimensions for square cells
+// of size cellSize covering b, expanding b to match the grid.
+func squareGrid(b *geom.Bounds, cellSize float64) (rows, cols int) {
+	if cellSize <= 0 {
+		panic("tilegram: cell size must be positive")
 	}
+	cols = fftSize(int(math.Ceil((b.Max.X - b.Min.X) / cellSize)))
+	rows = fftSize(int(math.Ceil((b.Max.Y - b.Min.Y) / cellSize)))
+	dx := (float64(cols)*cellSize - (b.Max.X - b.Min.X)) / 2
+	dy := (float64(rows)*cellSize - (b.Max.Y - b.Min.Y)) / 2
+	b.Min.X -= dx
+	b.Max.X += dx
+	b.Min.Y -= dy
+	b.Max.Y += dy
+	return rows, cols
+}
 
-	for j := 0; j < rows; j++ {
-		for i := 0; i < cols; i++ {
-			x := float64(i)*o.dx + o.b.Min.X
-			y := float64(j)*o.dy + o.b.Min.Y
-			gc := gridCell{
-				Polygon: geom.Polygon{{
-					geom.Point{X: x, Y: y},
-					geom.Point{X: x + o.dx, Y: y},
-					geom.Point{X: x + o.dx, Y: y + o.dy},
-					geom.Point{X: x, Y: y + o.dy},
-					geom.Point{X: x, Y: y},
-				}},
-				i: i,
-				j: j,
+// fftSize returns the smallest integer no less than n, and at least 2,
+// that has no prime factors other than 2, 3 and 5.
+func fftSize(n int) int {
+	if n < 2 {
+		return 2
+	}
+	for ; ; n++ {
+		m := n
+		for _, f := range []int{2, 3, 5} {
+			for m%f == 0 {
+				m /= f
 			}
-			o.index.Insert(&gc)
+		}
+		if m == 1 {
+			return n
 		}
 	}
+}
 
-	// Allocate C memory
-	lock.Lock()
-	C.cart_makews(C.int(cols), C.int(rows))
-	o.density = C.cart_dmalloc(C.int(cols), C.int(rows))
+// newCartogram creates a cartogram covering bounds b
+// with the given numbers of rows and columns.
+func newCartogram(shapes PolygonDensity, b *geom.Bounds, rows, cols int, opts []Option) *Cartogram {
+	o := newOptions(opts)
+	c := newGrid(b, rows, cols)
+	avgDens, minDens := densityStats(shapes)
+	m, background := c.backgroundDensity(o, avgDens, minDens)
+	if len(o.pinned) > 0 {
+		shapes = c.pin(shapes, o.pinned, avgDens)
+	}
+	c.addShapes(m, shapes, background)
+	blendDensity(m, o.strength)
+	c.dens = m
+	c.diffuse()
+	return c
+}
 
-	m := mat.NewDense(rows, cols, nil)
+// newGrid returns a cartogram, without density, covering bounds b
+// with the given numbers of rows and columns.
+func newGrid(b *geom.Bounds, rows, cols int) *Cartogram {
+	return &Cartogram{
+		b:    b,
+		dx:   (b.Max.X - b.Min.X) / float64(cols),
+		dy:   (b.Max.Y - b.Min.Y) / float64(rows),
+		rows: rows,
+		cols: cols,
+	}
+}
+
+// backgroundDensity returns a density grid for the receiver filled
+// with the background density set by o, given the average and minimum
+// densities of the input. It also returns the background density
+// inside the mask set by o, which is the same as the background
+// density outside the mask if there isn't one.
+func (c *Cartogram) backgroundDensity(o *options, avg, min float64) (*mat.Dense, float64) {
+	m := mat.NewDense(c.rows, c.cols, nil)
+	background := o.background(avg, min)
+	for j := 0; j < c.rows; j++ {
+		for i := 0; i < c.cols; i++ {
+			m.Set(j, i, background)
+		}
+	}
+	if o.mask != nil {
+		maskDens := o.maskBackground(avg, min)
+		c.addCoverage(m, o.mask, maskDens-background)
+		background = maskDens
+	}
+	return m, background
+}
+
+// blendDensity replaces each element d of density grid m with
+// (1-strength)*mean + strength*d, where mean is the average of m,
+// as for WithStrength.
+func blendDensity(m *mat.Dense, strength float64) {
+	if strength == 1 {
+		return
+	}
+	rows, cols := m.Dims()
+	var mean float64
+	for j := 0; j < rows; j++ {
+		for i := 0; i < cols; i++ {
+			mean += m.At(j, i)
+		}
+	}
+	mean /= float64(rows * cols)
 	for j := 0; j < rows; j++ {
 		for i := 0; i < cols; i++ {
-			m.Set(j, i, avgDens) // Set average density.
+			m.Set(j, i, (1-strength)*mean+strength*m.At(j, i))
 		}
 	}
+}
 
+// densityStats returns the area-weighted average density of shapes
+// and the minimum positive density of any of them.
+func densityStats(shapes PolygonDensity) (avg, min float64) {
+	var totalArea float64
+	min = math.Inf(1)
 	for i := 0; i < shapes.Len(); i++ {
-		p := shapes.Polygon(i)
-		v := shapes.Density(i)
-		for _, cI := range o.index.SearchIntersect(p.Bounds()) {
-			c := cI.(*gridCell)
-			a := c.Intersection(p).Area()
-			if a <= 0 {
-				continue
-			}
-			ac := c.Area()
-			m.Set(c.j, c.i, m.At(c.j, c.i)+(v-avgDens)*a/ac)
+		ap := shapes.Polygon(i).Area()
+		d := shapes.Density(i)
+		avg += d * ap
+		totalArea += ap
+		if d > 0 && d < min {
+			min = d
 		}
 	}
-	o.dens = m
+	return avg / totalArea, min
+}
 
-	for j := 0; j < rows; j++ {
-		for i := 0; i < cols; i++ {
-			C.cart_setrho(o.density, C.int(i), C.int(j), C.double(m.At(j, i)))
+// diffuse allocates the C workspace, waiting for any other cartogram
+// to be destroyed, and runs the diffusion algorithm on the
+// receiver's density grid.
+func (c *Cartogram) diffuse() {
+	lock.Lock()
+	c.live = true
+	C.cart_makews(C.int(c.cols), C.int(c.rows))
+	for k, p := range c.pinned {
+		if p {
+			C.cart_pin(C.int(k%(c.cols+1)), C.int(k/(c.cols+1)), C.int(c.cols), C.int(c.rows))
 		}
 	}
-	C.cart_transform(o.density, C.int(o.cols), C.int(o.rows))
-	C.cart_dfree(o.density)
-	return &o
+	c.density = C.cart_dmalloc(C.int(c.cols), C.int(c.rows))
+	for j := 0; j < c.rows; j++ {
+		for i := 0; i < c.cols; i++ {
+			C.cart_setrho(c.density, C.int(i), C.int(j), C.double(c.dens.At(j, i)))
+		}
+	}
+	C.cart_transform(c.density, C.int(c.cols), C.int(c.rows))
+	C.cart_dfree(c.density)
 }
 
 // TransformPoint moves a point to match a cartogram.
 func (c *Cartogram) TransformPoint(p geom.Point) geom.Point {
 	x, y := c.pointToGrid(p)
-	C.cart_makecartnooptions((*C.double)(unsafe.Pointer(&x[0])), (*C.double)(unsafe.Pointer(&y[0])), C.int(1), C.int(c.cols), C.int(c.rows), C.double(c.Blur))
+	c.transformGrid(x, y)
 	return c.pointFromGrid(x, y)
 }
 
+// TransformPath moves the vertices of a path to match a cartogram,
+// after densifying it according to the receiver's MaxSegment field.
 func (c *Cartogram) TransformPath(p geom.Path) geom.Path {
-	x, y := c.pathToGrid(p)
-	C.cart_makecartnooptions((*C.double)(unsafe.Pointer(&x[0])), (*C.double)(unsafe.Pointer(&y[0])), C.int(len(x)), C.int(c.cols), C.int(c.rows), C.double(c.Blur))
-	return c.pathFromGrid(x, y)
+	return c.transformPaths([]geom.Path{p}, nil)[0]
 }
 
+// transformGrid transforms points in grid units in place, either
+// by integrating them through the C workspace or, if the
+// workspace is no longer available, by interpolating between
+// the transformed grid vertices.
+func (c *Cartogram) transformGrid(x, y []float64) {
+	if len(x) == 0 {
+		return
+	}
+	if !c.live {
+		if c.gridX == nil {
+			panic("tilegram: cartogram has been destroyed")
+		}
+		c.interpolate(x, y)
+		return
+	}
+	threads := c.Threads
+	if threads <= 0 {
+		threads = runtime.GOMAXPROCS(0)
+	}
+	C.cart_makecartnooptions((*C.double)(unsafe.Pointer(&x[0])), (*C.double)(unsafe.Pointer(&y[0])), C.int(len(x)), C.int(c.cols), C.int(c.rows), C.double(c.Blur), C.int(threads))
+}
+
+// TransformPolygons moves the vertices of polygons to match a
+// cartogram, after densifying their rings according to the receiver's
+// MaxSegment field. Edges shared by rings are densified and simplified
+// identically, so shared borders remain shared.
 func (c *Cartogram) TransformPolygons(p []geom.Polygon) []geom.Polygon {
-	o := make([]geom.Polygon, len(p))
-	var path geom.Path
-	cuts := make([][][2]int, len(p))
-	var k int
+	var rings []geom.Path
+	var polygon []int
 	for i, poly := range p {
-		cuts[i] = make([][2]int, len(poly))
-		for j, ring := range poly {
-			path = append(path, ring...)
-			cuts[i][j] = [2]int{k, k + len(ring)}
-			k += len(ring)
+		rings = append(rings, poly...)
+		for range poly {
+			polygon = append(polygon, i)
 		}
 	}
-	path = c.TransformPath(path)
-	for i, cut := range cuts {
-		o[i] = make(geom.Polygon, len(cut))
-		for j, c := range cut {
-			o[i][j] = path[c[0]:c[1]]
-		}
+	rings = c.transformPaths(rings, polygon)
+	o := make([]geom.Polygon, len(p))
+	var k int
+	for i, poly := range p {
+		o[i] = make(geom.Polygon, len(poly))
+		k += copy(o[i], rings[k:k+len(poly)])
 	}
 	return o
 }
@@ -204,8 +407,15 @@ func (c *Cartogram) pathFromGrid(x, y []float64) geom.Path {
 }
 
 // Destroy frees the memory associated with the receiver. No other cartogram
-// can be created before this happens.
+// can be created before this happens. If the receiver has been
+// encoded or its displacement grid has otherwise been computed
+// (see Encode), it can still be used to transform points after
+// it has been destroyed.
 func (c *Cartogram) Destroy() {
+	if !c.live {
+		return
+	}
 	C.cart_freews(C.int(c.cols), C.int(c.rows))
+	c.live = false
 	lock.Unlock()
 }
@@ -0,0 +1,167 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"gonum.org/v1/gonum/mat"
+
+	"github.com/ctessum/geom"
+)
+
+// cartogramFileVersion is the version of the cartogram file format
+// written by Encode.
+const cartogramFileVersion = 1
+
+// cartogramFile is the serialized form of a Cartogram.
+type cartogramFile struct {
+	Version int
+
+	MinX, MinY, MaxX, MaxY float64
+	Rows, Cols             int
+	Blur                   float64
+
+	// Density is the density grid in row-major order.
+	Density []float64
+
+	// GridX and GridY are the transformed grid vertex locations.
+	GridX, GridY []float64
+
+	// Projection is the definition of the spatial reference
+	// of the grid. It is empty in files written before it was added.
+	Projection string
+}
+
+// Encode writes the receiver to w in a binary format that can be
+// read by DecodeCartogram. The result includes the grid bounds and
+// dimensions, the blur radius, the density grid, and the
+// displacement of every grid vertex, so the decoded cartogram can
+// transform points without recomputing the diffusion, and the
+// receiver's Projection.
+//
+// Computing the displacement grid requires the C workspace, so Encode
+// must be called before Destroy.
+func (c *Cartogram) Encode(w io.Writer) error {
+	if err := c.displacementGrid(); err != nil {
+		return err
+	}
+	f := cartogramFile{
+		Version: cartogramFileVersion,
+		MinX:    c.b.Min.X,
+		MinY:    c.b.Min.Y,
+		MaxX:    c.b.Max.X,
+		MaxY:    c.b.Max.Y,
+		Rows:    c.rows,
+		Cols:    c.cols,
+		Blur:    c.gridBlur,
+		Density: make([]float64, 0, c.rows*c.cols),
+		GridX:   c.gridX,
+		GridY:   c.gridY,
+
+		Projection: c.Projection,
+	}
+	for j := 0; j < c.rows; j++ {
+		for i := 0; i < c.cols; i++ {
+			f.Density = append(f.Density, c.dens.At(j, i))
+		}
+	}
+	return gob.NewEncoder(w).Encode(f)
+}
+
+// DecodeCartogram reads a cartogram that was written by Encode.
+// The result transforms points by interpolating the stored
+// displacement grid, so it does not hold the C workspace and
+// does not need to be destroyed. The grid was computed with the Blur
+// of the encoded cartogram, so changing the Blur or Threads fields of
+// the result has no effect. Its MaxSegment, Simplify, RepairPasses and
+// SharedVertices fields are applied as usual, but TransformFrames,
+// which needs the C workspace, panics.
+func DecodeCartogram(r io.Reader) (*Cartogram, error) {
+	var f cartogramFile
+	if err := gob.NewDecoder(r).Decode(&f); err != nil {
+		return nil, err
+	}
+	if f.Version != cartogramFileVersion {
+		return nil, fmt.Errorf("tilegram: unsupported cartogram file version %d", f.Version)
+	}
+	n := (f.Rows + 1) * (f.Cols + 1)
+	if f.Rows <= 0 || f.Cols <= 0 || len(f.Density) != f.Rows*f.Cols ||
+		len(f.GridX) != n || len(f.GridY) != n {
+		return nil, errors.New("tilegram: invalid cartogram file")
+	}
+	return &Cartogram{
+		b: &geom.Bounds{
+			Min: geom.Point{X: f.MinX, Y: f.MinY},
+			Max: geom.Point{X: f.MaxX, Y: f.MaxY},
+		},
+		rows:     f.Rows,
+		cols:     f.Cols,
+		dx:       (f.MaxX - f.MinX) / float64(f.Cols),
+		dy:       (f.MaxY - f.MinY) / float64(f.Rows),
+		dens:     mat.NewDense(f.Rows, f.Cols, f.Density),
+		gridX:    f.GridX,
+		gridY:    f.GridY,
+		gridBlur: f.Blur,
+		Blur:     f.Blur,
+
+		Projection: f.Projection,
+	}, nil
+}
+
+// displacementGrid calculates the transformed locations of the
+// receiver's grid vertices, if they have not already been calculated
+// with the current blur radius.
+func (c *Cartogram) displacementGrid() error {
+	if c.gridX != nil && (!c.live || c.gridBlur == c.Blur) {
+		return nil
+	}
+	if !c.live {
+		return errors.New("tilegram: cartogram has been destroyed")
+	}
+	w := c.cols + 1
+	x := make([]float64, w*(c.rows+1))
+	y := make([]float64, w*(c.rows+1))
+	for j := 0; j <= c.rows; j++ {
+		for i := 0; i <= c.cols; i++ {
+			x[j*w+i] = float64(i)
+			y[j*w+i] = float64(j)
+		}
+	}
+	c.transformGrid(x, y)
+	c.gridX, c.gridY, c.gridBlur = x, y, c.Blur
+	return nil
+}
+
+// interpolate transforms points in grid units in place by bilinear
+// interpolation between the transformed grid vertices.
+func (c *Cartogram) interpolate(x, y []float64) {
+	w := c.cols + 1
+	for k := range x {
+		xx := math.Max(0, math.Min(x[k], float64(c.cols)))
+		yy := math.Max(0, math.Min(y[k], float64(c.rows)))
+		i := int(xx)
+		if i == c.cols {
+			i--
+		}
+		j := int(yy)
+		if j == c.rows {
+			j--
+		}
+		dx, dy := xx-float64(i), yy-float64(j)
+		w00 := (1 - dx) * (1 - dy)
+		w10 := dx * (1 - dy)
+		w01 := (1 - dx) * dy
+		w11 := dx * dy
+		k00 := j*w + i
+		k01 := k00 + w
+		x[k] = w00*c.gridX[k00] + w10*c.gridX[k00+1] + w01*c.gridX[k01] + w11*c.gridX[k01+1]
+		y[k] = w00*c.gridY[k00] + w10*c.gridY[k00+1] + w01*c.gridY[k01] + w11*c.gridY[k01+1]
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import "github.com/ctessum/geom"
+
+// An Option changes how a cartogram is created.
+type Option func(*options)
+
+// options holds the settings changed by Options.
+type options struct {
+	background     Background
+	mask           geom.Polygonal
+	maskBackground Background
+	kernel         Kernel
+	strength       float64
+	pinned         []int
+
+	anchor           Anchor
+	referenceDensity float64
+}
+
+// newOptions returns the settings resulting from applying opts
+// to the defaults.
+func newOptions(opts []Option) *options {
+	o := &options{background: AverageDensity, kernel: GaussianKernel, strength: 1, anchor: CentroidAnchor}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// Background calculates the density of the parts of a cartogram that
+// are not covered by any input polygon (the "sea"), given the
+// area-weighted average density of the input polygons and the
+// minimum positive density of any of them.
+type Background func(average, minimum float64) float64
+
+// AverageDensity is a Background that uses the average density of
+// the input polygons, so that uncovered areas keep their size.
+// It is the default.
+func AverageDensity(average, minimum float64) float64 { return average }
+
+// FixedDensity returns a Background with density d.
+func FixedDensity(d float64) Background {
+	return func(_, _ float64) float64 { return d }
+}
+
+// MinimumDensity returns a Background with density equal to the given
+// fraction of the minimum positive density of the input polygons.
+// Values of fraction less than one make uncovered areas shrink
+// relative to all input polygons.
+func MinimumDensity(fraction float64) Background {
+	return func(_, minimum float64) float64 { return fraction * minimum }
+}
+
+// WithBackground sets the density of the parts of a cartogram that are
+// not covered by any input polygon or by the mask set by WithMask.
+func WithBackground(b Background) Option {
+	return func(o *options) { o.background = b }
+}
+
+// WithMask sets a mask, such as the land area of a map, inside of which
+// the parts of a cartogram that are not covered by any input polygon
+// have density background instead of the density set by WithBackground.
+// The input polygons are assumed to lie within the mask.
+func WithMask(mask geom.Polygonal, background Background) Option {
+	return func(o *options) {
+		o.mask = mask
+		o.maskBackground = background
+	}
+}
+
+// WithStrength makes a partial cartogram, whose areas move only partway
+// from the original map toward being proportional to density. The
+// density of each grid cell, including the background, is replaced by
+// (1-strength)*mean + strength*density before diffusion, where mean is
+// the average density of the grid, so that the area of each cell in the
+// cartogram is approximately (1-strength) times its original area plus
+// strength times its area in the full cartogram. A strength of zero
+// leaves the map unchanged and one, the default, makes a full
+// cartogram. WithStrength panics if strength is not between zero and one.
+func WithStrength(strength float64) Option {
+	if !(strength >= 0 && strength <= 1) {
+		panic("tilegram: strength must be between 0 and 1")
+	}
+	return func(o *options) { o.strength = strength }
+}
+
+// WithPinned pins the input polygons with the given indices, such as a
+// region of interest or the frame of an inset map, so that they keep
+// their shape and position while the rest of the cartogram equalizes
+// density around them. The velocity of the diffusion is held at zero at
+// every vertex of the grid cells that the pinned polygons cover, and
+// the pinned polygons are given the average density of the input, so
+// that the rest of the map is neither drawn into them nor pushed out of
+// them. The surrounding polygons then have to absorb the difference, so
+// their areas are less accurate; use NewAreaReport to measure the cost.
+// Only NewCartogram and NewSquareCartogram pin polygons.
+func WithPinned(indices ...int) Option {
+	return func(o *options) { o.pinned = append(o.pinned, indices...) }
+}
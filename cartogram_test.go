@@ -0,0 +1,291 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+// testDensity returns a simple cartogram input with a single
+// dense square surrounded by four sparse ones.
+func testDensity() *Features {
+	sq := func(x, y float64) geom.Polygon {
+		return geom.Polygon{{{X: x, Y: y}, {X: x + 1, Y: y}, {X: x + 1, Y: y + 1}, {X: x, Y: y + 1}, {X: x, Y: y}}}
+	}
+	return &Features{
+		Polygons: []geom.Polygonal{sq(1, 1), sq(0, 1), sq(2, 1), sq(1, 0), sq(1, 2)},
+		Weights:  []float64{10, 1, 1, 1, 1},
+		Groups:   []string{"a", "b", "b", "b", "b"},
+	}
+}
+
+func TestCartogramEncode(t *testing.T) {
+	c := NewCartogram(testDensity(), 1, 30, 30)
+	c.Blur = 1
+	c.Projection = LonLatWGS84
+
+	// Grid vertices, where interpolating the stored grid is exact, and
+	// points inside cells and polygon vertices, where it is not.
+	var pts, inside geom.Path
+	for j := 0; j <= 30; j += 5 {
+		for i := 0; i <= 30; i += 5 {
+			pts = append(pts, geom.Point{X: c.X(i), Y: c.Y(j)})
+			if i < 30 && j < 30 {
+				inside = append(inside, geom.Point{X: c.X(i) + 0.37*c.dx, Y: c.Y(j) + 0.61*c.dy})
+			}
+		}
+	}
+	var polygons []geom.Polygon
+	for _, p := range testDensity().Polygons {
+		polygons = append(polygons, p.(geom.Polygon))
+	}
+	want := c.TransformPath(pts)
+	wantInside := c.TransformPath(inside)
+	wantPolygons := c.TransformPolygons(polygons)
+
+	var buf bytes.Buffer
+	if err := c.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	c.Destroy()
+
+	c2, err := DecodeCartogram(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cols, rows := c2.Dims(); cols != 30 || rows != 30 {
+		t.Errorf("dims: have %d×%d, want 30×30", cols, rows)
+	}
+	if c2.Projection != LonLatWGS84 {
+		t.Errorf("projection: have %q, want %q", c2.Projection, LonLatWGS84)
+	}
+	have := c2.TransformPath(pts)
+	for i, p := range have {
+		if d := math.Hypot(p.X-want[i].X, p.Y-want[i].Y); d > 0.01*c.dx {
+			t.Errorf("point %d: have %v, want %v", i, p, want[i])
+		}
+	}
+	// Elsewhere, the interpolated points are within a twentieth of a grid
+	// cell of those integrated by the original cartogram.
+	for i, p := range c2.TransformPath(inside) {
+		if d := math.Hypot(p.X-wantInside[i].X, p.Y-wantInside[i].Y); d > 0.05*c.dx {
+			t.Errorf("point %d inside a cell: have %v, want %v", i, p, wantInside[i])
+		}
+	}
+	for i, p := range c2.TransformPolygons(polygons) {
+		for j, v := range p[0] {
+			w := wantPolygons[i][0][j]
+			if d := math.Hypot(v.X-w.X, v.Y-w.Y); d > 0.05*c.dx {
+				t.Errorf("polygon %d vertex %d: have %v, want %v", i, j, v, w)
+			}
+		}
+	}
+	if have := c2.TransformPoint(pts[8]); have != c2.TransformPath(pts[8:9])[0] {
+		t.Errorf("TransformPoint and TransformPath don't match: %v", have)
+	}
+	// The blur was applied when the grid was computed.
+	c2.Blur = 5
+	if p := c2.TransformPoint(pts[8]); p != have[8] {
+		t.Errorf("changing the blur of a decoded cartogram moved %v to %v", have[8], p)
+	}
+	c2.Destroy() // Should be a no-op.
+}
+
+func TestFFTSize(t *testing.T) {
+	for n, want := range map[int]int{0: 2, 1: 2, 2: 2, 7: 8, 11: 12, 13: 15, 31: 32, 97: 100, 121: 125, 1000: 1000, 1001: 1024} {
+		if have := fftSize(n); have != want {
+			t.Errorf("fftSize(%d): have %d, want %d", n, have, want)
+		}
+	}
+}
+
+func TestNewSquareCartogram(t *testing.T) {
+	shapes := testDensity()
+	const maxCells = 1000
+	cellSize := SquareCellSize(shapes, 0.5, maxCells)
+	c := NewSquareCartogram(shapes, 0.5, cellSize)
+	defer c.Destroy()
+
+	cols, rows := c.Dims()
+	if rows*cols > maxCells || rows*cols < maxCells/3 {
+		t.Errorf("%d×%d grid is not close to %d cells", cols, rows, maxCells)
+	}
+	if rows != fftSize(rows) || cols != fftSize(cols) {
+		t.Errorf("%d×%d grid is not FFT-friendly", cols, rows)
+	}
+	if math.Abs(c.dx-cellSize) > 1e-9 || math.Abs(c.dy-cellSize) > 1e-9 {
+		t.Errorf("cells are %g×%g, want %g×%g", c.dx, c.dy, cellSize, cellSize)
+	}
+	if c.b.Min.X > -0.5 || c.b.Min.Y > -0.5 || c.b.Max.X < 3.5 || c.b.Max.Y < 3.5 {
+		t.Errorf("bounds %v don't include shapes and margin", c.b)
+	}
+	// The grid is centered on the shapes.
+	if d := c.b.Min.X + c.b.Max.X - 3; math.Abs(d) > 1e-9 {
+		t.Errorf("grid is not centered: %v", c.b)
+	}
+}
+
+func TestSquareCellSizeInvalid(t *testing.T) {
+	point := &Features{
+		Polygons: []geom.Polygonal{geom.Polygon{{{X: 1, Y: 1}, {X: 1, Y: 1}, {X: 1, Y: 1}}}},
+		Weights:  []float64{1},
+		Groups:   []string{""},
+	}
+	for _, test := range []struct {
+		name     string
+		shapes   PolygonDensity
+		margin   float64
+		maxCells int
+	}{
+		{name: "too few cells", shapes: testDensity(), maxCells: 3},
+		{name: "no cells", shapes: testDensity(), maxCells: 0},
+		{name: "point", shapes: point, maxCells: 100},
+		{name: "empty", shapes: &Features{}, margin: 1, maxCells: 100},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("no panic")
+				}
+			}()
+			SquareCellSize(test.shapes, test.margin, test.maxCells)
+		})
+	}
+	// A margin gives a point an area to cover.
+	if s := SquareCellSize(point, 1, 4); !(s >= 1) {
+		t.Errorf("cell size for a point with a margin: %g", s)
+	}
+}
+
+func TestCartogramBackground(t *testing.T) {
+	mask := geom.Polygon{{{X: -0.5, Y: -0.5}, {X: 3.5, Y: -0.5}, {X: 3.5, Y: 3.5}, {X: -0.5, Y: 3.5}, {X: -0.5, Y: -0.5}}}
+	for _, test := range []struct {
+		name                  string
+		opts                  []Option
+		outside, inside, land float64
+	}{
+		{name: "default", outside: 14.0 / 5, inside: 14.0 / 5, land: 10},
+		{name: "fixed", opts: []Option{WithBackground(FixedDensity(2))}, outside: 2, inside: 2, land: 10},
+		{name: "minimum", opts: []Option{WithBackground(MinimumDensity(0.5))}, outside: 0.5, inside: 0.5, land: 10},
+		{
+			name:    "mask",
+			opts:    []Option{WithBackground(FixedDensity(0.1)), WithMask(mask, FixedDensity(3))},
+			outside: 0.1, inside: 3, land: 10,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// The grid cells are 1/6 wide, starting at -1.
+			c := NewCartogram(testDensity(), 1, 30, 30, test.opts...)
+			defer c.Destroy()
+			for _, cell := range []struct {
+				col, row int
+				want     float64
+			}{{0, 0, test.outside}, {7, 7, test.inside}, {15, 15, test.land}} {
+				if have := c.Z(cell.col, cell.row); math.Abs(have-cell.want) > 1e-9 {
+					t.Errorf("density at (%d, %d): have %g, want %g", cell.col, cell.row, have, cell.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCartogramStrength(t *testing.T) {
+	f := testDensity()
+	g := []geom.Geom{f.Polygons[0]}
+	area := func(strength float64) (a, z float64) {
+		c := NewCartogram(f, 1, 30, 30, WithStrength(strength))
+		defer c.Destroy()
+		return c.TransformGeoms(g)[0].(geom.Polygon).Area(), c.Z(15, 15)
+	}
+	full, _ := area(1)
+	if a, _ := area(0); math.Abs(a-1) > 1e-9 {
+		t.Errorf("strength 0: have area %g, want 1", a)
+	}
+	// The center square's density is halfway between the grid's
+	// mean of 2.8 and 10, so its area is about halfway between
+	// its original and full cartogram areas.
+	half, z := area(0.5)
+	if math.Abs(z-6.4) > 1e-9 {
+		t.Errorf("strength 0.5: have density %g, want 6.4", z)
+	}
+	if want := (1 + full) / 2; math.Abs(half-want) > 0.05*want {
+		t.Errorf("strength 0.5: have area %g, want about %g", half, want)
+	}
+
+	for _, strength := range []float64{-0.1, 1.5, math.NaN()} {
+		t.Run(fmt.Sprint(strength), func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("no panic")
+				}
+			}()
+			WithStrength(strength)
+		})
+	}
+}
+
+func TestTransformThreads(t *testing.T) {
+	c := NewCartogram(testDensity(), 1, 30, 30)
+	defer c.Destroy()
+	c.Blur = 1
+
+	// Enough points to be divided between threads.
+	var pts geom.Path
+	for j := 0; j < 100; j++ {
+		for i := 0; i < 100; i++ {
+			pts = append(pts, geom.Point{X: -1 + float64(i)*0.05, Y: -1 + float64(j)*0.05})
+		}
+	}
+	c.Threads = 1
+	want := c.TransformPath(pts)
+	for _, threads := range []int{2, 3, 8} {
+		c.Threads = threads
+		have := c.TransformPath(pts)
+		for i, p := range have {
+			if p != want[i] {
+				t.Errorf("%d threads: point %d: have %v, want %v", threads, i, p, want[i])
+				break
+			}
+		}
+	}
+}
+
+// BenchmarkTransformThreads measures how transforming a large number of
+// points scales with the number of threads. The vertices of the
+// Washington block groups are repeated to make the point integration,
+// rather than the calculation of the velocity grids, dominate.
+func BenchmarkTransformThreads(b *testing.B) {
+	f, err := ReadShapefile("testdata/WA_Population_2010.shp", "population", "county")
+	if err != nil {
+		b.Fatal(err)
+	}
+	var path geom.Path
+	for _, p := range f.Polygons {
+		for _, pp := range p.Polygons() {
+			for _, r := range pp {
+				path = append(path, r...)
+			}
+		}
+	}
+	for len(path) < 400000 {
+		path = append(path, path...)
+	}
+	c := NewSquareCartogram(f, 20000, SquareCellSize(f, 20000, 64*128))
+	defer c.Destroy()
+	c.Blur = 3
+	for _, threads := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("threads=%d", threads), func(b *testing.B) {
+			c.Threads = threads
+			for i := 0; i < b.N; i++ {
+				c.TransformPath(path)
+			}
+		})
+	}
+}
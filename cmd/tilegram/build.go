@@ -0,0 +1,469 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ctessum/geom/proj"
+	"github.com/ctessum/tilegram"
+	"gopkg.in/yaml.v2"
+)
+
+// runBuild runs the build command, which creates the outputs
+// described by a build configuration file.
+func runBuild(args []string) error {
+	fs := flag.NewFlagSet("build", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: tilegram build [-force] config")
+		fs.PrintDefaults()
+	}
+	force := fs.Bool("force", false, "run all stages, even those whose inputs and parameters have not changed")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("exactly one configuration file must be specified")
+	}
+	return build(fs.Arg(0), *force, os.Stderr)
+}
+
+// buildConfig is a build configuration. It is read from a YAML or
+// JSON file, and relative file names in it are relative to the
+// directory holding that file. For example:
+//
+//	input:
+//	  file: counties.shp
+//	  weight: population
+//	  group: state
+//	  projection: +proj=longlat +datum=WGS84
+//	projection: +proj=aea +lat_1=29.5 +lat_2=45.5 +lon_0=-96 +datum=NAD83
+//	cartogram:
+//	  margin: 500000
+//	  blur: 3
+//	hexagram:
+//	  tiles: 500
+//	outputs:
+//	  hexagons: hexagons.geojson
+//	  groups: states.geojson
+type buildConfig struct {
+	Input buildInput `yaml:"input" json:"input"`
+
+	// Projection, if set, is the proj4 definition of the projection
+	// the input features are transformed to before the cartogram is
+	// computed. The projection of the input must then be known. If it
+	// is not set, input in longitude and latitude is transformed to
+	// an equal-area projection.
+	Projection string `yaml:"projection,omitempty" json:"projection,omitempty"`
+
+	Cartogram cartogramConfig `yaml:"cartogram" json:"cartogram"`
+	Hexagram  hexagramConfig  `yaml:"hexagram" json:"hexagram"`
+	Outputs   buildOutputs    `yaml:"outputs" json:"outputs"`
+}
+
+// buildInput describes the input features of a build.
+type buildInput struct {
+	// File is a shapefile or GeoJSON file.
+	File string `yaml:"file" json:"file"`
+
+	// Weight and Group are the names of the fields holding
+	// the weight and group of each feature.
+	Weight string `yaml:"weight" json:"weight"`
+	Group  string `yaml:"group,omitempty" json:"group,omitempty"`
+
+	// Projection is the proj4 definition of the projection of File.
+	// If it is not set, the projection is read from the .prj file
+	// of a shapefile.
+	Projection string `yaml:"projection,omitempty" json:"projection,omitempty"`
+}
+
+// cartogramConfig holds the cartogram parameters of a build.
+// See the make command for their meaning.
+type cartogramConfig struct {
+	Rows     int      `yaml:"rows" json:"rows"`
+	Cols     int      `yaml:"cols" json:"cols"`
+	Cells    int      `yaml:"cells,omitempty" json:"cells,omitempty"`
+	Margin   float64  `yaml:"margin" json:"margin"`
+	Blur     float64  `yaml:"blur" json:"blur"`
+	Strength *float64 `yaml:"strength,omitempty" json:"strength,omitempty"`
+
+	MaxSegment float64 `yaml:"maxSegment,omitempty" json:"maxSegment,omitempty"`
+	Simplify   float64 `yaml:"simplify,omitempty" json:"simplify,omitempty"`
+	Repair     int     `yaml:"repair,omitempty" json:"repair,omitempty"`
+
+	RubberSheet int `yaml:"rubberSheet,omitempty" json:"rubberSheet,omitempty"`
+}
+
+// hexagramConfig holds the hexagram parameters of a build.
+// See the make command for their meaning.
+type hexagramConfig struct {
+	Radius    float64 `yaml:"radius" json:"radius"`
+	Tiles     int     `yaml:"tiles" json:"tiles"`
+	Tolerance float64 `yaml:"tolerance" json:"tolerance"`
+}
+
+// buildOutputs holds the names of the output files of a build.
+// Outputs that are not set are not created.
+type buildOutputs struct {
+	Cartogram string `yaml:"cartogram,omitempty" json:"cartogram,omitempty"`
+	Transform string `yaml:"transform,omitempty" json:"transform,omitempty"`
+	Hexagons  string `yaml:"hexagons,omitempty" json:"hexagons,omitempty"`
+	Groups    string `yaml:"groups,omitempty" json:"groups,omitempty"`
+	Hexagram  string `yaml:"hexagram,omitempty" json:"hexagram,omitempty"`
+
+	// Manifest is the file that the effective configuration, the
+	// checksums of the input and output files, and the state of each
+	// stage are written to. It defaults to the configuration file name
+	// with the extension replaced by ".manifest.json".
+	Manifest string `yaml:"manifest,omitempty" json:"manifest,omitempty"`
+
+	// Cache is the directory where intermediate results are kept so
+	// that later stages can be rerun without rerunning earlier ones.
+	// It defaults to the configuration file name with the extension
+	// replaced by ".cache".
+	Cache string `yaml:"cache,omitempty" json:"cache,omitempty"`
+}
+
+// readBuildConfig reads a build configuration from the named file,
+// filling in default values.
+func readBuildConfig(filename string) (*buildConfig, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var c buildConfig
+	// JSON is a subset of YAML, so both are read the same way.
+	if err := yaml.UnmarshalStrict(b, &c); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	base := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	if c.Cartogram.Rows == 0 {
+		c.Cartogram.Rows = defaultRows
+	}
+	if c.Cartogram.Cols == 0 {
+		c.Cartogram.Cols = defaultCols
+	}
+	if c.Outputs.Manifest == "" {
+		c.Outputs.Manifest = base + ".manifest.json"
+	}
+	if c.Outputs.Cache == "" {
+		c.Outputs.Cache = base + ".cache"
+	}
+
+	o := c.Outputs
+	switch {
+	case c.Input.File == "":
+		return nil, fmt.Errorf("%s: input file must be set", filename)
+	case c.Input.Weight == "":
+		return nil, fmt.Errorf("%s: input weight field must be set", filename)
+	case c.Cartogram.Cells != 0 && c.Cartogram.Cells < 4:
+		return nil, fmt.Errorf("%s: cartogram cells must be 0 or at least 4", filename)
+	case c.Cartogram.Strength != nil && !(*c.Cartogram.Strength >= 0 && *c.Cartogram.Strength <= 1):
+		return nil, fmt.Errorf("%s: cartogram strength must be between 0 and 1", filename)
+	case o.Cartogram == "" && o.Transform == "" && !c.hasHexagram():
+		return nil, fmt.Errorf("%s: no outputs specified", filename)
+	case c.hasHexagram() && c.Hexagram.Radius <= 0 && c.Hexagram.Tiles <= 0:
+		return nil, fmt.Errorf("%s: hexagram radius or tiles must be set", filename)
+	}
+	return &c, nil
+}
+
+// hasHexagram returns whether the receiver has any outputs that
+// require a hexagram.
+func (c *buildConfig) hasHexagram() bool {
+	return c.Outputs.Hexagons != "" || c.Outputs.Groups != "" || c.Outputs.Hexagram != ""
+}
+
+// buildManifest records a build so that later builds can skip
+// stages whose inputs and parameters have not changed.
+type buildManifest struct {
+	// Config is the effective configuration of the build.
+	Config *buildConfig `json:"config"`
+
+	// Inputs holds the SHA-256 checksum of each input file.
+	Inputs map[string]string `json:"inputs"`
+
+	// Stages holds the state of each stage that has been run.
+	Stages map[string]*stageRecord `json:"stages"`
+}
+
+// stageRecord is the state of a build stage.
+type stageRecord struct {
+	// Key is a checksum of everything that determines the results
+	// of the stage: the input checksums and the parameters of the
+	// stage and all earlier stages.
+	Key string `json:"key"`
+
+	// Outputs holds the SHA-256 checksum of each file written
+	// by the stage.
+	Outputs map[string]string `json:"outputs"`
+}
+
+// Names of build stages.
+const (
+	stageCartogram = "cartogram"
+	stageHexagram  = "hexagram"
+)
+
+// cacheFeatures is the name of the file in the cache directory that
+// holds the cartogram-transformed features.
+const cacheFeatures = "cartogram.geojson"
+
+// build creates the outputs described by the configuration in the named
+// file, skipping stages that have already been run with the same
+// inputs and parameters unless force is true. Progress messages are
+// written to log.
+func build(filename string, force bool, log io.Writer) error {
+	c, err := readBuildConfig(filename)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(filename)
+	path := func(name string) string {
+		if name == "" || filepath.IsAbs(name) {
+			return name
+		}
+		return filepath.Join(dir, name)
+	}
+	cache := path(c.Outputs.Cache)
+	if err := os.MkdirAll(cache, 0755); err != nil {
+		return err
+	}
+
+	var old buildManifest
+	if b, err := os.ReadFile(path(c.Outputs.Manifest)); err == nil {
+		// A manifest that can't be read is treated as missing,
+		// so that all stages are rerun.
+		json.Unmarshal(b, &old)
+	}
+	m := &buildManifest{
+		Config: c,
+		Inputs: make(map[string]string),
+		Stages: make(map[string]*stageRecord),
+	}
+	for _, f := range inputFiles(path(c.Input.File)) {
+		sum, err := fileChecksum(f)
+		if err != nil {
+			return err
+		}
+		m.Inputs[f] = sum
+	}
+
+	cartoKey := checksum(m.Inputs, c.Input, c.Projection, c.Cartogram)
+	cartoOut := map[string]string{
+		filepath.Join(cache, cacheFeatures): "",
+		path(c.Outputs.Cartogram):           "",
+		path(c.Outputs.Transform):           "",
+	}
+	delete(cartoOut, "")
+	var carto *tilegram.Features
+	if !force && old.Stages[stageCartogram].upToDate(cartoKey, cartoOut) {
+		fmt.Fprintln(log, "cartogram: up to date")
+		m.Stages[stageCartogram] = old.Stages[stageCartogram]
+	} else {
+		f, err := tilegram.ReadFeatures(path(c.Input.File), c.Input.Weight, c.Input.Group)
+		if err != nil {
+			return err
+		}
+		var def string
+		if f, def, err = projectInput(f, c, path(c.Input.File)); err != nil {
+			return err
+		}
+		p := pipeline{Rows: c.Cartogram.Rows, Cols: c.Cartogram.Cols, Cells: c.Cartogram.Cells, Margin: c.Cartogram.Margin, Blur: c.Cartogram.Blur,
+			Strength: c.Cartogram.Strength, MaxSegment: c.Cartogram.MaxSegment, Simplify: c.Cartogram.Simplify, RepairPasses: c.Cartogram.Repair,
+			RubberSheet: c.Cartogram.RubberSheet}
+		var withCartogram func(*tilegram.Cartogram) error
+		if c.Outputs.Transform != "" {
+			withCartogram = func(cg *tilegram.Cartogram) error {
+				return writeTransform(path(c.Outputs.Transform), cg, def)
+			}
+		}
+		progress := func(stage string) { fmt.Fprintf(log, "cartogram: %s\n", stage) }
+		if carto, err = p.cartogram(f, progress, withCartogram); err != nil {
+			return err
+		}
+		if err := writeTiles(filepath.Join(cache, cacheFeatures), carto.Tiles()); err != nil {
+			return err
+		}
+		if c.Outputs.Cartogram != "" {
+			if err := writeTiles(path(c.Outputs.Cartogram), carto.Tiles()); err != nil {
+				return err
+			}
+		}
+		if m.Stages[stageCartogram], err = newStageRecord(cartoKey, cartoOut); err != nil {
+			return err
+		}
+	}
+
+	if c.hasHexagram() {
+		hexKey := checksum(cartoKey, c.Hexagram)
+		hexOut := map[string]string{
+			path(c.Outputs.Hexagons): "",
+			path(c.Outputs.Groups):   "",
+			path(c.Outputs.Hexagram): "",
+		}
+		delete(hexOut, "")
+		if !force && carto == nil && old.Stages[stageHexagram].upToDate(hexKey, hexOut) {
+			fmt.Fprintln(log, "hexagram: up to date")
+			m.Stages[stageHexagram] = old.Stages[stageHexagram]
+		} else {
+			if carto == nil {
+				// The cartogram stage was skipped, so its results
+				// are read from the cache.
+				carto, err = tilegram.ReadFeatures(filepath.Join(cache, cacheFeatures), "weight", "group")
+				if err != nil {
+					return err
+				}
+			}
+			p := pipeline{Radius: c.Hexagram.Radius, Tiles: c.Hexagram.Tiles, Tolerance: c.Hexagram.Tolerance}
+			progress := func(stage string) { fmt.Fprintf(log, "hexagram: %s\n", stage) }
+			h, groups, err := p.hexagram(carto, progress)
+			if err != nil {
+				return err
+			}
+			if c.Outputs.Hexagons != "" {
+				if err := writeTiles(path(c.Outputs.Hexagons), h.Tiles()); err != nil {
+					return err
+				}
+			}
+			if c.Outputs.Groups != "" {
+				if err := writeTiles(path(c.Outputs.Groups), groups); err != nil {
+					return err
+				}
+			}
+			if c.Outputs.Hexagram != "" {
+				if err := writeHexagram(path(c.Outputs.Hexagram), h); err != nil {
+					return err
+				}
+			}
+			if m.Stages[stageHexagram], err = newStageRecord(hexKey, hexOut); err != nil {
+				return err
+			}
+		}
+	}
+
+	b, err := json.MarshalIndent(m, "", " ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path(c.Outputs.Manifest), append(b, '\n'), 0644)
+}
+
+// newStageRecord returns a record of a stage with the given key
+// that created the given output files.
+func newStageRecord(key string, outputs map[string]string) (*stageRecord, error) {
+	r := &stageRecord{Key: key, Outputs: make(map[string]string)}
+	for f := range outputs {
+		sum, err := fileChecksum(f)
+		if err != nil {
+			return nil, err
+		}
+		r.Outputs[f] = sum
+	}
+	return r, nil
+}
+
+// upToDate returns whether the receiver records a stage with the
+// given key that created the given output files, and whether those
+// files have not changed since.
+func (r *stageRecord) upToDate(key string, outputs map[string]string) bool {
+	if r == nil || r.Key != key || len(r.Outputs) != len(outputs) {
+		return false
+	}
+	for f, sum := range r.Outputs {
+		if _, ok := outputs[f]; !ok {
+			return false
+		}
+		if s, err := fileChecksum(f); err != nil || s != sum {
+			return false
+		}
+	}
+	return true
+}
+
+// inputFiles returns the files that make up the named input file,
+// which for a shapefile includes the files holding the attributes,
+// index and projection.
+func inputFiles(filename string) []string {
+	o := []string{filename}
+	if ext := filepath.Ext(filename); strings.ToLower(ext) == ".shp" {
+		base := strings.TrimSuffix(filename, ext)
+		for _, e := range []string{".shx", ".dbf", ".prj", ".cpg"} {
+			for _, f := range []string{base + e, base + strings.ToUpper(e)} {
+				if _, err := os.Stat(f); err == nil {
+					o = append(o, f)
+					break
+				}
+			}
+		}
+	}
+	sort.Strings(o)
+	return o
+}
+
+// fileChecksum returns the hex-encoded SHA-256 checksum
+// of the contents of the named file.
+func fileChecksum(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checksum returns the hex-encoded SHA-256 checksum
+// of the JSON encoding of v.
+func checksum(v ...interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// projectInput returns features f, read from filename, the input of
+// build configuration c, in the projection that the cartogram is computed in,
+// along with the definition of that projection, as returned by
+// projectionDefinition.
+func projectInput(f *tilegram.Features, c *buildConfig, filename string) (*tilegram.Features, string, error) {
+	if c.Input.Projection != "" {
+		sr, err := proj.Parse(c.Input.Projection)
+		if err != nil {
+			return nil, "", err
+		}
+		f.SR = sr
+	}
+	if c.Projection == "" {
+		def, err := projectionDefinition(f, filename, c.Input.Projection)
+		if err != nil {
+			return nil, "", err
+		}
+		f, err = f.EqualArea()
+		return f, def, err
+	}
+	sr, err := proj.Parse(c.Projection)
+	if err != nil {
+		return nil, "", err
+	}
+	f, err = f.Project(sr)
+	return f, c.Projection, err
+}
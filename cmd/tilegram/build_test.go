@@ -0,0 +1,140 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuild(t *testing.T) {
+	dir := t.TempDir()
+	writeTestInput(t, dir)
+	config := filepath.Join(dir, "build.yaml")
+	writeConfig := func(tiles int) {
+		c := fmt.Sprintf(`input:
+  file: in.geojson
+  weight: pop
+  group: state
+cartogram:
+  rows: 32
+  cols: 32
+  margin: 1
+hexagram:
+  tiles: %d
+outputs:
+  cartogram: carto.geojson
+  transform: carto.gob
+  hexagons: hex.geojson
+  groups: groups.svg
+`, tiles)
+		if err := os.WriteFile(config, []byte(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runBuild := func(force bool) string {
+		var log bytes.Buffer
+		if err := build(config, force, &log); err != nil {
+			t.Fatal(err)
+		}
+		return log.String()
+	}
+
+	writeConfig(12)
+	log := runBuild(false)
+	for _, stage := range []string{"cartogram: computing cartogram", "hexagram: allocating hexagons"} {
+		if !strings.Contains(log, stage) {
+			t.Errorf("first build: log does not contain %q:\n%s", stage, log)
+		}
+	}
+	for _, f := range []string{"carto.geojson", "carto.gob", "hex.geojson", "groups.svg", "build.manifest.json"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); err != nil {
+			t.Error(err)
+		}
+	}
+	hex, err := os.ReadFile(filepath.Join(dir, "hex.geojson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "build.manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m buildManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Config.Cartogram.Rows != 32 || m.Config.Hexagram.Tiles != 12 {
+		t.Errorf("manifest config: %+v", m.Config)
+	}
+	if sum, err := fileChecksum(filepath.Join(dir, "in.geojson")); err != nil || m.Inputs[filepath.Join(dir, "in.geojson")] != sum {
+		t.Errorf("manifest inputs: %v", m.Inputs)
+	}
+	if len(m.Stages[stageCartogram].Outputs) != 3 || len(m.Stages[stageHexagram].Outputs) != 2 {
+		t.Errorf("manifest stages: %+v, %+v", m.Stages[stageCartogram], m.Stages[stageHexagram])
+	}
+
+	if log := runBuild(false); log != "cartogram: up to date\nhexagram: up to date\n" {
+		t.Errorf("unchanged build: log:\n%s", log)
+	}
+
+	// Changing an output causes its stage to be rerun, recreating it.
+	if err := os.WriteFile(filepath.Join(dir, "hex.geojson"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	log = runBuild(false)
+	if !strings.Contains(log, "cartogram: up to date") || !strings.Contains(log, "hexagram: allocating hexagons") {
+		t.Errorf("changed output: log:\n%s", log)
+	}
+	hex2, err := os.ReadFile(filepath.Join(dir, "hex.geojson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(hex, hex2) {
+		t.Error("hexagons created from cached cartogram differ from original")
+	}
+
+	writeConfig(16)
+	log = runBuild(false)
+	if !strings.Contains(log, "cartogram: up to date") || !strings.Contains(log, "hexagram: allocating hexagons") {
+		t.Errorf("changed hexagram parameters: log:\n%s", log)
+	}
+
+	if log := runBuild(true); !strings.Contains(log, "cartogram: computing cartogram") {
+		t.Errorf("forced build: log:\n%s", log)
+	}
+}
+
+func TestBuildConfigJSON(t *testing.T) {
+	dir := t.TempDir()
+	writeTestInput(t, dir)
+	config := filepath.Join(dir, "build.json")
+	c := `{"input": {"file": "in.geojson", "weight": "pop"},
+"cartogram": {"rows": 16, "cols": 16, "margin": 1},
+"outputs": {"cartogram": "carto.geojson"}}`
+	if err := os.WriteFile(config, []byte(c), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var log bytes.Buffer
+	if err := build(config, false, &log); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "carto.geojson")); err != nil {
+		t.Error(err)
+	}
+
+	if err := os.WriteFile(config, []byte(`{"input": {"file": "in.geojson", "wieght": "pop"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := build(config, false, &log); err == nil {
+		t.Error("misspelled field: no error")
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"embed"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ctessum/tilegram"
+)
+
+// editorAssets holds the files of the browser-based editor.
+//
+//go:embed editor
+var editorAssets embed.FS
+
+// maxHexagramBytes is the maximum size of a hexagram saved by the editor.
+const maxHexagramBytes = 256 << 20
+
+// runEdit runs the edit command, which serves a browser-based
+// editor for a hexagram file written by "tilegram make -hexagram".
+func runEdit(args []string) error {
+	fs := flag.NewFlagSet("edit", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: tilegram edit [-addr address] file")
+		fs.PrintDefaults()
+	}
+	addr := fs.String("addr", "localhost:8081", "`address` to serve the editor on")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("exactly one hexagram file must be specified")
+	}
+	e := &editor{filename: fs.Arg(0)}
+	if _, err := e.read(); err != nil {
+		return err
+	}
+	log.Printf("tilegram: editing %s at http://%s/", e.filename, *addr)
+	return http.ListenAndServe(*addr, e.handler())
+}
+
+// editor serves the editor for a hexagram file.
+type editor struct {
+	filename string
+	mu       sync.Mutex
+}
+
+func (e *editor) handler() http.Handler {
+	assets, err := fs.Sub(editorAssets, "editor")
+	if err != nil {
+		panic(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.FS(assets)))
+	mux.HandleFunc("/hexagram", e.serveHexagram)
+	return mux
+}
+
+// serveHexagram returns the hexagram being edited in response to GET
+// requests and saves the request body as the hexagram in response to
+// PUT requests.
+func (e *editor) serveHexagram(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h, err := e.read()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := h.Encode(w); err != nil {
+			log.Printf("tilegram: sending hexagram: %v", err)
+		}
+	case http.MethodPut:
+		h, err := tilegram.DecodeHexagram(http.MaxBytesReader(w, r.Body, maxHexagramBytes))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := e.write(h); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (e *editor) read() (*tilegram.Hexagram, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return readHexagram(e.filename)
+}
+
+// write saves h to the receiver's file, replacing the file only
+// once h has been completely written.
+func (e *editor) write(h *tilegram.Hexagram) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	f, err := os.CreateTemp(filepath.Dir(e.filename), ".tilegram-*")
+	if err != nil {
+		return err
+	}
+	if err := h.Encode(f); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), e.filename)
+}
+
+// readHexagram reads a hexagram from the named file.
+func readHexagram(filename string) (*tilegram.Hexagram, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return tilegram.DecodeHexagram(f)
+}
+
+// writeHexagram writes h to the named file.
+func writeHexagram(filename string, h *tilegram.Hexagram) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := h.Encode(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
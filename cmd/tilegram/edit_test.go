@@ -0,0 +1,107 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEdit(t *testing.T) {
+	dir := t.TempDir()
+	in, _ := writeTestInput(t, dir)
+	filename := filepath.Join(dir, "hex.json")
+	err := runMake([]string{"-in", in, "-weight", "pop", "-group", "state",
+		"-rows", "32", "-cols", "32", "-margin", "1", "-tiles", "12", "-hexagram", filename})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := &editor{filename: filename}
+	ts := httptest.NewServer(e.handler())
+	defer ts.Close()
+
+	for _, asset := range []string{"/", "/editor.js", "/editor.css"} {
+		resp, err := http.Get(ts.URL + asset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || len(b) == 0 {
+			t.Errorf("%s: status %d, length %d", asset, resp.StatusCode, len(b))
+		}
+		if strings.Contains(string(b), "://cdn") {
+			t.Errorf("%s refers to an external CDN", asset)
+		}
+	}
+
+	resp, err := http.Get(ts.URL + "/hexagram")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h struct {
+		Version int                      `json:"version"`
+		Radius  float64                  `json:"radius"`
+		Origin  [2]float64               `json:"origin"`
+		Tiles   []map[string]interface{} `json:"tiles"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&h)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Tiles) == 0 {
+		t.Fatal("no tiles")
+	}
+
+	// Reassign the first tile and remove the last one,
+	// as the editor would.
+	h.Tiles[0]["group"] = "Z"
+	h.Tiles = h.Tiles[:len(h.Tiles)-1]
+	b, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPut, ts.URL+"/hexagram", bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("save: status %d", resp.StatusCode)
+	}
+
+	saved, err := readHexagram(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Len() != len(h.Tiles) {
+		t.Errorf("saved hexagram has %d tiles, want %d", saved.Len(), len(h.Tiles))
+	}
+	if g := saved.Hexes()[0].Group(); g != "Z" {
+		t.Errorf("saved group: have %s, want Z", g)
+	}
+
+	req, _ = http.NewRequest(http.MethodPut, ts.URL+"/hexagram", strings.NewReader("{}"))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid hexagram: status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
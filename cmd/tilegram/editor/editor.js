@@ -0,0 +1,464 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// editor.js implements the tilegram editor. It loads a hexagram from
+// the server in the format written by Hexagram.Encode, lets the user
+// edit it, and saves it back in the same format.
+'use strict';
+
+(function () {
+	const svgNS = 'http://www.w3.org/2000/svg';
+	const palette = [
+		'#1f77b4', '#ff7f0e', '#2ca02c', '#d62728', '#9467bd',
+		'#8c564b', '#e377c2', '#7f7f7f', '#bcbd22', '#17becf',
+	];
+	const maxUndo = 100;
+
+	const svg = document.getElementById('map');
+	const tbody = document.querySelector('#groups tbody');
+	const warnings = document.getElementById('warnings');
+	const status = document.getElementById('status');
+	const undoButton = document.getElementById('undo');
+	const saveButton = document.getElementById('save');
+
+	let hexagram = null; // The hexagram being edited.
+	let targets = {}; // Target weight share by group.
+	let groupNames = []; // All group names, sorted.
+	let selected = null; // The selected group.
+	let undoStack = [];
+	let dirty = false;
+	let painting = false;
+	let panning = null;
+	let view = null; // The SVG viewBox: {x, y, w, h}.
+
+	function setStatus(msg, isError) {
+		status.textContent = msg;
+		status.className = isError ? 'error' : '';
+	}
+
+	function setDirty(d) {
+		dirty = d;
+		saveButton.disabled = !d;
+		undoButton.disabled = undoStack.length === 0;
+	}
+
+	function mode() {
+		return document.querySelector('input[name="mode"]:checked').value;
+	}
+
+	// computeTargets calculates the share of the total data weight
+	// in each group. Editing never changes the data weights, so the
+	// targets are only calculated when the hexagram is loaded.
+	function computeTargets() {
+		const weights = {};
+		let total = 0;
+		const names = new Set();
+		for (const t of hexagram.tiles) {
+			names.add(t.group);
+			for (const g in t.data || {}) {
+				weights[g] = (weights[g] || 0) + t.data[g];
+				total += t.data[g];
+				names.add(g);
+			}
+		}
+		targets = {};
+		for (const g of names) {
+			targets[g] = total > 0 ? (weights[g] || 0) / total : 0;
+		}
+		groupNames = Array.from(names).sort();
+	}
+
+	function color(group) {
+		const i = groupNames.indexOf(group);
+		return i < 0 ? '#cccccc' : palette[i % palette.length];
+	}
+
+	// hexPoints returns the SVG points attribute for a tile.
+	// The y axis is flipped so that north is up.
+	function hexPoints(t) {
+		const r = hexagram.radius;
+		const pts = [];
+		for (let i = 0; i < 6; i++) {
+			const a = Math.PI * 2 / 6 * i;
+			pts.push((t.x + r * Math.cos(a)) + ',' + -(t.y + r * Math.sin(a)));
+		}
+		return pts.join(' ');
+	}
+
+	function resetView() {
+		const r = hexagram.radius;
+		let minX = Infinity, minY = Infinity, maxX = -Infinity, maxY = -Infinity;
+		for (const t of hexagram.tiles) {
+			minX = Math.min(minX, t.x - r);
+			maxX = Math.max(maxX, t.x + r);
+			minY = Math.min(minY, t.y - r);
+			maxY = Math.max(maxY, t.y + r);
+		}
+		view = {x: minX - r, y: -maxY - r, w: maxX - minX + 2 * r, h: maxY - minY + 2 * r};
+		applyView();
+	}
+
+	function applyView() {
+		svg.setAttribute('viewBox', [view.x, view.y, view.w, view.h].join(' '));
+	}
+
+	// toMap converts a mouse event location to map coordinates.
+	function toMap(e) {
+		const p = svg.createSVGPoint();
+		p.x = e.clientX;
+		p.y = e.clientY;
+		const m = p.matrixTransform(svg.getScreenCTM().inverse());
+		return {x: m.x, y: -m.y};
+	}
+
+	function render() {
+		while (svg.firstChild) {
+			svg.removeChild(svg.firstChild);
+		}
+		hexagram.tiles.forEach(function (t, i) {
+			const p = document.createElementNS(svgNS, 'polygon');
+			p.setAttribute('points', hexPoints(t));
+			p.setAttribute('fill', color(t.group));
+			p.dataset.index = i;
+			if (t.group === selected) {
+				p.classList.add('selected');
+			}
+			const title = document.createElementNS(svgNS, 'title');
+			title.textContent = t.group + ': ' + tileWeight(t).toPrecision(4);
+			p.appendChild(title);
+			svg.appendChild(p);
+		});
+		updateStats();
+	}
+
+	function tileWeight(t) {
+		let w = 0;
+		for (const g in t.data || {}) {
+			w += t.data[g];
+		}
+		return w;
+	}
+
+	function pushUndo() {
+		undoStack.push(JSON.stringify(hexagram.tiles));
+		if (undoStack.length > maxUndo) {
+			undoStack.shift();
+		}
+		setDirty(true);
+	}
+
+	function undo() {
+		if (undoStack.length === 0) {
+			return;
+		}
+		hexagram.tiles = JSON.parse(undoStack.pop());
+		setDirty(true);
+		render();
+	}
+
+	function paint(i) {
+		const t = hexagram.tiles[i];
+		if (selected === null || t.group === selected) {
+			return;
+		}
+		t.group = selected;
+		const p = svg.querySelector('polygon[data-index="' + i + '"]');
+		p.setAttribute('fill', color(selected));
+		p.classList.add('selected');
+		p.firstChild.textContent = t.group + ': ' + tileWeight(t).toPrecision(4);
+		updateStats();
+	}
+
+	// remove removes tile i, moving its data to the nearest
+	// remaining tile so that the group targets are unchanged.
+	function remove(i) {
+		if (hexagram.tiles.length === 1) {
+			setStatus('The last tile cannot be removed', true);
+			return;
+		}
+		pushUndo();
+		const t = hexagram.tiles.splice(i, 1)[0];
+		let nearest = null;
+		let minDist = Infinity;
+		for (const o of hexagram.tiles) {
+			const d = Math.hypot(o.x - t.x, o.y - t.y);
+			if (d < minDist) {
+				nearest = o;
+				minDist = d;
+			}
+		}
+		for (const g in t.data || {}) {
+			nearest.data = nearest.data || {};
+			nearest.data[g] = (nearest.data[g] || 0) + t.data[g];
+		}
+		render();
+	}
+
+	// add adds a tile in the selected group at the lattice
+	// location nearest to map location p.
+	function add(p) {
+		const r = hexagram.radius;
+		const dx = 3 * r;
+		const dy = Math.sqrt(3) * r;
+		const origins = [
+			{x: hexagram.origin[0], y: hexagram.origin[1]},
+			{x: hexagram.origin[0] - 1.5 * r, y: hexagram.origin[1] - r},
+		];
+		let best = null;
+		let minDist = Infinity;
+		for (const o of origins) {
+			const c = {
+				x: o.x + Math.round((p.x - o.x) / dx) * dx,
+				y: o.y + Math.round((p.y - o.y) / dy) * dy,
+			};
+			const d = Math.hypot(c.x - p.x, c.y - p.y);
+			if (d < minDist) {
+				best = c;
+				minDist = d;
+			}
+		}
+		for (const t of hexagram.tiles) {
+			if (Math.hypot(t.x - best.x, t.y - best.y) < 1.5 * r) {
+				return; // The location is already occupied.
+			}
+		}
+		pushUndo();
+		hexagram.tiles.push({x: best.x, y: best.y, group: selected, data: {}});
+		render();
+	}
+
+	// components returns the number of contiguous parts of each group,
+	// where tiles are adjacent if their centers are less than two
+	// radii apart.
+	function components() {
+		const r = hexagram.radius;
+		const cell = 2 * r;
+		const grid = new Map();
+		const key = (i, j) => i + ',' + j;
+		hexagram.tiles.forEach(function (t, i) {
+			const k = key(Math.floor(t.x / cell), Math.floor(t.y / cell));
+			if (!grid.has(k)) {
+				grid.set(k, []);
+			}
+			grid.get(k).push(i);
+		});
+		const seen = new Array(hexagram.tiles.length).fill(false);
+		const count = {};
+		hexagram.tiles.forEach(function (start, s) {
+			if (seen[s]) {
+				return;
+			}
+			count[start.group] = (count[start.group] || 0) + 1;
+			const stack = [s];
+			seen[s] = true;
+			while (stack.length > 0) {
+				const t = hexagram.tiles[stack.pop()];
+				const ci = Math.floor(t.x / cell);
+				const cj = Math.floor(t.y / cell);
+				for (let i = ci - 1; i <= ci + 1; i++) {
+					for (let j = cj - 1; j <= cj + 1; j++) {
+						for (const n of grid.get(key(i, j)) || []) {
+							const o = hexagram.tiles[n];
+							if (!seen[n] && o.group === start.group &&
+								Math.hypot(o.x - t.x, o.y - t.y) < 2 * r) {
+								seen[n] = true;
+								stack.push(n);
+							}
+						}
+					}
+				}
+			}
+		});
+		return count;
+	}
+
+	function updateStats() {
+		const tiles = {};
+		for (const t of hexagram.tiles) {
+			tiles[t.group] = (tiles[t.group] || 0) + 1;
+		}
+		const n = hexagram.tiles.length;
+		while (tbody.firstChild) {
+			tbody.removeChild(tbody.firstChild);
+		}
+		for (const g of groupNames) {
+			const share = (tiles[g] || 0) / n;
+			const target = targets[g] || 0;
+			const dev = share - target;
+			const tr = document.createElement('tr');
+			if (g === selected) {
+				tr.className = 'selected';
+			}
+			const swatch = document.createElement('span');
+			swatch.className = 'swatch';
+			swatch.style.background = color(g);
+			const cells = [swatch, g || '(none)', tiles[g] || 0,
+				pct(target), pct(share), (dev >= 0 ? '+' : '') + pct(dev)];
+			cells.forEach(function (c, i) {
+				const td = document.createElement('td');
+				if (c instanceof Node) {
+					td.appendChild(c);
+				} else {
+					td.textContent = c;
+				}
+				if (i === 5 && Math.abs(dev) >= 0.5 / n) {
+					td.className = dev > 0 ? 'over' : 'under';
+				}
+				tr.appendChild(td);
+			});
+			tr.addEventListener('click', function () {
+				selected = g;
+				render();
+			});
+			tbody.appendChild(tr);
+		}
+
+		while (warnings.firstChild) {
+			warnings.removeChild(warnings.firstChild);
+		}
+		const parts = components();
+		for (const g of groupNames) {
+			let msg = null;
+			if (!tiles[g] && targets[g] > 0) {
+				msg = 'has no tiles';
+			} else if (parts[g] > 1) {
+				msg = 'is split into ' + parts[g] + ' parts';
+			}
+			if (msg !== null) {
+				const li = document.createElement('li');
+				li.textContent = (g || '(none)') + ' ' + msg;
+				warnings.appendChild(li);
+			}
+		}
+	}
+
+	function pct(f) {
+		return (100 * f).toFixed(1) + '%';
+	}
+
+	function load() {
+		fetch('hexagram').then(function (resp) {
+			if (!resp.ok) {
+				return resp.text().then(function (t) { throw new Error(t); });
+			}
+			return resp.json();
+		}).then(function (h) {
+			hexagram = h;
+			undoStack = [];
+			computeTargets();
+			selected = groupNames.length > 0 ? groupNames[0] : '';
+			resetView();
+			render();
+			setDirty(false);
+			setStatus('Loaded ' + h.tiles.length + ' tiles.');
+		}).catch(function (err) {
+			setStatus('Error loading hexagram: ' + err.message, true);
+		});
+	}
+
+	function save() {
+		saveButton.disabled = true;
+		fetch('hexagram', {
+			method: 'PUT',
+			headers: {'Content-Type': 'application/json'},
+			body: JSON.stringify(hexagram),
+		}).then(function (resp) {
+			if (!resp.ok) {
+				return resp.text().then(function (t) { throw new Error(t); });
+			}
+			setDirty(false);
+			setStatus('Saved ' + hexagram.tiles.length + ' tiles.');
+		}).catch(function (err) {
+			saveButton.disabled = false;
+			setStatus('Error saving hexagram: ' + err.message, true);
+		});
+	}
+
+	svg.addEventListener('pointerdown', function (e) {
+		if (hexagram === null) {
+			return;
+		}
+		if (e.shiftKey) {
+			panning = {x: e.clientX, y: e.clientY, view: Object.assign({}, view)};
+			return;
+		}
+		const i = e.target.dataset ? e.target.dataset.index : undefined;
+		switch (mode()) {
+		case 'paint':
+			if (i !== undefined) {
+				pushUndo();
+				painting = true;
+				paint(+i);
+			}
+			break;
+		case 'remove':
+			if (i !== undefined) {
+				remove(+i);
+			}
+			break;
+		case 'add':
+			add(toMap(e));
+			break;
+		}
+	});
+
+	svg.addEventListener('pointermove', function (e) {
+		if (panning !== null) {
+			const scale = view.w / svg.clientWidth;
+			view.x = panning.view.x - (e.clientX - panning.x) * scale;
+			view.y = panning.view.y - (e.clientY - panning.y) * scale;
+			applyView();
+			return;
+		}
+		if (painting) {
+			const el = document.elementFromPoint(e.clientX, e.clientY);
+			if (el && el.dataset && el.dataset.index !== undefined) {
+				paint(+el.dataset.index);
+			}
+		}
+	});
+
+	window.addEventListener('pointerup', function () {
+		painting = false;
+		panning = null;
+	});
+
+	svg.addEventListener('wheel', function (e) {
+		if (view === null) {
+			return;
+		}
+		e.preventDefault();
+		const p = toMap(e);
+		const f = e.deltaY > 0 ? 1.2 : 1 / 1.2;
+		view.x = p.x - (p.x - view.x) * f;
+		view.y = -p.y - (-p.y - view.y) * f;
+		view.w *= f;
+		view.h *= f;
+		applyView();
+	}, {passive: false});
+
+	undoButton.addEventListener('click', undo);
+	saveButton.addEventListener('click', save);
+
+	document.addEventListener('keydown', function (e) {
+		if ((e.ctrlKey || e.metaKey) && e.key === 'z') {
+			e.preventDefault();
+			undo();
+		} else if ((e.ctrlKey || e.metaKey) && e.key === 's') {
+			e.preventDefault();
+			if (dirty) {
+				save();
+			}
+		}
+	});
+
+	window.addEventListener('beforeunload', function (e) {
+		if (dirty) {
+			e.preventDefault();
+			e.returnValue = '';
+		}
+	});
+
+	load();
+})();
@@ -0,0 +1,232 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/shp"
+	"github.com/ctessum/geom/proj"
+	"github.com/ctessum/tilegram"
+	goshp "github.com/jonas-p/go-shp"
+)
+
+// layer is a set of map features of any geometry type along
+// with their attributes.
+type layer struct {
+	geoms []geom.Geom
+	props []map[string]interface{}
+
+	// fields holds the attribute fields of layers read from
+	// shapefiles, so they can be written back unchanged.
+	fields []goshp.Field
+
+	// sr is the spatial reference of geoms, or nil if it is not known.
+	sr *proj.SR
+}
+
+// readLayer reads a layer from a shapefile or GeoJSON file,
+// choosing the format from the file extension.
+func readLayer(filename string) (*layer, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".shp":
+		return readShapefileLayer(filename)
+	case ".geojson", ".json":
+		return readGeoJSONLayer(filename)
+	default:
+		return nil, fmt.Errorf("unsupported input file type %s", filename)
+	}
+}
+
+func readShapefileLayer(filename string) (*layer, error) {
+	d, err := shp.NewDecoder(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+
+	l := &layer{fields: d.Fields()}
+	names := make([]string, len(l.fields))
+	for i, f := range l.fields {
+		names[i] = f.String()
+	}
+	for {
+		g, fields, more := d.DecodeRowFields(names...)
+		if !more {
+			break
+		}
+		props := make(map[string]interface{}, len(fields))
+		for k, v := range fields {
+			props[k] = v
+		}
+		l.geoms = append(l.geoms, g)
+		l.props = append(l.props, props)
+	}
+	if err := d.Error(); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", filename, err)
+	}
+	if sr, err := d.SR(); err == nil {
+		l.sr = sr
+	}
+	return l, nil
+}
+
+func readGeoJSONLayer(filename string) (*layer, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	geoms, props, err := tilegram.DecodeGeoJSON(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", filename, err)
+	}
+	sr, err := tilegram.GeoJSONReference(geoms)
+	if err != nil {
+		return nil, err
+	}
+	return &layer{geoms: geoms, props: props, sr: sr}, nil
+}
+
+// warp transforms the receiver's geometry with cartogram c, whose
+// grid is in spatial reference sr. If both sr and the receiver's
+// spatial reference are known, the geometry is projected to sr before
+// it is transformed and back afterwards. Otherwise they are assumed to
+// be the same, unless the receiver is in longitude and latitude, which
+// a cartogram grid never is.
+func (l *layer) warp(c *tilegram.Cartogram, sr *proj.SR) error {
+	switch {
+	case sr == nil && tilegram.IsGeographic(l.sr):
+		return errors.New("the layer is in longitude and latitude, but the projection of the cartogram is not known")
+	case sr == nil || l.sr == nil:
+		l.geoms = c.TransformGeoms(l.geoms)
+		return nil
+	}
+	var err error
+	if l.geoms, err = projectGeoms(l.geoms, l.sr, sr); err != nil {
+		return err
+	}
+	l.geoms, err = projectGeoms(c.TransformGeoms(l.geoms), sr, l.sr)
+	return err
+}
+
+// projectGeoms returns geoms transformed from spatial reference from
+// to to, checking that every vertex is finite, which it may not be if
+// a geometry lies outside the domain of a projection.
+func projectGeoms(geoms []geom.Geom, from, to *proj.SR) ([]geom.Geom, error) {
+	t, err := from.NewTransform(to)
+	if err != nil {
+		return nil, err
+	}
+	finite := func(x, y float64) (float64, float64, error) {
+		px, py, err := t(x, y)
+		if err == nil && (math.IsNaN(px) || math.IsNaN(py) || math.IsInf(px, 0) || math.IsInf(py, 0)) {
+			err = fmt.Errorf("point (%g, %g) is outside the projection", x, y)
+		}
+		return px, py, err
+	}
+	o := make([]geom.Geom, len(geoms))
+	for i, g := range geoms {
+		if o[i], err = g.Transform(finite); err != nil {
+			return nil, fmt.Errorf("projecting feature %d: %v", i, err)
+		}
+	}
+	return o, nil
+}
+
+// write writes the receiver to a shapefile or GeoJSON file,
+// choosing the format from the file extension.
+func (l *layer) write(filename string) error {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".shp":
+		return l.writeShapefile(filename)
+	case ".geojson", ".json":
+		return l.writeGeoJSON(filename)
+	default:
+		return fmt.Errorf("unsupported output file type %s", filename)
+	}
+}
+
+func (l *layer) writeGeoJSON(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := tilegram.EncodeGeoJSON(f, l.geoms, l.props); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (l *layer) writeShapefile(filename string) error {
+	if len(l.geoms) == 0 {
+		return fmt.Errorf("cannot write empty layer to shapefile %s", filename)
+	}
+	shapeType, err := shapeType(l.geoms[0])
+	if err != nil {
+		return err
+	}
+	fields := l.fields
+	if fields == nil {
+		// The layer was not read from a shapefile, so store all
+		// properties as strings.
+		names := make(map[string]bool)
+		for _, p := range l.props {
+			for k := range p {
+				names[k] = true
+			}
+		}
+		for k := range names {
+			fields = append(fields, goshp.StringField(k, 254))
+		}
+		sort.Slice(fields, func(i, j int) bool { return fields[i].String() < fields[j].String() })
+	}
+	e, err := shp.NewEncoderFromFields(filename, shapeType, fields...)
+	if err != nil {
+		return err
+	}
+	defer e.Close()
+	for i, g := range l.geoms {
+		vals := make([]interface{}, len(fields))
+		for j, f := range fields {
+			v := l.props[i][f.String()]
+			if v == nil {
+				v = ""
+			}
+			if l.fields == nil {
+				v = fmt.Sprint(v)
+			}
+			vals[j] = v
+		}
+		if err := e.EncodeFields(g, vals...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shapeType returns the shapefile shape type corresponding to g.
+func shapeType(g geom.Geom) (goshp.ShapeType, error) {
+	switch g.(type) {
+	case geom.Point:
+		return goshp.POINT, nil
+	case geom.MultiPoint:
+		return goshp.MULTIPOINT, nil
+	case geom.LineString, geom.MultiLineString:
+		return goshp.POLYLINE, nil
+	case geom.Polygon, geom.MultiPolygon:
+		return goshp.POLYGON, nil
+	default:
+		return goshp.NULL, fmt.Errorf("geometry type %T can't be written to a shapefile", g)
+	}
+}
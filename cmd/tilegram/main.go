@@ -0,0 +1,116 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Command tilegram creates cartograms and hexagonal tilegrams
+// from polygon data.
+//
+// Usage:
+//
+//	tilegram <command> [flags]
+//
+// The commands are:
+//
+//	make    create a tilegram from a shapefile or GeoJSON file
+//	build   create the outputs described by a configuration file
+//	warp    transform map layers to match a saved cartogram
+//	serve   run an HTTP service for creating cartograms and tilegrams
+//	edit    edit a hexagram in a web browser
+//
+// Run "tilegram <command> -h" for the flags accepted by each command.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ctessum/tilegram"
+)
+
+// command is a tilegram subcommand.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []command{
+	{name: "make", summary: "create a tilegram from a shapefile or GeoJSON file", run: runMake},
+	{name: "build", summary: "create the outputs described by a configuration file", run: runBuild},
+	{name: "warp", summary: "transform map layers to match a saved cartogram", run: runWarp},
+	{name: "serve", summary: "run an HTTP service for creating cartograms and tilegrams", run: runServe},
+	{name: "edit", summary: "edit a hexagram in a web browser", run: runEdit},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	name := os.Args[1]
+	if name == "help" || name == "-h" || name == "-help" || name == "--help" {
+		usage()
+		return
+	}
+	for _, c := range commands {
+		if c.name != name {
+			continue
+		}
+		if err := c.run(os.Args[2:]); err != nil {
+			if err != flag.ErrHelp {
+				fmt.Fprintf(os.Stderr, "tilegram %s: %v\n", name, err)
+			}
+			os.Exit(1)
+		}
+		return
+	}
+	fmt.Fprintf(os.Stderr, "tilegram: unknown command %q\n", name)
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: tilegram <command> [flags]")
+	fmt.Fprintln(os.Stderr, "\nThe commands are:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "\t%-8s%s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(os.Stderr, "\nRun \"tilegram <command> -h\" for the flags accepted by each command.")
+}
+
+// svgWidth is the width in pixels of SVG output.
+const svgWidth = 800
+
+// writeTiles writes tiles to the named file, choosing the format from
+// the file extension: ".shp" for a shapefile, ".svg" for an SVG image,
+// or ".geojson" or ".json" for GeoJSON. A filename of "-" writes GeoJSON
+// to standard output.
+func writeTiles(filename string, tiles []tilegram.Tile) error {
+	if filename == "-" {
+		return tilegram.WriteGeoJSON(os.Stdout, tiles)
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".shp":
+		return tilegram.WriteShapefile(filename, tiles)
+	case ".geojson", ".json", ".svg":
+		f, err := os.Create(filename)
+		if err != nil {
+			return err
+		}
+		if strings.ToLower(filepath.Ext(filename)) == ".svg" {
+			err = tilegram.WriteSVG(f, tiles, svgWidth)
+		} else {
+			err = tilegram.WriteGeoJSON(f, tiles)
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	default:
+		return fmt.Errorf("unsupported output file type %s", filename)
+	}
+}
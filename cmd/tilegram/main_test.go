@@ -0,0 +1,240 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/tilegram"
+)
+
+// writeTestInput writes a GeoJSON file with a 4×4 grid of
+// unit squares in two groups and returns its name and total weight.
+func writeTestInput(t *testing.T, dir string) (string, float64) {
+	var features []string
+	var total float64
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			w := float64(1 + i*j)
+			total += w
+			features = append(features, fmt.Sprintf(`{"type":"Feature","properties":{"pop":%g,"state":"%c"},`+
+				`"geometry":{"type":"Polygon","coordinates":[[[%d,%d],[%d,%d],[%d,%d],[%d,%d],[%d,%d]]]}}`,
+				w, 'A'+rune(i/2), i, j, i+1, j, i+1, j+1, i, j+1, i, j))
+		}
+	}
+	filename := filepath.Join(dir, "in.geojson")
+	fc := `{"type":"FeatureCollection","features":[` + strings.Join(features, ",") + "]}"
+	if err := os.WriteFile(filename, []byte(fc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename, total
+}
+
+func TestMake(t *testing.T) {
+	dir := t.TempDir()
+	in, total := writeTestInput(t, dir)
+	out := filepath.Join(dir, "hex.geojson")
+	groups := filepath.Join(dir, "groups.geojson")
+	carto := filepath.Join(dir, "carto.geojson")
+	err := runMake([]string{"-in", in, "-weight", "pop", "-group", "state",
+		"-rows", "32", "-cols", "32", "-margin", "1", "-tiles", "12",
+		"-out", out, "-groups", groups, "-cartogram", carto})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := tilegram.ReadFeatures(carto, "weight", "group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Len() != 16 {
+		t.Errorf("cartogram has %d features, want 16", f.Len())
+	}
+
+	h, err := tilegram.ReadFeatures(out, "weight", "group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sum float64
+	for _, w := range h.Weights {
+		sum += w
+	}
+	if sum <= 0 || sum > total*1.000001 {
+		t.Errorf("hexagon weight %g out of range (0, %g]", sum, total)
+	}
+
+	g, err := tilegram.ReadFeatures(groups, "weight", "group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Len() != 2 {
+		t.Errorf("have %d groups, want 2", g.Len())
+	}
+}
+
+func TestMakeCells(t *testing.T) {
+	dir := t.TempDir()
+	in, _ := writeTestInput(t, dir)
+	carto := filepath.Join(dir, "carto.geojson")
+	err := runMake([]string{"-in", in, "-weight", "pop", "-cells", "500", "-margin", "1", "-cartogram", carto})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := tilegram.ReadFeatures(carto, "weight", "group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Len() != 16 {
+		t.Errorf("cartogram has %d features, want 16", f.Len())
+	}
+
+	// A single point covers no area, and a grid must have 4 cells.
+	point := filepath.Join(dir, "point.geojson")
+	err = os.WriteFile(point, []byte(`{"type":"FeatureCollection","features":[{"type":"Feature","properties":{"pop":1},`+
+		`"geometry":{"type":"Polygon","coordinates":[[[1,1],[1,1],[1,1],[1,1]]]}}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"-in", point, "-weight", "pop", "-cells", "500", "-cartogram", carto},
+		{"-in", in, "-weight", "pop", "-cells", "3", "-cartogram", carto},
+	} {
+		if err := runMake(args); err == nil {
+			t.Errorf("%v: no error", args)
+		}
+	}
+}
+
+func TestMakeStrength(t *testing.T) {
+	dir := t.TempDir()
+	in, _ := writeTestInput(t, dir)
+	carto := filepath.Join(dir, "carto.geojson")
+	err := runMake([]string{"-in", in, "-weight", "pop", "-rows", "32", "-cols", "32", "-margin", "1",
+		"-strength", "0.5", "-cartogram", carto})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := tilegram.ReadFeatures(carto, "weight", "group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Len() != 16 {
+		t.Errorf("cartogram has %d features, want 16", f.Len())
+	}
+
+	// A strength of zero leaves the map unchanged.
+	err = runMake([]string{"-in", in, "-weight", "pop", "-rows", "32", "-cols", "32", "-margin", "1",
+		"-strength", "0", "-cartogram", carto})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, strength := range []string{"1.5", "NaN"} {
+		err = runMake([]string{"-in", in, "-weight", "pop", "-strength", strength, "-cartogram", carto})
+		if err == nil {
+			t.Errorf("no error for strength %s", strength)
+		}
+	}
+}
+
+func TestMakeLonLat(t *testing.T) {
+	dir := t.TempDir()
+	in, _ := writeTestInput(t, dir)
+	carto := filepath.Join(dir, "carto.geojson")
+	bounds := func() *geom.Bounds {
+		f, err := tilegram.ReadFeatures(carto, "weight", "group")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := geom.NewBounds()
+		for _, p := range f.Polygons {
+			b.Extend(p.Bounds())
+		}
+		return b
+	}
+
+	// GeoJSON is in longitude and latitude, so the input is
+	// projected to meters.
+	args := []string{"-in", in, "-weight", "pop", "-rows", "32", "-cols", "32", "-cartogram", carto}
+	if err := runMake(args); err != nil {
+		t.Fatal(err)
+	}
+	if b := bounds(); b.Max.X-b.Min.X < 1e5 {
+		t.Errorf("projected cartogram bounds: %v", b)
+	}
+	projected := filepath.Join(dir, "projected.geojson")
+	if err := os.Rename(carto, projected); err != nil {
+		t.Fatal(err)
+	}
+
+	// The output is projected back to degrees.
+	if err := runMake(append(args, "-lonlat", "-tiles", "10", "-out", filepath.Join(dir, "hex.geojson"))); err != nil {
+		t.Fatal(err)
+	}
+	if b := bounds(); b.Min.X < -1 || b.Max.X > 5 || b.Min.Y < -1 || b.Max.Y > 5 {
+		t.Errorf("longitude and latitude cartogram bounds: %v", b)
+	}
+
+	// The projection of GeoJSON in meters is not known
+	// unless it is set.
+	args = []string{"-in", projected, "-weight", "weight", "-rows", "32", "-cols", "32", "-lonlat", "-cartogram", carto}
+	if err := runMake(args); err == nil {
+		t.Error("no error writing longitude and latitude with an unknown projection")
+	}
+	sr := "+proj=aea +lat_1=0.666667 +lat_2=3.33333 +lat_0=2 +lon_0=2 +x_0=0 +y_0=0 +datum=WGS84 +units=m +no_defs"
+	if err := runMake(append(args, "-projection", sr)); err != nil {
+		t.Fatal(err)
+	}
+	if b := bounds(); b.Min.X < -1 || b.Max.X > 5 || b.Min.Y < -1 || b.Max.Y > 5 {
+		t.Errorf("longitude and latitude bounds of projected input: %v", b)
+	}
+}
+
+func TestMakeRubberSheet(t *testing.T) {
+	dir := t.TempDir()
+	in, _ := writeTestInput(t, dir)
+	carto := filepath.Join(dir, "carto.geojson")
+	err := runMake([]string{"-in", in, "-weight", "pop", "-rubbersheet", "20", "-cartogram", carto})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := tilegram.ReadFeatures(carto, "weight", "group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Len() != 16 {
+		t.Errorf("cartogram has %d features, want 16", f.Len())
+	}
+
+	err = runMake([]string{"-in", in, "-weight", "pop", "-rubbersheet", "20", "-transform", filepath.Join(dir, "carto.gob")})
+	if err == nil {
+		t.Error("no error saving the transform of a rubber-sheet cartogram")
+	}
+}
+
+func TestMakeFrames(t *testing.T) {
+	dir := t.TempDir()
+	in, _ := writeTestInput(t, dir)
+	pattern := filepath.Join(dir, "frame%d.geojson")
+	err := runMake([]string{"-in", in, "-weight", "pop", "-rows", "32", "-cols", "32", "-margin", "1",
+		"-frames", pattern, "-nframes", "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := 0; k < 3; k++ {
+		f, err := tilegram.ReadFeatures(fmt.Sprintf(pattern, k), "weight", "group")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Len() != 16 {
+			t.Errorf("frame %d has %d features, want 16", k, f.Len())
+		}
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ctessum/geom/proj"
+	"github.com/ctessum/tilegram"
+)
+
+// runMake runs the make command, which reads polygon features,
+// creates a cartogram from them, and allocates the
+// cartogram-transformed features to a hexagonal tilegram.
+func runMake(args []string) error {
+	fs := flag.NewFlagSet("make", flag.ContinueOnError)
+	in := fs.String("in", "", "input shapefile (.shp) or GeoJSON (.geojson, .json) `file`")
+	weight := fs.String("weight", "", "name of the input `field` holding the weight of each feature")
+	group := fs.String("group", "", "name of the input `field` holding the group of each feature")
+	projection := fs.String("projection", "", "proj4 `definition` of the projection of the input, overriding any .prj file; input in longitude and latitude is projected to an equal-area projection")
+	lonLat := fs.Bool("lonlat", false, "write the -out, -groups and -cartogram outputs in longitude and latitude")
+	rows := fs.Int("rows", defaultRows, "number of rows in the cartogram grid")
+	cols := fs.Int("cols", defaultCols, "number of columns in the cartogram grid")
+	cells := fs.Int("cells", 0, "maximum number of cells in the cartogram grid; if set, the grid has square cells and -rows and -cols are ignored")
+	margin := fs.Float64("margin", 0, "margin added to each side of the input bounds, in map units, which are meters for input in longitude and latitude")
+	blur := fs.Float64("blur", 0, "radius of Gaussian blurring of the density grid, in grid cells")
+	strength := fs.Float64("strength", 1, "strength of a partial cartogram, between 0 (the original map) and 1 (a full cartogram)")
+	maxSegment := fs.Float64("maxsegment", 0, "maximum length of polygon edges before transformation, in grid cells; longer edges are split")
+	simplify := fs.Float64("simplify", 0, "tolerance, in map units (meters for input in longitude and latitude), to which vertices added by -maxsegment are simplified after transformation")
+	repair := fs.Int("repair", 0, "maximum number of passes made to repair overlapping or self-intersecting transformed polygons")
+	rubberSheet := fs.Int("rubbersheet", 0, "if set, the number of iterations of the rubber-sheet algorithm to use instead of diffusion on a grid")
+	radius := fs.Float64("radius", 0, "hexagon radius, in map units, which are meters for input in longitude and latitude")
+	count := fs.Int("tiles", 0, "approximate number of hexagons, used if -radius is not set")
+	tolerance := fs.Float64("tolerance", 0, "distance within which group outline points are merged; defaults to half the hexagon radius")
+	out := fs.String("out", "", "output `file` for the hexagons")
+	groupsOut := fs.String("groups", "", "output `file` for the group outlines")
+	hexOut := fs.String("hexagram", "", "output `file` for the hexagons in tilegram's own format, for use with \"tilegram edit\"")
+	cartoOut := fs.String("cartogram", "", "output `file` for the cartogram-transformed input features")
+	transformOut := fs.String("transform", "", "output `file` for the cartogram transform")
+	frames := fs.String("frames", "", "output file name `pattern`, such as frames/%03d.geojson, for GeoJSON animation frames from the input features to the cartogram, formatted with the frame number")
+	nFrames := fs.Int("nframes", 30, "number of animation frames written with -frames")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	switch {
+	case *in == "":
+		return errors.New("-in must be set")
+	case *weight == "":
+		return errors.New("-weight must be set")
+	case *out == "" && *groupsOut == "" && *hexOut == "" && *cartoOut == "" && *transformOut == "" && *frames == "":
+		return errors.New("at least one of -out, -groups, -hexagram, -cartogram, -transform or -frames must be set")
+	case *cells != 0 && *cells < 4:
+		return errors.New("-cells must be 0 or at least 4")
+	case !(*strength >= 0 && *strength <= 1):
+		return errors.New("-strength must be between 0 and 1")
+	case *frames != "" && *rubberSheet > 0:
+		return errors.New("-frames cannot be used with -rubbersheet")
+	case *frames != "" && *lonLat:
+		return errors.New("-frames cannot be used with -lonlat")
+	case (*out != "" || *groupsOut != "" || *hexOut != "") && *radius <= 0 && *count <= 0:
+		return errors.New("one of -radius or -tiles must be set")
+	}
+
+	f, err := tilegram.ReadFeatures(*in, *weight, *group)
+	if err != nil {
+		return err
+	}
+	if *projection != "" {
+		if f.SR, err = proj.Parse(*projection); err != nil {
+			return err
+		}
+	}
+	var lonLatSR *proj.SR
+	if *lonLat {
+		if lonLatSR, err = lonLatReference(f.SR); err != nil {
+			return err
+		}
+	}
+	def, err := projectionDefinition(f, *in, *projection)
+	if err != nil {
+		return err
+	}
+	if f, err = f.EqualArea(); err != nil {
+		return err
+	}
+
+	p := pipeline{
+		Rows:         *rows,
+		Cols:         *cols,
+		Cells:        *cells,
+		Margin:       *margin,
+		Blur:         *blur,
+		Strength:     strength,
+		MaxSegment:   *maxSegment,
+		Simplify:     *simplify,
+		RepairPasses: *repair,
+		RubberSheet:  *rubberSheet,
+		Tolerance:    *tolerance,
+	}
+	if *out != "" || *groupsOut != "" || *hexOut != "" {
+		p.Radius, p.Tiles = *radius, *count
+	}
+	var withCartogram func(*tilegram.Cartogram) error
+	if *transformOut != "" || *frames != "" {
+		withCartogram = func(c *tilegram.Cartogram) error {
+			if *transformOut != "" {
+				if err := writeTransform(*transformOut, c, def); err != nil {
+					return err
+				}
+			}
+			if *frames != "" {
+				return tilegram.WriteFrames(*frames, c, f, *nFrames)
+			}
+			return nil
+		}
+	}
+	r, err := p.run(f, nil, withCartogram)
+	if err != nil {
+		return err
+	}
+
+	// writeOutput writes tiles to the named file, in longitude
+	// and latitude if -lonlat is set.
+	writeOutput := func(filename string, tiles []tilegram.Tile) error {
+		if lonLatSR != nil {
+			if err := tilegram.ProjectTiles(tiles, f.SR, lonLatSR); err != nil {
+				return err
+			}
+		}
+		return writeTiles(filename, tiles)
+	}
+	if *cartoOut != "" {
+		if err := writeOutput(*cartoOut, r.Cartogram.Tiles()); err != nil {
+			return err
+		}
+	}
+	if *out != "" {
+		if err := writeOutput(*out, r.Hexagram.Tiles()); err != nil {
+			return err
+		}
+	}
+	if *groupsOut != "" {
+		if err := writeOutput(*groupsOut, r.Groups); err != nil {
+			return err
+		}
+	}
+	if *hexOut != "" {
+		if err := writeHexagram(*hexOut, r.Hexagram); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lonLatReference returns the geographic spatial reference that
+// outputs are transformed to when they are written in longitude and
+// latitude: sr itself if it is geographic, or WGS84 otherwise.
+func lonLatReference(sr *proj.SR) (*proj.SR, error) {
+	switch {
+	case sr == nil:
+		return nil, errors.New("the projection of the input must be known, from a .prj file or -projection, to write longitude and latitude")
+	case tilegram.IsGeographic(sr):
+		return sr, nil
+	default:
+		return proj.Parse(tilegram.LonLatWGS84)
+	}
+}
+
+// projectionDefinition returns the definition of the spatial reference
+// of features f, read from the named input file, after they are
+// projected by EqualArea: the equal-area projection if they are in
+// longitude and latitude, or otherwise projection if it is set or the
+// contents of the .prj file of a shapefile. It returns an empty string
+// if the spatial reference is not known.
+func projectionDefinition(f *tilegram.Features, filename, projection string) (string, error) {
+	def, err := f.EqualAreaDefinition()
+	switch {
+	case err != nil || def != "":
+		return def, err
+	case projection != "":
+		return projection, nil
+	case f.SR == nil || strings.ToLower(filepath.Ext(filename)) != ".shp":
+		return "", nil
+	}
+	for _, prj := range inputFiles(filename) {
+		if strings.ToLower(filepath.Ext(prj)) == ".prj" {
+			b, err := os.ReadFile(prj)
+			return strings.TrimSpace(string(b)), err
+		}
+	}
+	return "", nil
+}
+
+// writeTransform writes cartogram c, whose grid is in the spatial
+// reference with definition projection, to the named file.
+func writeTransform(filename string, c *tilegram.Cartogram, projection string) error {
+	c.Projection = projection
+	w, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := c.Encode(w); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,199 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"math"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/tilegram"
+)
+
+// Default dimensions of the cartogram grid.
+const (
+	defaultRows = 512
+	defaultCols = 1024
+)
+
+// pipeline holds the parameters for creating a cartogram and
+// hexagonal tilegram from polygon features. Map units are those of
+// the features, which are meters for input in longitude and latitude
+// after it is projected to an equal-area projection.
+type pipeline struct {
+	// Rows and Cols are the dimensions of the cartogram grid.
+	Rows, Cols int
+
+	// Cells, if positive, is the maximum number of cells in the
+	// cartogram grid, whose cells are then square and whose
+	// dimensions are chosen automatically instead of using
+	// Rows and Cols.
+	Cells int
+
+	// Margin is added to each side of the input bounds, in map units.
+	Margin float64
+
+	// Blur is the radius of Gaussian blurring, in grid cells.
+	Blur float64
+
+	// Strength, if set, is the strength of a partial cartogram, as
+	// for tilegram.WithStrength. If it is nil, a full cartogram
+	// is made.
+	Strength *float64
+
+	// MaxSegment, if positive, is the maximum length of polygon edges,
+	// in grid cells, before they are transformed, and Simplify, if
+	// positive, is the tolerance in map units to which the added
+	// vertices are simplified afterwards.
+	MaxSegment, Simplify float64
+
+	// RepairPasses is the maximum number of passes made to repair
+	// overlapping or self-intersecting transformed polygons.
+	RepairPasses int
+
+	// RubberSheet, if positive, is the maximum number of iterations of
+	// the rubber-sheet algorithm, which is then used instead of the
+	// diffusion cartogram. The grid parameters are ignored.
+	RubberSheet int
+
+	// Radius is the hexagon radius in map units. If it is zero,
+	// the radius is chosen to create approximately Tiles hexagons.
+	// If both are zero, no tilegram is created.
+	Radius float64
+	Tiles  int
+
+	// Tolerance is the distance within which group outline points
+	// are merged. If it is zero, half of the hexagon radius is used.
+	Tolerance float64
+
+	// cartogramSlots, if not nil, limits the number of cartograms
+	// that are computed at the same time.
+	cartogramSlots chan struct{}
+}
+
+// pipelineResult holds the outputs of a pipeline.
+type pipelineResult struct {
+	// Cartogram holds the cartogram-transformed input features.
+	Cartogram *tilegram.Features
+
+	// Hexagram is the hexagonal tilegram, and Groups holds the
+	// outlines of the groups in it. They are not set if no
+	// hexagon radius or count was specified.
+	Hexagram *tilegram.Hexagram
+	Groups   []tilegram.Tile
+}
+
+// run runs the pipeline on features f. If progress is not nil, it is
+// called with a description of each stage as the stage begins.
+// If withCartogram is not nil, it is called with the cartogram
+// before the cartogram is destroyed.
+func (p *pipeline) run(f *tilegram.Features, progress func(stage string), withCartogram func(*tilegram.Cartogram) error) (*pipelineResult, error) {
+	if progress == nil {
+		progress = func(string) {}
+	}
+	carto, err := p.cartogram(f, progress, withCartogram)
+	if err != nil {
+		return nil, err
+	}
+	o := &pipelineResult{Cartogram: carto}
+	if p.Radius <= 0 && p.Tiles <= 0 {
+		return o, nil
+	}
+	o.Hexagram, o.Groups, err = p.hexagram(carto, progress)
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// cartogram computes a cartogram from features f and returns
+// the cartogram-transformed features. The arguments are
+// as for run, except that progress must not be nil.
+func (p *pipeline) cartogram(f *tilegram.Features, progress func(stage string), withCartogram func(*tilegram.Cartogram) error) (*tilegram.Features, error) {
+	if p.RubberSheet > 0 {
+		if withCartogram != nil {
+			return nil, errors.New("the transform of a rubber-sheet cartogram cannot be saved")
+		}
+		progress("computing rubber-sheet cartogram")
+		r := tilegram.NewRubberSheet(f, p.RubberSheet, 0)
+		progress("transforming features")
+		return f.Transform(r), nil
+	}
+	if p.cartogramSlots != nil {
+		select {
+		case p.cartogramSlots <- struct{}{}:
+		default:
+			progress("waiting for cartogram engine")
+			p.cartogramSlots <- struct{}{}
+		}
+	}
+	defer p.releaseCartogram()
+	progress("computing cartogram")
+	var opts []tilegram.Option
+	if p.Strength != nil {
+		opts = append(opts, tilegram.WithStrength(*p.Strength))
+	}
+	if p.Cells > 0 && !hasArea(f, p.Margin) {
+		return nil, errors.New("the input and margin cover no area, so a grid of square cells can't be fitted to them")
+	}
+	var c *tilegram.Cartogram
+	if p.Cells > 0 {
+		c = tilegram.NewSquareCartogram(f, p.Margin, tilegram.SquareCellSize(f, p.Margin, p.Cells), opts...)
+	} else {
+		c = tilegram.NewCartogram(f, p.Margin, p.Rows, p.Cols, opts...)
+	}
+	defer c.Destroy()
+	c.Blur = p.Blur
+	c.MaxSegment, c.Simplify = p.MaxSegment, p.Simplify
+	c.RepairPasses = p.RepairPasses
+	c.SharedVertices = true
+	if withCartogram != nil {
+		if err := withCartogram(c); err != nil {
+			return nil, err
+		}
+	}
+	progress("transforming features")
+	return f.Transform(c), nil
+}
+
+// hasArea returns whether the bounds of features f, with margin added
+// to each side, have positive, finite width and height.
+func hasArea(f *tilegram.Features, margin float64) bool {
+	b := geom.NewBounds()
+	for _, p := range f.Polygons {
+		b.Extend(p.Bounds())
+	}
+	w, h := b.Max.X-b.Min.X+2*margin, b.Max.Y-b.Min.Y+2*margin
+	return w > 0 && h > 0 && !math.IsInf(w, 0) && !math.IsInf(h, 0)
+}
+
+// hexagram allocates the cartogram-transformed features carto to
+// hexagons and returns the hexagram and the outlines of its groups.
+// progress must not be nil.
+func (p *pipeline) hexagram(carto *tilegram.Features, progress func(stage string)) (*tilegram.Hexagram, []tilegram.Tile, error) {
+	progress("allocating hexagons")
+	var h *tilegram.Hexagram
+	var err error
+	if p.Radius > 0 {
+		h, err = tilegram.NewHexagram(carto.Groupers(), p.Radius)
+	} else {
+		h, err = tilegram.NewHexagramCount(carto.Groupers(), p.Tiles)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	progress("combining groups")
+	tol := p.Tolerance
+	if tol <= 0 {
+		tol = h.Radius() / 2
+	}
+	return h, h.GroupTiles(tol), nil
+}
+
+func (p *pipeline) releaseCartogram() {
+	if p.cartogramSlots != nil {
+		<-p.cartogramSlots
+	}
+}
@@ -0,0 +1,509 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ctessum/geom/proj"
+	"github.com/ctessum/tilegram"
+)
+
+// runServe runs the serve command, which provides an HTTP
+// interface for creating cartograms and tilegrams.
+//
+// Jobs are created by POSTing a GeoJSON FeatureCollection to /jobs,
+// with the pipeline parameters given as query parameters named
+// after the flags of the make command (weight, group, projection,
+// lonlat, rows, cols, cells, margin, blur, strength, maxsegment,
+// simplify, repair, rubbersheet, radius, tiles and tolerance). The
+// input, like any GeoJSON, is taken to be in longitude and latitude and
+// projected to an equal-area projection, unless its coordinates are out
+// of range or projection is set, so margin, simplify, radius and
+// tolerance are then in meters. The response holds the job ID, which is
+// a hash of the input and parameters, so resubmitting the same request
+// returns the cached job. New jobs are refused with status 503 while
+// the inputs of the jobs waiting to run would total more than the
+// -maxqueued flag allows. Progress can be followed at
+// /jobs/{id}/events as Server-Sent Events, and results are available
+// at /jobs/{id}/{hexagons,groups,cartogram}.{geojson,svg}, in longitude
+// and latitude if lonlat is true, and, in the format read by the edit
+// command and in projected coordinates, at /jobs/{id}/hexagram.json.
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := fs.String("addr", "localhost:8080", "`address` to listen on")
+	workers := fs.Int("workers", runtime.NumCPU(), "maximum number of jobs to run at the same time")
+	cacheSize := fs.Int("cache", 100, "maximum number of finished jobs to keep")
+	maxBytes := fs.Int64("maxbytes", 256<<20, "maximum size of uploaded input, in bytes")
+	maxQueued := fs.Int64("maxqueued", 1<<30, "maximum total size of the inputs of queued jobs, in bytes")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	s := newServer(*workers, *cacheSize, *maxBytes, *maxQueued)
+	defer s.close()
+	log.Printf("tilegram: listening on %s", *addr)
+	return http.ListenAndServe(*addr, s)
+}
+
+// server is an HTTP handler that runs tilegram jobs.
+type server struct {
+	queue          chan *job
+	cartogramSlots chan struct{}
+	cacheSize      int
+	maxBytes       int64
+	maxQueued      int64
+
+	mu       sync.Mutex
+	jobs     map[string]*job
+	finished []string // IDs of finished jobs, oldest first.
+	queued   int64    // Total size of the inputs of queued jobs.
+}
+
+// newServer returns a server that runs up to workers jobs at a time,
+// keeps the results of up to cacheSize finished jobs, and accepts
+// inputs of up to maxBytes bytes while the inputs of the jobs waiting
+// to run total no more than maxQueued bytes. Only tilegram.MaxCartograms
+// jobs can be in the cartogram stage at the same time; other jobs wait
+// for them.
+func newServer(workers, cacheSize int, maxBytes, maxQueued int64) *server {
+	s := &server{
+		queue:          make(chan *job, 1000),
+		cartogramSlots: make(chan struct{}, tilegram.MaxCartograms),
+		cacheSize:      cacheSize,
+		maxBytes:       maxBytes,
+		maxQueued:      maxQueued,
+		jobs:           make(map[string]*job),
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for j := range s.queue {
+				s.mu.Lock()
+				s.queued -= int64(len(j.input))
+				s.mu.Unlock()
+				s.run(j)
+			}
+		}()
+	}
+	return s
+}
+
+// close stops the receiver's workers once the queued jobs are finished.
+func (s *server) close() { close(s.queue) }
+
+// job is a request to run a pipeline on a set of input features.
+type job struct {
+	id            string
+	weight, group string
+	p             pipeline
+	input         []byte
+
+	// projection is the proj4 definition of the projection of the
+	// input, if it is set, and lonLat is whether the results are
+	// served in longitude and latitude.
+	projection string
+	lonLat     bool
+
+	// sr is the projection the results are computed in, and lonLatSR
+	// is the spatial reference they are served in if lonLat is set.
+	sr, lonLatSR *proj.SR
+
+	mu       sync.Mutex
+	events   []jobEvent
+	changed  chan struct{} // closed and replaced when events are added
+	finished bool
+	err      error
+	result   *pipelineResult
+}
+
+// jobEvent is a progress update for a job.
+type jobEvent struct {
+	// Type is "progress", "done" or "error".
+	Type  string `json:"type"`
+	Stage string `json:"stage,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// jobStatus is the JSON representation of a job.
+type jobStatus struct {
+	ID    string `json:"id"`
+	State string `json:"state"`
+	Stage string `json:"stage,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+func (j *job) progress(stage string) {
+	j.publish(jobEvent{Type: "progress", Stage: stage}, false)
+}
+
+func (j *job) finish(r *pipelineResult, err error) {
+	e := jobEvent{Type: "done"}
+	if err != nil {
+		e = jobEvent{Type: "error", Error: err.Error()}
+	}
+	j.mu.Lock()
+	j.result, j.err, j.input = r, err, nil
+	j.mu.Unlock()
+	j.publish(e, true)
+}
+
+func (j *job) publish(e jobEvent, finished bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.events = append(j.events, e)
+	j.finished = finished
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+func (j *job) status() jobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	s := jobStatus{ID: j.id, State: "running"}
+	last := j.events[len(j.events)-1]
+	s.Stage = last.Stage
+	switch {
+	case j.err != nil:
+		s.State, s.Error = "error", j.err.Error()
+	case j.finished:
+		s.State = "done"
+	case last.Stage == "queued":
+		s.State = "queued"
+	}
+	return s
+}
+
+// project returns features f, read from the input of the receiver, in
+// the projection that the cartogram is computed in, and records the
+// projections needed to serve the results.
+func (j *job) project(f *tilegram.Features) (*tilegram.Features, error) {
+	if j.projection != "" {
+		sr, err := proj.Parse(j.projection)
+		if err != nil {
+			return nil, err
+		}
+		f.SR = sr
+	}
+	if j.lonLat {
+		sr, err := lonLatReference(f.SR)
+		if err != nil {
+			return nil, err
+		}
+		j.lonLatSR = sr
+	}
+	f, err := f.EqualArea()
+	if err != nil {
+		return nil, err
+	}
+	j.sr = f.SR
+	return f, nil
+}
+
+// run runs job j and adds it to the cache of finished jobs.
+func (s *server) run(j *job) {
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				j.finish(nil, fmt.Errorf("%v", r))
+			}
+		}()
+		j.progress("reading input")
+		f, err := tilegram.ReadGeoJSON(bytes.NewReader(j.input), j.weight, j.group)
+		j.input = nil // The job is identified by its ID from now on.
+		if err == nil {
+			f, err = j.project(f)
+		}
+		if err != nil {
+			j.finish(nil, err)
+			return
+		}
+		j.finish(j.p.run(f, j.progress, nil))
+	}()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.finished = append(s.finished, j.id)
+	for len(s.finished) > s.cacheSize {
+		delete(s.jobs, s.finished[0])
+		s.finished = s.finished[1:]
+	}
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "jobs" || len(parts) > 3 {
+		http.NotFound(w, r)
+		return
+	}
+	if len(parts) == 1 {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.create(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.Lock()
+	j, ok := s.jobs[parts[1]]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case len(parts) == 2:
+		writeJSON(w, http.StatusOK, j.status())
+	case parts[2] == "events":
+		s.events(w, r, j)
+	default:
+		s.result(w, r, j, parts[2])
+	}
+}
+
+// create handles requests to create a new job.
+func (s *server) create(w http.ResponseWriter, r *http.Request) {
+	j, err := parseJob(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Inputs are rejected before they are read if the queue is full.
+	s.mu.Lock()
+	full := s.queued >= s.maxQueued
+	s.mu.Unlock()
+	if full {
+		http.Error(w, "too many queued jobs", http.StatusServiceUnavailable)
+		return
+	}
+	j.input, err = io.ReadAll(http.MaxBytesReader(w, r.Body, s.maxBytes))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	h := sha256.New()
+	json.NewEncoder(h).Encode(struct {
+		Weight, Group, Projection string
+		LonLat                    bool
+		Pipeline                  pipeline
+	}{j.weight, j.group, j.projection, j.lonLat, j.p})
+	h.Write(j.input)
+	j.id = hex.EncodeToString(h.Sum(nil))
+
+	s.mu.Lock()
+	if cached, ok := s.jobs[j.id]; ok {
+		s.mu.Unlock()
+		writeJSON(w, http.StatusOK, cached.status())
+		return
+	}
+	j.changed = make(chan struct{})
+	j.events = []jobEvent{{Type: "progress", Stage: "queued"}}
+	j.p.cartogramSlots = s.cartogramSlots
+	if s.queued+int64(len(j.input)) > s.maxQueued {
+		s.mu.Unlock()
+		http.Error(w, "too many queued jobs", http.StatusServiceUnavailable)
+		return
+	}
+	select {
+	case s.queue <- j:
+		s.jobs[j.id] = j
+		s.queued += int64(len(j.input))
+		s.mu.Unlock()
+	default:
+		s.mu.Unlock()
+		http.Error(w, "too many queued jobs", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Location", "/jobs/"+j.id)
+	writeJSON(w, http.StatusAccepted, j.status())
+}
+
+// parseJob creates a job from the given request parameters.
+func parseJob(q url.Values) (*job, error) {
+	j := &job{
+		weight:     q.Get("weight"),
+		group:      q.Get("group"),
+		projection: q.Get("projection"),
+		p:          pipeline{Rows: 512, Cols: 1024},
+	}
+	if j.weight == "" {
+		return nil, fmt.Errorf("weight parameter must be set")
+	}
+	if s := q.Get("lonlat"); s != "" {
+		var err error
+		if j.lonLat, err = strconv.ParseBool(s); err != nil {
+			return nil, fmt.Errorf("invalid lonlat parameter: %v", err)
+		}
+	}
+	for name, v := range map[string]*int{"rows": &j.p.Rows, "cols": &j.p.Cols, "cells": &j.p.Cells, "tiles": &j.p.Tiles,
+		"repair": &j.p.RepairPasses, "rubbersheet": &j.p.RubberSheet} {
+		if s := q.Get(name); s != "" {
+			var err error
+			if *v, err = strconv.Atoi(s); err != nil {
+				return nil, fmt.Errorf("invalid %s parameter: %v", name, err)
+			}
+		}
+	}
+	for name, v := range map[string]*float64{"margin": &j.p.Margin, "blur": &j.p.Blur,
+		"maxsegment": &j.p.MaxSegment, "simplify": &j.p.Simplify, "radius": &j.p.Radius, "tolerance": &j.p.Tolerance} {
+		if s := q.Get(name); s != "" {
+			var err error
+			if *v, err = strconv.ParseFloat(s, 64); err != nil {
+				return nil, fmt.Errorf("invalid %s parameter: %v", name, err)
+			}
+		}
+	}
+	if s := q.Get("strength"); s != "" {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid strength parameter: %v", err)
+		}
+		if !(v >= 0 && v <= 1) {
+			return nil, fmt.Errorf("strength must be between 0 and 1")
+		}
+		j.p.Strength = &v
+	}
+	if j.p.Cells != 0 && j.p.Cells < 4 {
+		return nil, fmt.Errorf("cells must be 0 or at least 4")
+	}
+	if j.p.RepairPasses < 0 {
+		return nil, fmt.Errorf("repair must not be negative")
+	}
+	if j.p.Rows <= 0 || j.p.Cols <= 0 {
+		return nil, fmt.Errorf("rows and cols must be positive")
+	}
+	return j, nil
+}
+
+// events streams the progress of job j as Server-Sent Events
+// until the job is finished.
+func (s *server) events(w http.ResponseWriter, r *http.Request, j *job) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher, _ := w.(http.Flusher)
+	var next int
+	for {
+		j.mu.Lock()
+		events := j.events[next:]
+		changed, finished := j.changed, j.finished
+		j.mu.Unlock()
+
+		for _, e := range events {
+			b, err := json.Marshal(e)
+			if err != nil {
+				panic(err)
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, b)
+		}
+		next += len(events)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if finished {
+			return
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// result writes the named result of job j, for example
+// "hexagons.geojson" or "groups.svg".
+func (s *server) result(w http.ResponseWriter, r *http.Request, j *job, name string) {
+	j.mu.Lock()
+	res, err, finished := j.result, j.err, j.finished
+	sr, lonLatSR := j.sr, j.lonLatSR
+	j.mu.Unlock()
+	switch {
+	case !finished:
+		http.Error(w, "job is not finished", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	if name == "hexagram.json" {
+		if res.Hexagram == nil {
+			http.Error(w, "no tilegram was requested for this job", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := res.Hexagram.Encode(w); err != nil {
+			log.Printf("tilegram: writing %s for job %s: %v", name, j.id, err)
+		}
+		return
+	}
+
+	var tiles []tilegram.Tile
+	base, format := name, ""
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		base, format = name[:i], name[i+1:]
+	}
+	switch base {
+	case "cartogram":
+		tiles = res.Cartogram.Tiles()
+	case "hexagons", "groups":
+		if res.Hexagram == nil {
+			http.Error(w, "no tilegram was requested for this job", http.StatusNotFound)
+			return
+		}
+		// The groups are stored in the cached result, so they are
+		// copied before being projected in place below.
+		tiles = append([]tilegram.Tile(nil), res.Groups...)
+		if base == "hexagons" {
+			tiles = res.Hexagram.Tiles()
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if lonLatSR != nil {
+		if err := tilegram.ProjectTiles(tiles, sr, lonLatSR); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	switch format {
+	case "geojson":
+		w.Header().Set("Content-Type", "application/geo+json")
+		err = tilegram.WriteGeoJSON(w, tiles)
+	case "svg":
+		w.Header().Set("Content-Type", "image/svg+xml")
+		err = tilegram.WriteSVG(w, tiles, svgWidth)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("tilegram: writing %s for job %s: %v", name, j.id, err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("tilegram: writing response: %v", err)
+	}
+}
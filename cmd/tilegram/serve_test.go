@@ -0,0 +1,295 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/tilegram"
+)
+
+func TestServe(t *testing.T) {
+	in, total := writeTestInput(t, t.TempDir())
+	input, err := os.ReadFile(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(2, 10, 1<<20, 1<<22)
+	defer s.close()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	const query = "/jobs?weight=pop&group=state&rows=32&cols=32&margin=1&tiles=12"
+	post := func() (int, jobStatus) {
+		resp, err := http.Post(ts.URL+query, "application/geo+json", strings.NewReader(string(input)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var status jobStatus
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, status
+	}
+	code, status := post()
+	if code != http.StatusAccepted {
+		t.Fatalf("status code: have %d, want %d", code, http.StatusAccepted)
+	}
+
+	resp, err := http.Get(ts.URL + "/jobs/" + status.ID + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if e := strings.TrimPrefix(scanner.Text(), "event: "); e != scanner.Text() {
+			events = append(events, e)
+		}
+	}
+	resp.Body.Close()
+	if len(events) < 2 || events[0] != "progress" || events[len(events)-1] != "done" {
+		t.Fatalf("events: %v", events)
+	}
+
+	resp, err = http.Get(ts.URL + "/jobs/" + status.ID + "/hexagons.geojson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := tilegram.ReadGeoJSON(resp.Body, "weight", "group")
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sum float64
+	for _, w := range f.Weights {
+		sum += w
+	}
+	if sum <= 0 || sum > total*1.000001 {
+		t.Errorf("hexagon weight %g out of range (0, %g]", sum, total)
+	}
+
+	resp, err = http.Get(ts.URL + "/jobs/" + status.ID + "/groups.svg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.HasPrefix(string(b), "<svg") {
+		t.Errorf("invalid SVG: %.50s", b)
+	}
+
+	code, status2 := post()
+	if code != http.StatusOK || status2.ID != status.ID || status2.State != "done" {
+		t.Errorf("resubmitted job should be cached: %d %+v", code, status2)
+	}
+
+	resp, err = http.Post(ts.URL+"/jobs?group=state", "application/geo+json", strings.NewReader(string(input)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("missing weight: have status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestServeQueueFull(t *testing.T) {
+	in, _ := writeTestInput(t, t.TempDir())
+	input, err := os.ReadFile(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// With no workers, the queue only fills up. It has room
+	// for the input of one job but not of two.
+	s := newServer(0, 10, 1<<20, int64(len(input))*3/2)
+	defer s.close()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	for i, want := range []int{http.StatusAccepted, http.StatusServiceUnavailable} {
+		resp, err := http.Post(ts.URL+"/jobs?weight=pop&rows="+strconv.Itoa(32+i), "application/geo+json", strings.NewReader(string(input)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("job %d: have status %d, want %d", i, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestServeLonLat(t *testing.T) {
+	in, _ := writeTestInput(t, t.TempDir())
+	input, err := os.ReadFile(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(1, 10, 1<<20, 1<<22)
+	defer s.close()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	// The input is in longitude and latitude, so the cartogram is
+	// computed in meters, and lonlat projects it back.
+	bounds := make(map[string]*geom.Bounds)
+	for _, lonLat := range []string{"false", "true"} {
+		resp, err := http.Post(ts.URL+"/jobs?weight=pop&rows=32&cols=32&lonlat="+lonLat, "application/geo+json", strings.NewReader(string(input)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var status jobStatus
+		err = json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err = http.Get(ts.URL + "/jobs/" + status.ID + "/events")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		resp, err = http.Get(ts.URL + "/jobs/" + status.ID + "/cartogram.geojson")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := tilegram.ReadGeoJSON(resp.Body, "weight", "group")
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := geom.NewBounds()
+		for _, p := range f.Polygons {
+			b.Extend(p.Bounds())
+		}
+		bounds[lonLat] = b
+	}
+	if b := bounds["false"]; b.Max.X-b.Min.X < 1e5 {
+		t.Errorf("projected cartogram bounds: %v", b)
+	}
+	if b := bounds["true"]; b.Min.X < -1 || b.Max.X > 5 || b.Min.Y < -1 || b.Max.Y > 5 {
+		t.Errorf("longitude and latitude cartogram bounds: %v", b)
+	}
+}
+
+func TestServeLonLatRepeated(t *testing.T) {
+	in, _ := writeTestInput(t, t.TempDir())
+	input, err := os.ReadFile(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(1, 10, 1<<20, 1<<22)
+	defer s.close()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/jobs?weight=pop&group=state&rows=32&cols=32&tiles=12&lonlat=true", "application/geo+json", strings.NewReader(string(input)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status jobStatus
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.Get(ts.URL + "/jobs/" + status.ID + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	// The results are projected to longitude and latitude each time they
+	// are fetched, without changing the cached results, even when they
+	// are fetched concurrently.
+	for _, name := range []string{"groups.geojson", "hexagons.geojson", "cartogram.geojson"} {
+		var (
+			wg   sync.WaitGroup
+			have [4][]byte
+			errs [4]error
+		)
+		for i := range have {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				resp, err := http.Get(ts.URL + "/jobs/" + status.ID + "/" + name)
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				defer resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					errs[i] = fmt.Errorf("status %s", resp.Status)
+					return
+				}
+				have[i], errs[i] = io.ReadAll(resp.Body)
+			}(i)
+		}
+		wg.Wait()
+		for i := range have {
+			if errs[i] != nil {
+				t.Fatalf("%s: %v", name, errs[i])
+			}
+			if !bytes.Equal(have[i], have[0]) {
+				t.Errorf("%s: fetch %d differs from the first", name, i)
+			}
+		}
+		f, err := tilegram.ReadGeoJSON(bytes.NewReader(have[0]), "weight", "group")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !tilegram.IsGeographic(f.SR) {
+			t.Errorf("%s is not in longitude and latitude", name)
+		}
+	}
+}
+
+func TestParseJob(t *testing.T) {
+	for _, test := range []struct {
+		query string
+		ok    bool
+	}{
+		{query: "weight=pop", ok: true},
+		{query: "weight=pop&cells=4", ok: true},
+		{query: "weight=pop&cells=0", ok: true},
+		{query: "weight=pop&cells=1"},
+		{query: "weight=pop&cells=3"},
+		{query: "weight=pop&cells=-1"},
+		{query: "weight=pop&rows=0"},
+		{query: "cells=100"},
+		{query: "weight=pop&lonlat=true", ok: true},
+		{query: "weight=pop&lonlat=maybe"},
+		{query: "weight=pop&strength=0", ok: true},
+		{query: "weight=pop&strength=0.5", ok: true},
+		{query: "weight=pop&strength=-0.1"},
+		{query: "weight=pop&strength=1.5"},
+		{query: "weight=pop&strength=NaN"},
+		{query: "weight=pop&strength=strong"},
+	} {
+		q, err := url.ParseQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parseJob(q); (err == nil) != test.ok {
+			t.Errorf("%s: have error %v, want ok %v", test.query, err, test.ok)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ctessum/geom/proj"
+	"github.com/ctessum/tilegram"
+)
+
+// runWarp runs the warp command, which transforms map layers
+// to match a cartogram that was saved by the make command. Layers
+// whose spatial reference is known, from a .prj file or because they
+// are GeoJSON in longitude and latitude, are projected to that of the
+// cartogram before they are transformed and back afterwards.
+func runWarp(args []string) error {
+	fs := flag.NewFlagSet("warp", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: tilegram warp -transform file -outdir dir layer...")
+		fs.PrintDefaults()
+	}
+	transform := fs.String("transform", "", "cartogram transform `file` created by \"tilegram make -transform\"")
+	outdir := fs.String("outdir", "", "`directory` to write the transformed layers to, using the input file names")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	switch {
+	case *transform == "":
+		return errors.New("-transform must be set")
+	case *outdir == "":
+		return errors.New("-outdir must be set")
+	case fs.NArg() == 0:
+		return errors.New("no input layers specified")
+	}
+
+	c, err := readTransform(*transform)
+	if err != nil {
+		return err
+	}
+	var sr *proj.SR
+	if c.Projection != "" {
+		if sr, err = proj.Parse(c.Projection); err != nil {
+			return fmt.Errorf("%s: %v", *transform, err)
+		}
+	}
+	outputs, err := warpOutputs(*outdir, fs.Args())
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*outdir, 0755); err != nil {
+		return err
+	}
+	for i, in := range fs.Args() {
+		l, err := readLayer(in)
+		if err != nil {
+			return err
+		}
+		for i, g := range l.geoms {
+			if g == nil {
+				return fmt.Errorf("%s: feature %d has no geometry", in, i)
+			}
+		}
+		if err := l.warp(c, sr); err != nil {
+			return fmt.Errorf("%s: %v", in, err)
+		}
+		if err := l.write(outputs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// warpOutputs returns the names of the files in outdir that the named
+// input layers are written to, which have the same base names. It
+// returns an error if two inputs would be written to the same file or
+// an output would replace one of the inputs.
+func warpOutputs(outdir string, inputs []string) ([]string, error) {
+	var stats []os.FileInfo
+	for _, in := range inputs {
+		fi, err := os.Stat(in)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, fi)
+	}
+	o := make([]string, len(inputs))
+	written := make(map[string]string)
+	for i, in := range inputs {
+		o[i] = filepath.Join(outdir, filepath.Base(in))
+		abs, err := filepath.Abs(o[i])
+		if err != nil {
+			return nil, err
+		}
+		if prev, ok := written[abs]; ok {
+			return nil, fmt.Errorf("inputs %s and %s would both be written to %s", prev, in, o[i])
+		}
+		written[abs] = in
+		fi, err := os.Stat(o[i])
+		if err != nil {
+			continue
+		}
+		for j, in := range inputs {
+			if os.SameFile(fi, stats[j]) {
+				return nil, fmt.Errorf("%s would be overwritten by its output", in)
+			}
+		}
+	}
+	return o, nil
+}
+
+// readTransform reads a cartogram from the named file.
+func readTransform(filename string) (*tilegram.Cartogram, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return tilegram.DecodeCartogram(f)
+}
@@ -0,0 +1,180 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/proj"
+	"github.com/ctessum/tilegram"
+)
+
+func TestWarp(t *testing.T) {
+	dir := t.TempDir()
+	in, _ := writeTestInput(t, dir)
+	transform := filepath.Join(dir, "carto.gob")
+	carto := filepath.Join(dir, "carto.geojson")
+	err := runMake([]string{"-in", in, "-weight", "pop", "-group", "state",
+		"-rows", "32", "-cols", "32", "-margin", "1", "-transform", transform,
+		"-lonlat", "-cartogram", carto})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	points := filepath.Join(dir, "points.geojson")
+	const pointsJSON = `{"type":"FeatureCollection","features":[
+{"type":"Feature","properties":{"name":"x","n":3},"geometry":{"type":"Point","coordinates":[1.5,2.5]}},
+{"type":"Feature","properties":{"name":"y"},"geometry":{"type":"LineString","coordinates":[[0.5,0.5],[3.5,3.5]]}}
+]}`
+	if err := os.WriteFile(points, []byte(pointsJSON), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	outdir := filepath.Join(dir, "out")
+	if err := runWarp([]string{"-transform", transform, "-outdir", outdir, in, points}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The input is in longitude and latitude, so the layers are
+	// projected to the equal-area projection of the cartogram
+	// and back.
+	c, err := readTransform(transform)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Projection == "" {
+		t.Fatal("the projection of the cartogram is not stored")
+	}
+	lonLat, err := proj.Parse(tilegram.LonLatWGS84)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr, err := proj.Parse(c.Projection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := projectGeoms([]geom.Geom{geom.Point{X: 1.5, Y: 2.5}}, lonLat, sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, err = projectGeoms(c.TransformGeoms(want), sr, lonLat); err != nil {
+		t.Fatal(err)
+	}
+	l, err := readLayer(filepath.Join(outdir, "points.geojson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.geoms) != 2 {
+		t.Fatalf("have %d features, want 2", len(l.geoms))
+	}
+	if l.geoms[0] != want[0] {
+		t.Errorf("point: have %v, want %v", l.geoms[0], want[0])
+	}
+	if ls, ok := l.geoms[1].(geom.LineString); !ok || len(ls) != 2 {
+		t.Errorf("line: have %#v", l.geoms[1])
+	}
+	if want := map[string]interface{}{"name": "x", "n": 3.}; !reflect.DeepEqual(l.props[0], want) {
+		t.Errorf("properties: have %v, want %v", l.props[0], want)
+	}
+
+	polys, err := readLayer(filepath.Join(outdir, "in.geojson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(polys.geoms) != 16 {
+		t.Fatalf("have %d polygons, want 16", len(polys.geoms))
+	}
+
+	// The warped input matches the cartogram made from it, apart from
+	// the error of interpolating the stored grid.
+	f, err := tilegram.ReadFeatures(carto, "weight", "group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const tol = 0.01 // degrees
+	for i, g := range polys.geoms {
+		have, want := g.(geom.Polygonal).Polygons()[0][0], f.Polygons[i].Polygons()[0][0]
+		if len(have) != len(want) {
+			t.Fatalf("polygon %d: have %d vertices, want %d", i, len(have), len(want))
+		}
+		for j := range have {
+			if d := math.Hypot(have[j].X-want[j].X, have[j].Y-want[j].Y); d > tol {
+				t.Errorf("polygon %d vertex %d: have %v, want %v", i, j, have[j], want[j])
+			}
+		}
+	}
+}
+
+func TestWarpUnknownProjection(t *testing.T) {
+	dir := t.TempDir()
+	in, _ := writeTestInput(t, dir)
+	projected := filepath.Join(dir, "projected.geojson")
+	err := runMake([]string{"-in", in, "-weight", "pop", "-rows", "32", "-cols", "32", "-cartogram", projected})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The projection of GeoJSON in meters is not known, so neither
+	// is that of a cartogram made from it, and layers in longitude and
+	// latitude can't be projected to match it.
+	transform := filepath.Join(dir, "carto.gob")
+	err = runMake([]string{"-in", projected, "-weight", "weight", "-rows", "32", "-cols", "32", "-transform", transform})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runWarp([]string{"-transform", transform, "-outdir", filepath.Join(dir, "out"), in}); err == nil {
+		t.Error("no error warping a layer in longitude and latitude")
+	}
+	if err := runWarp([]string{"-transform", transform, "-outdir", filepath.Join(dir, "out"), projected}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWarpOutputs(t *testing.T) {
+	dir := t.TempDir()
+	in, _ := writeTestInput(t, dir)
+	transform := filepath.Join(dir, "carto.gob")
+	err := runMake([]string{"-in", in, "-weight", "pop", "-rows", "32", "-cols", "32", "-transform", transform})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(dir, "other", "in.geojson")
+	if err := os.MkdirAll(filepath.Dir(other), 0755); err != nil {
+		t.Fatal(err)
+	}
+	input, err := os.ReadFile(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(other, input, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		outdir string
+		inputs []string
+	}{
+		{name: "same base name", outdir: filepath.Join(dir, "out"), inputs: []string{in, other}},
+		{name: "input directory", outdir: dir, inputs: []string{in}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			args := append([]string{"-transform", transform, "-outdir", test.outdir}, test.inputs...)
+			if err := runWarp(args); err == nil {
+				t.Error("no error")
+			}
+			for _, f := range []string{in, other} {
+				if b, err := os.ReadFile(f); err != nil || string(b) != string(input) {
+					t.Errorf("%s was changed", f)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestNewDemers(t *testing.T) {
+	f := testDensity()
+	o, err := NewDemers(f.Groupers(), 1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The squares on each side of the center share a corner with
+	// the squares on the adjacent sides.
+	want := [][2]int{{0, 1}, {0, 2}, {0, 3}, {0, 4}, {1, 3}, {1, 4}, {2, 3}, {2, 4}}
+	if !reflect.DeepEqual(o.Neighbors, want) {
+		t.Errorf("neighbors: have %v, want %v", o.Neighbors, want)
+	}
+
+	// The five squares have a total area of 5 and weight of 14.
+	for i, s := range o.Squares {
+		if want := 5 * f.Weights[i] / 14; math.Abs(s.Side*s.Side-want) > 1e-12 {
+			t.Errorf("square %d area: have %g, want %g", i, s.Side*s.Side, want)
+		}
+	}
+	for i := range o.Squares {
+		for j := i + 1; j < len(o.Squares); j++ {
+			if o.overlap(i, j) {
+				t.Errorf("squares %d and %d overlap", i, j)
+			}
+		}
+	}
+	// The large center square pushes the others away,
+	// but they all still touch it.
+	for j := 1; j < len(o.Squares); j++ {
+		if !o.touching(0, j) {
+			t.Errorf("square %d does not touch the center: %v, %v", j, o.Squares[0], o.Squares[j])
+		}
+	}
+	if o.Stats.Overlaps != 0 || o.Touching < 4 || o.Stats.MaxDisplacement == 0 {
+		t.Errorf("touching %d, stats %+v", o.Touching, o.Stats)
+	}
+
+	tiles := o.Tiles()
+	if len(tiles) != len(o.Squares) || tiles[1].Group != "b" {
+		t.Fatalf("have %d tiles, want %d", len(tiles), len(o.Squares))
+	}
+	if a := tiles[0].Geom.Area(); math.Abs(a-50.0/14) > 1e-12 {
+		t.Errorf("tile area: have %g, want %g", a, 50.0/14)
+	}
+
+	if _, err := NewDemers(nil, 1, 10); err == nil {
+		t.Error("no error for empty data")
+	}
+}
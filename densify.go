@@ -0,0 +1,315 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"math"
+	"sort"
+
+	"github.com/ctessum/geom"
+)
+
+// densePath is a path with vertices inserted by densification.
+type densePath struct {
+	geom.Path
+
+	// segs holds the segments of the original path.
+	segs []denseSegment
+}
+
+// denseSegment is a segment of an original path.
+type denseSegment struct {
+	// start and end are the indices in the densified path of the
+	// vertices at the start and end of the segment.
+	start, end int
+
+	// reversed is true if the original segment runs in the opposite
+	// direction to its canonical direction, which is from its
+	// lesser to its greater end point.
+	reversed bool
+
+	// exact is true if the segment was split to repair a topology
+	// error, so that the vertices inserted into it are not simplified.
+	exact bool
+}
+
+// transformPaths transforms paths together in a single call. If polygon
+// is not nil, it holds for each path that is a ring, whose last vertex
+// connects to its first, the index of the polygon that the ring is in,
+// and -1 for the other paths. The receiver's MaxSegment, Simplify and
+// RepairPasses fields are applied.
+func (c *Cartogram) transformPaths(paths []geom.Path, polygon []int) []geom.Path {
+	closed := func(i int) bool { return polygon != nil && polygon[i] >= 0 }
+	// rings holds the indices of the paths that are rings.
+	var rings []int
+	for i := range paths {
+		if closed(i) {
+			rings = append(rings, i)
+		}
+	}
+	// split holds the maximum lengths, in grid cells, of segments that
+	// have been split to repair topology errors, by their end points in
+	// canonical order. All rings are transformed again after each repair
+	// pass so that shared vertices are transformed identically.
+	var split map[[2]geom.Point]float64
+	if c.SharedVertices {
+		paths = c.snap(paths, closed)
+	}
+	for pass := 0; ; pass++ {
+		dense := make([]densePath, len(paths))
+		for i, p := range paths {
+			dense[i] = c.densify(p, closed(i), split)
+		}
+		o := c.transformDense(dense, closed, c.transformVertices)[0]
+
+		var errs []topologyError
+		if len(rings) > 0 && pass < c.RepairPasses {
+			ringPaths := make([]geom.Path, len(rings))
+			ringPolygon := make([]int, len(rings))
+			for k, i := range rings {
+				ringPaths[k], ringPolygon[k] = o[i], polygon[i]
+			}
+			errs = topologyErrors(ringPaths, ringPolygon)
+			for k := range errs {
+				errs[k].ring, errs[k].otherRing = rings[errs[k].ring], rings[errs[k].otherRing]
+			}
+		}
+		if len(errs) == 0 {
+			if c.Simplify > 0 {
+				for i, d := range dense {
+					o[i] = simplifySegments(o[i], d.segs, c.Simplify)
+				}
+			}
+			return o
+		}
+		if split == nil {
+			split = make(map[[2]geom.Point]float64)
+		}
+		halve := make(map[[2]geom.Point]float64)
+		for _, e := range errs {
+			segs := [][2]int{{e.otherRing, e.otherVertex}}
+			if !e.inside {
+				segs = append(segs, [2]int{e.ring, e.vertex})
+			}
+			for _, rs := range segs {
+				d := dense[rs[0]]
+				k := sort.Search(len(d.segs), func(k int) bool { return d.segs[k].end > rs[1] })
+				if k == len(d.segs) {
+					continue
+				}
+				s := d.segs[k]
+				a, b := d.Path[s.start], d.Path[s.end%len(d.Path)]
+				if s.reversed {
+					a, b = b, a
+				}
+				key := [2]geom.Point{a, b}
+				maxLen, ok := split[key]
+				if !ok {
+					maxLen = math.Hypot((b.X-a.X)/c.dx, (b.Y-a.Y)/c.dy)
+					if c.MaxSegment > 0 {
+						maxLen = math.Min(maxLen, c.MaxSegment)
+					}
+				}
+				halve[key] = maxLen / 2
+			}
+		}
+		for key, maxLen := range halve {
+			split[key] = maxLen
+		}
+	}
+}
+
+// transformDense transforms the densified paths dense together, using
+// transform, which returns any number of transformed copies of the
+// vertices it is given, and returns the paths in each copy. closed is
+// as for newArcTopology. If the receiver's SharedVertices field is
+// true, the vertices are given to transform through the shared-arc
+// topology of the paths, so that each distinct vertex is given once.
+func (c *Cartogram) transformDense(dense []densePath, closed func(int) bool, transform func(geom.Path) []geom.Path) [][]geom.Path {
+	paths := make([]geom.Path, len(dense))
+	for i, d := range dense {
+		paths[i] = d.Path
+	}
+	if c.SharedVertices {
+		t := newArcTopology(paths, closed)
+		copies := transform(t.vertices)
+		o := make([][]geom.Path, len(copies))
+		for f, v := range copies {
+			o[f] = t.assemble(v)
+		}
+		return o
+	}
+	var all geom.Path
+	for _, p := range paths {
+		all = append(all, p...)
+	}
+	copies := transform(all)
+	o := make([][]geom.Path, len(copies))
+	for f, all := range copies {
+		o[f] = make([]geom.Path, len(paths))
+		var k int
+		for i, p := range paths {
+			o[f][i] = all[k : k+len(p) : k+len(p)]
+			k += len(p)
+		}
+	}
+	return o
+}
+
+// transformVertices returns the transformed vertices of p,
+// as the only copy for transformDense.
+func (c *Cartogram) transformVertices(p geom.Path) []geom.Path {
+	x, y := c.pathToGrid(p)
+	c.transformGrid(x, y)
+	return []geom.Path{c.pathFromGrid(x, y)}
+}
+
+// densify inserts vertices into p so that no segment is longer than
+// the receiver's MaxSegment, in grid cells, or, for segments in split,
+// than the length given there. If closed is true and p is not
+// explicitly closed, its closing segment is densified as well.
+// Inserted vertices are calculated from the lesser end point of each
+// segment so that a segment shared by two paths is densified the
+// same way in both, whatever its direction.
+func (c *Cartogram) densify(p geom.Path, closed bool, split map[[2]geom.Point]float64) densePath {
+	var o densePath
+	if len(p) == 0 {
+		return o
+	}
+	n := len(p) - 1
+	if closed && len(p) > 1 && p[0] != p[len(p)-1] {
+		n = len(p)
+	}
+	o.Path = append(o.Path, p[0])
+	for i := 0; i < n; i++ {
+		a, b := p[i], p[(i+1)%len(p)]
+		seg := denseSegment{start: len(o.Path) - 1}
+		lo, hi := a, b
+		if pointLess(b, a) {
+			lo, hi = b, a
+			seg.reversed = true
+		}
+		maxLen, ok := split[[2]geom.Point{lo, hi}]
+		if !ok {
+			maxLen = c.MaxSegment
+		}
+		seg.exact = ok
+		var inserted geom.Path
+		if maxLen > 0 {
+			pieces := math.Ceil(math.Hypot((hi.X-lo.X)/c.dx, (hi.Y-lo.Y)/c.dy) / maxLen)
+			for k := 1.0; k < pieces; k++ {
+				f := k / pieces
+				inserted = append(inserted, geom.Point{X: lo.X + f*(hi.X-lo.X), Y: lo.Y + f*(hi.Y-lo.Y)})
+			}
+			if seg.reversed {
+				reversePath(inserted)
+			}
+		}
+		o.Path = append(o.Path, inserted...)
+		if i < len(p)-1 {
+			o.Path = append(o.Path, b)
+		}
+		seg.end = len(o.Path) - 1
+		if i == len(p)-1 {
+			// The closing segment ends at the first vertex.
+			seg.end = len(o.Path)
+		}
+		o.segs = append(o.segs, seg)
+	}
+	return o
+}
+
+// simplifySegments removes vertices inserted by densify from p that
+// are within tolerance of the line between the vertices that
+// remain on either side of them, using the Douglas-Peucker algorithm on
+// each original segment in its canonical direction. The original
+// vertices are kept.
+func simplifySegments(p geom.Path, segs []denseSegment, tolerance float64) geom.Path {
+	keep := make([]bool, len(p))
+	for _, s := range segs {
+		if s.exact {
+			for i := s.start; i < s.end && i < len(p); i++ {
+				keep[i] = true
+			}
+			continue
+		}
+		keep[s.start] = true
+		if s.end < len(p) {
+			keep[s.end] = true
+		}
+		span := make(geom.Path, 0, s.end-s.start+1)
+		for i := s.start; i <= s.end; i++ {
+			span = append(span, p[i%len(p)])
+		}
+		if s.reversed {
+			reversePath(span)
+		}
+		spanKeep := make([]bool, len(span))
+		douglasPeucker(span, spanKeep, tolerance)
+		for i, k := range spanKeep {
+			if !k {
+				continue
+			}
+			if s.reversed {
+				i = len(span) - 1 - i
+			}
+			keep[(s.start+i)%len(p)] = true
+		}
+	}
+	o := make(geom.Path, 0, len(p))
+	for i, pt := range p {
+		if keep[i] {
+			o = append(o, pt)
+		}
+	}
+	return o
+}
+
+// douglasPeucker marks in keep the vertices of p that are kept when
+// it is simplified to the given tolerance. The end points are
+// always kept.
+func douglasPeucker(p geom.Path, keep []bool, tolerance float64) {
+	keep[0], keep[len(p)-1] = true, true
+	if len(p) < 3 {
+		return
+	}
+	a, b := p[0], p[len(p)-1]
+	var maxDist float64
+	var maxI int
+	for i := 1; i < len(p)-1; i++ {
+		if d := segmentDistance(p[i], a, b); d > maxDist {
+			maxDist, maxI = d, i
+		}
+	}
+	if maxDist <= tolerance {
+		return
+	}
+	douglasPeucker(p[:maxI+1], keep[:maxI+1], tolerance)
+	douglasPeucker(p[maxI:], keep[maxI:], tolerance)
+}
+
+// segmentDistance returns the distance from p to the
+// segment between a and b.
+func segmentDistance(p, a, b geom.Point) float64 {
+	dx, dy := b.X-a.X, b.Y-a.Y
+	l2 := dx*dx + dy*dy
+	if l2 == 0 {
+		return math.Hypot(p.X-a.X, p.Y-a.Y)
+	}
+	t := math.Max(0, math.Min(1, ((p.X-a.X)*dx+(p.Y-a.Y)*dy)/l2))
+	return math.Hypot(p.X-a.X-t*dx, p.Y-a.Y-t*dy)
+}
+
+// pointLess returns whether a sorts before b, by x and then by y.
+func pointLess(a, b geom.Point) bool {
+	return a.X < b.X || (a.X == b.X && a.Y < b.Y)
+}
+
+// reversePath reverses p in place.
+func reversePath(p geom.Path) {
+	for i, j := 0, len(p)-1; i < j; i, j = i+1, j-1 {
+		p[i], p[j] = p[j], p[i]
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+func TestDensify(t *testing.T) {
+	c := &Cartogram{dx: 0.1, dy: 0.2, MaxSegment: 2}
+	ring := geom.Path{{X: 0, Y: 0}, {X: 1, Y: 0}, {X: 1, Y: 0.15}, {X: 0, Y: 2}}
+	d := c.densify(ring, true, nil)
+
+	if len(d.segs) != len(ring) {
+		t.Fatalf("segments: have %d, want %d", len(d.segs), len(ring))
+	}
+	for i, s := range d.segs {
+		if d.Path[s.start] != ring[i] {
+			t.Errorf("segment %d: starts at %v, want %v", i, d.Path[s.start], ring[i])
+		}
+	}
+	if d.segs[len(ring)-1].end != len(d.Path) {
+		t.Errorf("closing segment ends at %d, want %d", d.segs[len(ring)-1].end, len(d.Path))
+	}
+	prev := d.Path[len(d.Path)-1]
+	for i, p := range d.Path {
+		if l := math.Hypot((p.X-prev.X)/c.dx, (p.Y-prev.Y)/c.dy); l > c.MaxSegment*(1+1e-12) {
+			t.Errorf("segment ending at %d: length %g cells", i, l)
+		}
+		prev = p
+	}
+	// Segments of 10, 0.75 and 13.6 cells and a closing segment of
+	// 10 cells need 4, 0, 6 and 4 new vertices.
+	if want := len(ring) + 4 + 0 + 6 + 4; len(d.Path) != want {
+		t.Errorf("length: have %d, want %d", len(d.Path), want)
+	}
+
+	// Reversing the ring reverses the inserted vertices exactly.
+	rev := make(geom.Path, len(ring))
+	copy(rev, ring)
+	reversePath(rev)
+	dr := c.densify(append(rev[len(rev)-1:], rev[:len(rev)-1]...), true, nil)
+	reversePath(dr.Path)
+	back := append(dr.Path[len(dr.Path)-1:], dr.Path[:len(dr.Path)-1]...)
+	if !reflect.DeepEqual(back, d.Path) {
+		t.Errorf("reversed ring:\nhave %v\nwant %v", back, d.Path)
+	}
+}
+
+func TestTransformPolygonsDensify(t *testing.T) {
+	c := NewCartogram(testDensity(), 1, 30, 30)
+	defer c.Destroy()
+	in := testDensity()
+	polys := []geom.Polygon{in.Polygons[0].(geom.Polygon), in.Polygons[1].(geom.Polygon)}
+
+	plain := c.TransformPolygons(polys)
+	want := c.TransformPath(append(append(geom.Path(nil), polys[0][0]...), polys[1][0]...))
+	if have := append(append(geom.Path(nil), plain[0][0]...), plain[1][0]...); !reflect.DeepEqual(have, want) {
+		t.Errorf("without densification: have %v, want %v", have, want)
+	}
+
+	// run returns the vertices of r from a to b.
+	run := func(r geom.Path, a, b geom.Point) geom.Path {
+		for i := range r {
+			if r[i] != a {
+				continue
+			}
+			for j := i + 1; j < len(r); j++ {
+				if r[j] == b {
+					return r[i : j+1]
+				}
+			}
+		}
+		t.Fatalf("no run from %v to %v in %v", a, b, r)
+		return nil
+	}
+
+	c.MaxSegment = 0.5
+	dense := c.TransformPolygons(polys)
+	// a and b are the ends of the shared edge, which is
+	// segment 1 of polygon 1.
+	d := c.densify(polys[1][0], true, nil)
+	a, b := dense[1][0][d.segs[1].start], dense[1][0][d.segs[1].end]
+	// The shared edge is 6 cells long, so it is split into 12 pieces.
+	shared := run(dense[1][0], a, b)
+	if len(shared) != 13 {
+		t.Errorf("shared edge: have %d vertices, want 13", len(shared))
+	}
+	other := append(geom.Path(nil), run(dense[0][0], b, a)...)
+	reversePath(other)
+	if !reflect.DeepEqual(shared, other) {
+		t.Errorf("shared edge differs:\n%v\n%v", shared, other)
+	}
+
+	c.Simplify = 0.01
+	simple := c.TransformPolygons(polys)
+	for i, poly := range simple {
+		if len(poly[0]) >= len(dense[i][0]) {
+			t.Errorf("polygon %d: simplified to %d vertices from %d", i, len(poly[0]), len(dense[i][0]))
+		}
+		for _, s := range c.densify(polys[i][0], true, nil).segs {
+			p := dense[i][0][s.start]
+			var found bool
+			for _, q := range poly[0] {
+				found = found || p == q
+			}
+			if !found {
+				t.Errorf("polygon %d: original vertex %v removed", i, p)
+			}
+		}
+	}
+	shared = run(simple[1][0], a, b)
+	other = append(geom.Path(nil), run(simple[0][0], b, a)...)
+	reversePath(other)
+	if !reflect.DeepEqual(shared, other) {
+		t.Errorf("simplified shared edge differs:\n%v\n%v", shared, other)
+	}
+}
+
+func TestSharedVertices(t *testing.T) {
+	c := NewCartogram(testDensity(), 1, 30, 30)
+	defer c.Destroy()
+	c.MaxSegment = 0.5
+	f := testDensity()
+	want := f.Transform(c)
+	c.SharedVertices = true
+	have := f.Transform(c)
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("shared vertices:\nhave %v\nwant %v", have.Polygons, want.Polygons)
+	}
+
+}
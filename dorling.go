@@ -0,0 +1,138 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"math"
+
+	"github.com/ctessum/geom"
+)
+
+// Dorling is a Dorling cartogram, where each data item is represented
+// by a circle whose area is proportional to its weight, placed as near
+// as possible to the item's location without overlapping the
+// other circles.
+type Dorling struct {
+	// Circles holds the circle of each data item,
+	// in the order of the input.
+	Circles []Circle
+
+	// Stats describes how far the circles were moved.
+	Stats LayoutStats
+}
+
+// Circle is a circle in a Dorling cartogram.
+type Circle struct {
+	// Center and Radius are the location and size of the circle.
+	Center geom.Point
+	Radius float64
+
+	// Origin is the centroid of the data item that
+	// the circle represents.
+	Origin geom.Point
+
+	Group  string
+	Weight float64
+}
+
+// circleVertices is the number of vertices in the polygons
+// that represent circles.
+const circleVertices = 64
+
+// NewDorling creates a Dorling cartogram of data. The circles are
+// sized so that their total area is the given fraction of the total
+// area of data. They start at the centroids of the data items and
+// overlaps are resolved over at most the given number of iterations.
+// In each iteration, each pair of overlapping circles in turn is pushed
+// apart, with the larger circle moving less, and then, in the first
+// half of the iterations, all circles are pulled back towards their
+// origins. Crowded data need more iterations: the 4771 block groups of
+// Washington State need about 500 with fill 0.1 and 1000 with fill 0.5.
+//
+// Dorling, D. (1996). Area Cartograms: Their Use and Creation. Concepts
+// and Techniques in Modern Geography, 59. University of East Anglia.
+func NewDorling(data []Grouper, fill float64, iterations int) (*Dorling, error) {
+	origins, areas, err := layoutOrigins(data, fill, "Dorling")
+	if err != nil {
+		return nil, err
+	}
+	o := &Dorling{Circles: make([]Circle, len(data))}
+	for i, d := range data {
+		o.Circles[i] = Circle{
+			Center: origins[i],
+			Radius: math.Sqrt(areas[i] / math.Pi),
+			Origin: origins[i],
+			Group:  d.Group(),
+			Weight: d.Weight(),
+		}
+	}
+	center := func(i int) *geom.Point { return &o.Circles[i].Center }
+
+	for it := 0; it < iterations; it++ {
+		var overlapping bool
+		o.overlaps(func(i, j int, overlap, dx, dy, d float64) {
+			overlapping = true
+			ci, cj := &o.Circles[i], &o.Circles[j]
+			fi := layoutRelaxation * overlap * cj.Radius / (ci.Radius + cj.Radius)
+			fj := layoutRelaxation*overlap - fi
+			ci.Center.X -= fi * dx / d
+			ci.Center.Y -= fi * dy / d
+			cj.Center.X += fj * dx / d
+			cj.Center.Y += fj * dy / d
+		})
+		attraction := layoutAttraction * math.Max(0, 1-2*float64(it+1)/float64(iterations))
+		if attraction == 0 && !overlapping {
+			break
+		}
+		layoutAttract(len(o.Circles), center, origins, attraction)
+	}
+
+	o.Stats = layoutDisplacement(len(o.Circles), center,
+		func(i int) float64 { return o.Circles[i].Radius }, origins)
+	o.overlaps(func(i, j int, overlap, dx, dy, d float64) {
+		if overlap > 1e-9*(o.Circles[i].Radius+o.Circles[j].Radius) {
+			o.Stats.Overlaps++
+		}
+	})
+	return o, nil
+}
+
+// overlaps calls f for each pair of overlapping circles i < j, in
+// order, where overlap is the sum of their radii minus the distance d
+// between their centers, and dx and dy are the offsets of the center of
+// j from the center of i. Circles with the same center are separated
+// along the x axis. Candidate pairs are found using a grid of cells the
+// size of the largest circle, which is not updated if f moves the
+// circles, but the overlap is calculated when f is called.
+func (o *Dorling) overlaps(f func(i, j int, overlap, dx, dy, d float64)) {
+	var maxR float64
+	for _, c := range o.Circles {
+		maxR = math.Max(maxR, c.Radius)
+	}
+	center := func(i int) *geom.Point { return &o.Circles[i].Center }
+	gridPairs(len(o.Circles), center, 2*maxR, func(i, j int) {
+		ci, cj := &o.Circles[i], &o.Circles[j]
+		dx, dy := cj.Center.X-ci.Center.X, cj.Center.Y-ci.Center.Y
+		d := math.Hypot(dx, dy)
+		overlap := ci.Radius + cj.Radius - d
+		if overlap <= 0 {
+			return
+		}
+		if d == 0 {
+			dx, d = 1, 1
+		}
+		f(i, j, overlap, dx, dy, d)
+	})
+}
+
+// Geom returns a polygon approximating the receiver.
+func (c *Circle) Geom() geom.Polygon {
+	r := make(geom.Path, circleVertices)
+	for i := range r {
+		a := 2 * math.Pi * float64(i) / circleVertices
+		r[i] = geom.Point{X: c.Center.X + c.Radius*math.Cos(a), Y: c.Center.Y + c.Radius*math.Sin(a)}
+	}
+	return geom.Polygon{r}
+}
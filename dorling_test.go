@@ -0,0 +1,76 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+func TestNewDorling(t *testing.T) {
+	f := testDensity()
+	o, err := NewDorling(f.Groupers(), 2, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(o.Circles) != f.Len() {
+		t.Fatalf("have %d circles, want %d", len(o.Circles), f.Len())
+	}
+
+	// The five squares have a total area of 5 and weight of 14, so the
+	// circles have a total area of 10.
+	var area float64
+	for i, c := range o.Circles {
+		area += math.Pi * c.Radius * c.Radius
+		if want := 10 * f.Weights[i] / 14; math.Abs(math.Pi*c.Radius*c.Radius-want) > 1e-12 {
+			t.Errorf("circle %d area: have %g, want %g", i, math.Pi*c.Radius*c.Radius, want)
+		}
+		if c.Group != f.Groups[i] || c.Weight != f.Weights[i] {
+			t.Errorf("circle %d: have group %s weight %g", i, c.Group, c.Weight)
+		}
+	}
+	if math.Abs(area-10) > 1e-12 {
+		t.Errorf("total area: have %g, want 10", area)
+	}
+	if want := (geom.Point{X: 0.5, Y: 1.5}); o.Circles[1].Origin != want {
+		t.Errorf("origin: have %v, want %v", o.Circles[1].Origin, want)
+	}
+
+	// The large center circle overlaps its neighbors until
+	// they are pushed away.
+	for i, c := range o.Circles {
+		for _, c2 := range o.Circles[i+1:] {
+			if d := math.Hypot(c.Center.X-c2.Center.X, c.Center.Y-c2.Center.Y); d < c.Radius+c2.Radius-1e-9 {
+				t.Errorf("circles at %v and %v overlap", c.Center, c2.Center)
+			}
+		}
+	}
+	if o.Stats.Overlaps != 0 || o.Stats.MaxDisplacement == 0 ||
+		o.Stats.MeanDisplacement > o.Stats.MaxDisplacement {
+		t.Errorf("stats: %+v", o.Stats)
+	}
+
+	if o, err := NewDorling(f.Groupers(), 2, 0); err != nil || o.Stats.Overlaps != 4 || o.Stats.MaxDisplacement != 0 {
+		t.Errorf("no iterations: have %+v, %v", o.Stats, err)
+	}
+
+	tiles := o.Tiles()
+	if len(tiles) != len(o.Circles) || tiles[0].Group != "a" {
+		t.Fatalf("have %d tiles, want %d", len(tiles), len(o.Circles))
+	}
+	// The 64-sided polygon has 99.8% of the area of the circle.
+	if a, want := tiles[0].Geom.(geom.Polygon).Area(), 10.0*10/14; math.Abs(a-want) > 0.005*want {
+		t.Errorf("tile area: have %g, want about %g", a, want)
+	}
+
+	if _, err := NewDorling(nil, 0.5, 10); err == nil {
+		t.Error("no error for empty data")
+	}
+	if _, err := NewDorling(f.Groupers(), 0, 10); err == nil {
+		t.Error("no error for zero fill")
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/geojson"
+	"github.com/ctessum/geom/encoding/shp"
+)
+
+// Tile is a polygonal map feature with an associated group and weight.
+// It is the common output format for tilegrams and cartograms.
+type Tile struct {
+	Geom   geom.Polygonal
+	Group  string
+	Weight float64
+}
+
+// Tiles returns the hexagons in the receiver as Tiles.
+func (h *Hexagram) Tiles() []Tile {
+	o := make([]Tile, len(h.hexes))
+	for i, hh := range h.hexes {
+		o[i] = Tile{
+			Geom:   hh.Geom(),
+			Group:  hh.Group(),
+			Weight: hh.Weight(),
+		}
+	}
+	return o
+}
+
+// GroupTiles returns the combined geometry and weight of the hexagons
+// in each group, sorted by group name. See GroupGeom for the
+// meaning of tolerance.
+func (h *Hexagram) GroupTiles(tolerance float64) []Tile {
+	weights := make(map[string]float64)
+	for _, hh := range h.hexes {
+		weights[hh.Group()] += hh.Weight()
+	}
+	groups := h.GroupGeom(tolerance)
+	o := make([]Tile, 0, len(groups))
+	for g, p := range groups {
+		o = append(o, Tile{Geom: p, Group: g, Weight: weights[g]})
+	}
+	sort.Slice(o, func(i, j int) bool { return o[i].Group < o[j].Group })
+	return o
+}
+
+// Tiles returns the circles in the receiver as Tiles.
+func (o *Dorling) Tiles() []Tile {
+	t := make([]Tile, len(o.Circles))
+	for i := range o.Circles {
+		c := &o.Circles[i]
+		t[i] = Tile{Geom: c.Geom(), Group: c.Group, Weight: c.Weight}
+	}
+	return t
+}
+
+// Tiles returns the squares in the receiver as Tiles.
+func (o *Demers) Tiles() []Tile {
+	t := make([]Tile, len(o.Squares))
+	for i := range o.Squares {
+		s := &o.Squares[i]
+		t[i] = Tile{Geom: s.Geom(), Group: s.Group, Weight: s.Weight}
+	}
+	return t
+}
+
+// Tiles returns the features in the receiver as Tiles.
+func (f *Features) Tiles() []Tile {
+	o := make([]Tile, f.Len())
+	for i, p := range f.Polygons {
+		o[i] = Tile{
+			Geom:   p,
+			Group:  f.Groups[i],
+			Weight: f.Weights[i],
+		}
+	}
+	return o
+}
+
+// WriteGeoJSON writes tiles to w as a GeoJSON FeatureCollection,
+// where the group and weight of each tile are stored in the
+// "group" and "weight" properties.
+func WriteGeoJSON(w io.Writer, tiles []Tile) error {
+	geoms := make([]geom.Geom, len(tiles))
+	props := make([]map[string]interface{}, len(tiles))
+	for i, t := range tiles {
+		geoms[i] = closeRings(t.Geom)
+		props[i] = map[string]interface{}{
+			"group":  t.Group,
+			"weight": t.Weight,
+		}
+	}
+	return EncodeGeoJSON(w, geoms, props)
+}
+
+// EncodeGeoJSON writes geometries of any type to w as a GeoJSON
+// FeatureCollection, with the corresponding element of props as
+// the properties of each feature. It is the inverse of DecodeGeoJSON.
+func EncodeGeoJSON(w io.Writer, geoms []geom.Geom, props []map[string]interface{}) error {
+	if len(props) != len(geoms) {
+		return errors.New("tilegram: numbers of geometries and properties differ")
+	}
+	fc := geoJSONFeatureCollection{
+		Type:     "FeatureCollection",
+		Features: make([]*geoJSONFeature, len(geoms)),
+	}
+	for i, g := range geoms {
+		gj, err := geojson.Encode(g)
+		if err != nil {
+			return err
+		}
+		fc.Features[i] = &geoJSONFeature{
+			Type:       "Feature",
+			Geometry:   gj,
+			Properties: props[i],
+		}
+	}
+	return json.NewEncoder(w).Encode(fc)
+}
+
+// tileRecord is the shapefile representation of a Tile.
+type tileRecord struct {
+	geom.Polygon
+	Group  string
+	Weight float64
+}
+
+// WriteShapefile writes tiles to a shapefile with the given name,
+// where the group and weight of each tile are stored in the
+// "Group" and "Weight" fields.
+func WriteShapefile(filename string, tiles []Tile) error {
+	e, err := shp.NewEncoder(filename, tileRecord{})
+	if err != nil {
+		return err
+	}
+	defer e.Close()
+	for _, t := range tiles {
+		var p geom.Polygon
+		for _, pp := range t.Geom.Polygons() {
+			p = append(p, pp...)
+		}
+		if err := e.Encode(tileRecord{Polygon: p, Group: t.Group, Weight: t.Weight}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeRings returns a copy of p where the first point of each ring
+// is repeated at the end of the ring, as required by GeoJSON.
+func closeRings(p geom.Polygonal) geom.Geom {
+	closePoly := func(p geom.Polygon) geom.Polygon {
+		o := make(geom.Polygon, len(p))
+		for i, r := range p {
+			o[i] = r
+			if len(r) > 0 && r[0] != r[len(r)-1] {
+				o[i] = append(append(geom.Path(nil), r...), r[0])
+			}
+		}
+		return o
+	}
+	if pp, ok := p.(geom.Polygon); ok {
+		return closePoly(pp)
+	}
+	polys := p.Polygons()
+	o := make(geom.MultiPolygon, len(polys))
+	for i, pp := range polys {
+		o[i] = closePoly(pp)
+	}
+	return o
+}
+
+// svgColors are the fill colors used for tile groups in SVG output.
+var svgColors = []string{
+	"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd",
+	"#8c564b", "#e377c2", "#7f7f7f", "#bcbd22", "#17becf",
+}
+
+// WriteSVG writes tiles to w as an SVG image with the given width in
+// pixels, where the height is chosen to preserve the aspect ratio of the
+// tiles. Each tile is filled with a color chosen by its group and
+// is labeled with its group and weight.
+func WriteSVG(w io.Writer, tiles []Tile, width float64) error {
+	b := geom.NewBounds()
+	groups := make(map[string]int)
+	var groupNames []string
+	for _, t := range tiles {
+		b.Extend(t.Geom.Bounds())
+		if _, ok := groups[t.Group]; !ok {
+			groups[t.Group] = 0
+			groupNames = append(groupNames, t.Group)
+		}
+	}
+	sort.Strings(groupNames)
+	for i, g := range groupNames {
+		groups[g] = i
+	}
+	var scale, height float64
+	if len(tiles) > 0 && b.Max.X > b.Min.X {
+		scale = width / (b.Max.X - b.Min.X)
+		height = (b.Max.Y - b.Min.Y) * scale
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, `<svg xmlns="http://www.w3.org/2000/svg" width="%g" height="%g" viewBox="0 0 %g %g">`+"\n",
+		width, height, width, height)
+	for _, t := range tiles {
+		bw.WriteString(`<path fill-rule="evenodd" stroke="#ffffff" stroke-width="0.5" d="`)
+		for _, p := range t.Geom.Polygons() {
+			for _, r := range p {
+				for i, pt := range r {
+					cmd := "L"
+					if i == 0 {
+						cmd = "M"
+					}
+					fmt.Fprintf(bw, "%s%.2f %.2f", cmd, (pt.X-b.Min.X)*scale, (b.Max.Y-pt.Y)*scale)
+				}
+				bw.WriteString("Z")
+			}
+		}
+		fmt.Fprintf(bw, `" fill="%s"><title>`, svgColors[groups[t.Group]%len(svgColors)])
+		xml.EscapeText(bw, []byte(fmt.Sprintf("%s: %g", t.Group, t.Weight)))
+		bw.WriteString("</title></path>\n")
+	}
+	bw.WriteString("</svg>\n")
+	return bw.Flush()
+}
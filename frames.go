@@ -0,0 +1,153 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+// #include <cart.h>
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"unsafe"
+
+	"github.com/ctessum/geom"
+)
+
+// TransformFrames returns copies of g transformed partway to match the
+// cartogram, one for each of the given fractions of the diffusion time,
+// for animating the transition from the original map to the cartogram.
+// The intermediate geometries are the states that the diffusion passes
+// through, so, like the final cartogram and unlike geometries created by
+// interpolating between the original and transformed vertices, they
+// do not fold over themselves.
+//
+// Time is measured on a logarithmic scale, from the start of the
+// diffusion to when the vertices stop moving, because the integration
+// time-steps grow geometrically, so frames at evenly spaced fractions
+// show roughly even progress. A fraction of zero gives the original
+// geometry and one gives the same geometry as TransformGeoms, except
+// that the receiver's RepairPasses field is not applied. Its MaxSegment,
+// Simplify and SharedVertices fields are applied to every frame.
+// Stopping the integration at each frame changes the later time-steps
+// slightly, so each frame depends very slightly on the other fractions.
+//
+// The vertices are integrated twice, once to find the time scale and
+// once to record the frames, so TransformFrames takes about twice as
+// long as TransformGeoms. The integration needs the C workspace, which
+// only a cartogram created by NewCartogram or a similar function holds
+// until it is destroyed, so TransformFrames panics if the receiver has
+// been destroyed or was read by DecodeCartogram.
+func (c *Cartogram) TransformFrames(g []geom.Geom, fractions []float64) [][]geom.Geom {
+	return transformGeomFrames(g, func(paths []geom.Path, polygon []int) [][]geom.Path {
+		return c.transformPathFrames(paths, polygon, fractions)
+	})
+}
+
+// transformPathFrames is like transformPaths, but returns the paths
+// transformed at each of the given fractions of the diffusion time,
+// without repairing topology errors.
+func (c *Cartogram) transformPathFrames(paths []geom.Path, polygon []int, fractions []float64) [][]geom.Path {
+	closed := func(i int) bool { return polygon != nil && polygon[i] >= 0 }
+	if c.SharedVertices {
+		paths = c.snap(paths, closed)
+	}
+	dense := make([]densePath, len(paths))
+	for i, p := range paths {
+		dense[i] = c.densify(p, closed(i), nil)
+	}
+	o := c.transformDense(dense, closed, func(p geom.Path) []geom.Path {
+		return c.transformVertexFrames(p, fractions)
+	})
+	if c.Simplify > 0 {
+		for _, frame := range o {
+			for i, d := range dense {
+				frame[i] = simplifySegments(frame[i], d.segs, c.Simplify)
+			}
+		}
+	}
+	return o
+}
+
+// transformVertexFrames is like transformVertices, but returns the
+// vertices transformed at each of the given fractions of
+// the diffusion time.
+func (c *Cartogram) transformVertexFrames(p geom.Path, fractions []float64) []geom.Path {
+	x, y := c.pathToGrid(p)
+	fx, fy := c.transformGridFrames(x, y, fractions)
+	o := make([]geom.Path, len(fractions))
+	for f := range o {
+		o[f] = c.pathFromGrid(fx[f], fy[f])
+	}
+	return o
+}
+
+// transformGridFrames returns the points in grid units transformed
+// at each of the given fractions of the diffusion time. It requires
+// the C workspace.
+func (c *Cartogram) transformGridFrames(x, y, fractions []float64) (fx, fy [][]float64) {
+	if !c.live {
+		panic("tilegram: transforming frames needs the C workspace, which a destroyed or decoded cartogram doesn't have")
+	}
+	n := len(x)
+	fx, fy = make([][]float64, len(fractions)), make([][]float64, len(fractions))
+	bx, by := make([]float64, n*len(fractions)), make([]float64, n*len(fractions))
+	for f := range fractions {
+		fx[f], fy[f] = bx[f*n:(f+1)*n:(f+1)*n], by[f*n:(f+1)*n:(f+1)*n]
+	}
+	if n == 0 || len(fractions) == 0 {
+		return fx, fy
+	}
+	threads := c.Threads
+	if threads <= 0 {
+		threads = runtime.GOMAXPROCS(0)
+	}
+	C.cart_makecartframes((*C.double)(unsafe.Pointer(&x[0])), (*C.double)(unsafe.Pointer(&y[0])), C.int(n),
+		C.int(c.cols), C.int(c.rows), C.double(c.Blur), C.int(threads),
+		(*C.double)(unsafe.Pointer(&fractions[0])), C.int(len(fractions)),
+		(*C.double)(unsafe.Pointer(&bx[0])), (*C.double)(unsafe.Pointer(&by[0])))
+	return fx, fy
+}
+
+// WriteFrames writes n frames of an animation of the transition from
+// features f to cartogram c, at evenly spaced fractions of the
+// diffusion time as for TransformFrames, so that the first frame is the
+// original map and the last is the cartogram. Each frame is written as
+// GeoJSON, as for WriteGeoJSON, to the file named by formatting pattern,
+// such as "frame%03d.geojson", with the frame number, starting from
+// zero. n must be at least two, and c must not have been destroyed or
+// read by DecodeCartogram, as for TransformFrames.
+func WriteFrames(pattern string, c *Cartogram, f *Features, n int) error {
+	if n < 2 {
+		return errors.New("tilegram: at least two frames are needed")
+	}
+	g := make([]geom.Geom, f.Len())
+	for i, p := range f.Polygons {
+		g[i] = p
+	}
+	fractions := make([]float64, n)
+	for k := range fractions {
+		fractions[k] = float64(k) / float64(n-1)
+	}
+	for k, frame := range c.TransformFrames(g, fractions) {
+		tiles := f.Tiles()
+		for i := range tiles {
+			tiles[i].Geom = frame[i].(geom.Polygonal)
+		}
+		w, err := os.Create(fmt.Sprintf(pattern, k))
+		if err != nil {
+			return err
+		}
+		if err := WriteGeoJSON(w, tiles); err != nil {
+			w.Close()
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+func TestTransformFrames(t *testing.T) {
+	f := testDensity()
+	c := NewCartogram(f, 1, 30, 30)
+	defer c.Destroy()
+
+	g := make([]geom.Geom, f.Len())
+	for i, p := range f.Polygons {
+		g[i] = p
+	}
+	frames := c.TransformFrames(g, []float64{0, 0.25, 0.5, 0.75, 1})
+	if len(frames) != 5 {
+		t.Fatalf("have %d frames, want 5", len(frames))
+	}
+
+	// The first frame is the original geometry, apart from rounding.
+	for i, p := range frames[0] {
+		for k, pt := range p.(geom.Polygon)[0] {
+			want := f.Polygons[i].(geom.Polygon)[0][k]
+			if math.Abs(pt.X-want.X) > 1e-12 || math.Abs(pt.Y-want.Y) > 1e-12 {
+				t.Errorf("frame 0 polygon %d vertex %d: have %v, want %v", i, k, pt, want)
+			}
+		}
+	}
+	if have, want := frames[4], c.TransformGeoms(g); !reflect.DeepEqual(have, want) {
+		t.Errorf("last frame:\nhave %v\nwant %v", have, want)
+	}
+
+	// The dense center square grows steadily.
+	prev := 1.0
+	for k, frame := range frames[1:] {
+		a := frame[0].(geom.Polygon).Area()
+		if a <= prev {
+			t.Errorf("frame %d: center area %g is not more than %g", k+1, a, prev)
+		}
+		prev = a
+	}
+
+	// The frames do not depend on the order of the fractions, but
+	// stopping at each frame changes the later time-steps slightly,
+	// so they do depend on the other fractions.
+	want := c.TransformFrames(g, []float64{0.25, 0.75})
+	if have := c.TransformFrames(g, []float64{0.75, 0.25}); !reflect.DeepEqual(have, [][]geom.Geom{want[1], want[0]}) {
+		t.Errorf("reordered frames:\nhave %v\nwant %v", have, [][]geom.Geom{want[1], want[0]})
+	}
+
+	dir := t.TempDir()
+	if err := WriteFrames(filepath.Join(dir, "frame%d.geojson"), c, f, 3); err != nil {
+		t.Fatal(err)
+	}
+	for k := 0; k < 3; k++ {
+		b, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("frame%d.geojson", k)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), `"FeatureCollection"`) {
+			t.Errorf("frame %d: %s", k, b)
+		}
+	}
+	if err := WriteFrames(filepath.Join(dir, "frame%d.geojson"), c, f, 1); err == nil {
+		t.Error("no error for one frame")
+	}
+
+	// A decoded cartogram has no C workspace to integrate frames with.
+	var buf bytes.Buffer
+	if err := c.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeCartogram(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "decoded") {
+			t.Errorf("decoded cartogram: have panic %v", r)
+		}
+	}()
+	decoded.TransformFrames(g, []float64{0.5})
+}
@@ -0,0 +1,399 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ctessum/geom"
+	"gonum.org/v1/gonum/mat"
+)
+
+// TIFF tags used by ReadGeoTIFF.
+const (
+	tiffImageWidth       = 256
+	tiffImageLength      = 257
+	tiffBitsPerSample    = 258
+	tiffCompression      = 259
+	tiffStripOffsets     = 273
+	tiffSamplesPerPixel  = 277
+	tiffRowsPerStrip     = 278
+	tiffStripByteCounts  = 279
+	tiffPredictor        = 317
+	tiffTileWidth        = 322
+	tiffTileLength       = 323
+	tiffTileOffsets      = 324
+	tiffTileByteCounts   = 325
+	tiffSampleFormat     = 339
+	geoModelPixelScale   = 33550
+	geoModelTiepoint     = 33922
+	geoModelTransform    = 34264
+	geoKeyDirectory      = 34735
+	gdalNoData           = 42113
+	tiffCompressionNone  = 1
+	tiffCompressionFlate = 8
+	tiffCompressionZlib  = 32946 // Obsolete code for Deflate.
+)
+
+// GeoTIFF keys used by ReadGeoTIFF, from the GeoKeyDirectory field.
+const (
+	gtRasterTypeGeoKey = 1025
+	rasterPixelIsArea  = 1
+	rasterPixelIsPoint = 2
+)
+
+// maxTIFFBytes is the size assumed for a GeoTIFF whose reader does
+// not report its size, and maxTIFFCells is the largest number of cells
+// that ReadGeoTIFF reads, which keeps corrupt or malicious files from
+// exhausting memory.
+const (
+	maxTIFFBytes = 1 << 32
+	maxTIFFCells = 1 << 28
+)
+
+// tiffTypeSizes holds the size in bytes of each TIFF field type.
+var tiffTypeSizes = map[uint16]int{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+// ReadGeoTIFF reads a single-band GeoTIFF raster, returning the
+// raster values and their georeferenced bounds in the form expected by
+// NewRasterCartogram: row 0 of the returned matrix is the bottom row
+// of the raster. Cells equal to the GDAL no-data value are set to NaN.
+//
+// Rasters may be stored in strips or tiles, either uncompressed or
+// compressed with Deflate, with unsigned integer, signed integer or
+// floating point samples. Only the first image in the file is read,
+// and it must not be rotated. The georeferencing of rasters whose
+// GTRasterTypeGeoKey is PixelIsPoint locates the centers of pixels,
+// so their bounds are extended by half a pixel. Rasters of more than 2²⁸ cells, and
+// fields or strips that extend past the end of the file, are rejected.
+// The size of the file is found from r if it has a Size or Stat
+// method, as *bytes.Reader, *io.SectionReader and *os.File do.
+func ReadGeoTIFF(r io.ReaderAt) (*mat.Dense, *geom.Bounds, error) {
+	t, err := readTIFFDir(r, readerSize(r))
+	if err != nil {
+		return nil, nil, err
+	}
+	w, h := t.num(tiffImageWidth, 0), t.num(tiffImageLength, 0)
+	if !(w >= 1 && h >= 1) {
+		return nil, nil, errors.New("tilegram: GeoTIFF has no image dimensions")
+	}
+	if w*h > maxTIFFCells {
+		return nil, nil, fmt.Errorf("tilegram: GeoTIFF has %g×%g cells, more than the maximum of %d", w, h, maxTIFFCells)
+	}
+	width, height := int(w), int(h)
+	if n := t.num(tiffSamplesPerPixel, 1); n != 1 {
+		return nil, nil, fmt.Errorf("tilegram: GeoTIFF has %g bands; only single-band rasters are supported", n)
+	}
+	bits := int(t.num(tiffBitsPerSample, 1))
+	format := int(t.num(tiffSampleFormat, 1))
+	sample, err := tiffSampleReader(t.bo, bits, format)
+	if err != nil {
+		return nil, nil, err
+	}
+	compression := int(t.num(tiffCompression, tiffCompressionNone))
+	if compression != tiffCompressionNone && compression != tiffCompressionFlate && compression != tiffCompressionZlib {
+		return nil, nil, fmt.Errorf("tilegram: unsupported GeoTIFF compression %d", compression)
+	}
+	predictor := int(t.num(tiffPredictor, 1))
+	if predictor != 1 && (predictor != 2 || format == 3) {
+		return nil, nil, fmt.Errorf("tilegram: unsupported GeoTIFF predictor %d", predictor)
+	}
+	b, err := t.bounds(width, height)
+	if err != nil {
+		return nil, nil, err
+	}
+	noData := math.NaN()
+	if s, ok := t.ascii[gdalNoData]; ok {
+		if noData, err = strconv.ParseFloat(strings.TrimSpace(s), 64); err != nil {
+			return nil, nil, fmt.Errorf("tilegram: invalid GeoTIFF no-data value %q", s)
+		}
+	}
+
+	// Strips are treated as tiles that span the width of the image.
+	cw, ch := w, math.Min(t.num(tiffRowsPerStrip, h), h)
+	offsets, counts := t.nums[tiffStripOffsets], t.nums[tiffStripByteCounts]
+	if _, ok := t.nums[tiffTileOffsets]; ok {
+		cw, ch = t.num(tiffTileWidth, 0), t.num(tiffTileLength, 0)
+		offsets, counts = t.nums[tiffTileOffsets], t.nums[tiffTileByteCounts]
+	}
+	if !(cw >= 1 && ch >= 1) || cw*ch > maxTIFFCells {
+		return nil, nil, errors.New("tilegram: GeoTIFF has invalid strip or tile size")
+	}
+	chunkW, chunkH := int(cw), int(ch)
+	across := (width + chunkW - 1) / chunkW
+	down := (height + chunkH - 1) / chunkH
+	if len(offsets) != across*down || len(counts) != len(offsets) {
+		return nil, nil, errors.New("tilegram: GeoTIFF has the wrong number of strips or tiles")
+	}
+
+	sampleBytes := bits / 8
+	m := mat.NewDense(height, width, nil)
+	for k, off := range offsets {
+		buf, err := t.read(r, off, counts[k])
+		if err != nil {
+			return nil, nil, err
+		}
+		if compression != tiffCompressionNone {
+			zr, err := zlib.NewReader(bytes.NewReader(buf))
+			if err != nil {
+				return nil, nil, fmt.Errorf("tilegram: reading GeoTIFF: %v", err)
+			}
+			// Only the bytes of the chunk's samples are needed.
+			if buf, err = io.ReadAll(io.LimitReader(zr, int64(chunkW*chunkH*sampleBytes))); err != nil {
+				return nil, nil, fmt.Errorf("tilegram: reading GeoTIFF: %v", err)
+			}
+		}
+		x0, y0 := (k%across)*chunkW, (k/across)*chunkH
+		for y := 0; y < chunkH && y0+y < height; y++ {
+			if len(buf) < (y+1)*chunkW*sampleBytes {
+				return nil, nil, errors.New("tilegram: GeoTIFF strip or tile is too short")
+			}
+			row := buf[y*chunkW*sampleBytes : (y+1)*chunkW*sampleBytes]
+			if predictor == 2 {
+				undoHorizontalDifferencing(row, t.bo, sampleBytes)
+			}
+			for x := 0; x < chunkW && x0+x < width; x++ {
+				v := sample(row[x*sampleBytes:])
+				if v == noData {
+					v = math.NaN()
+				}
+				m.Set(height-1-(y0+y), x0+x, v)
+			}
+		}
+	}
+	return m, b, nil
+}
+
+// tiffDir holds the fields of a TIFF image file directory.
+type tiffDir struct {
+	bo    binary.ByteOrder
+	nums  map[uint16][]float64
+	ascii map[uint16]string
+
+	// size is the size of the file in bytes.
+	size int64
+}
+
+// readerSize returns the size of r if it reports one,
+// or maxTIFFBytes otherwise.
+func readerSize(r io.ReaderAt) int64 {
+	switch r := r.(type) {
+	case interface{ Size() int64 }:
+		return r.Size()
+	case interface{ Stat() (os.FileInfo, error) }:
+		if fi, err := r.Stat(); err == nil && fi.Mode().IsRegular() {
+			return fi.Size()
+		}
+	}
+	return maxTIFFBytes
+}
+
+// read returns n bytes read from r at offset off, or an error if
+// they do not lie within the file.
+func (t *tiffDir) read(r io.ReaderAt, off, n float64) ([]byte, error) {
+	if !(off >= 0 && n >= 0 && off+n <= float64(t.size)) {
+		return nil, errors.New("tilegram: GeoTIFF data extends past the end of the file")
+	}
+	buf := make([]byte, int(n))
+	if _, err := r.ReadAt(buf, int64(off)); err != nil {
+		return nil, fmt.Errorf("tilegram: reading GeoTIFF: %v", err)
+	}
+	return buf, nil
+}
+
+// num returns the first value of numeric field tag,
+// or def if the field is not present.
+func (t *tiffDir) num(tag uint16, def float64) float64 {
+	if v, ok := t.nums[tag]; ok && len(v) > 0 {
+		return v[0]
+	}
+	return def
+}
+
+// geoKey returns the value of GeoTIFF key, which must be a single
+// SHORT stored in the GeoKeyDirectory field itself, or def if the key
+// is not present.
+func (t *tiffDir) geoKey(key uint16, def float64) float64 {
+	dir := t.nums[geoKeyDirectory]
+	if len(dir) < 4 {
+		return def
+	}
+	// The directory starts with its version and the number of keys.
+	keys := dir[4:]
+	if n := 4 * int(dir[3]); n >= 0 && n < len(keys) {
+		keys = keys[:n]
+	}
+	for k := keys; len(k) >= 4; k = k[4:] {
+		// Each key is its ID, the tag of the field holding its value
+		// or zero if the value follows, its count and its value.
+		if k[0] == float64(key) && k[1] == 0 && k[2] == 1 {
+			return k[3]
+		}
+	}
+	return def
+}
+
+// bounds returns the bounds of an image with the given dimensions
+// from the GeoTIFF georeferencing fields.
+func (t *tiffDir) bounds(width, height int) (*geom.Bounds, error) {
+	var sx, sy, x0, y0 float64
+	scale, tie, transform := t.nums[geoModelPixelScale], t.nums[geoModelTiepoint], t.nums[geoModelTransform]
+	switch {
+	case len(scale) >= 2 && len(tie) >= 6:
+		sx, sy = scale[0], scale[1]
+		x0, y0 = tie[3]-tie[0]*sx, tie[4]+tie[1]*sy
+	case len(transform) == 16:
+		if transform[1] != 0 || transform[4] != 0 {
+			return nil, errors.New("tilegram: rotated GeoTIFF rasters are not supported")
+		}
+		sx, sy = transform[0], -transform[5]
+		x0, y0 = transform[3], transform[7]
+	default:
+		return nil, errors.New("tilegram: GeoTIFF is not georeferenced")
+	}
+	switch rt := t.geoKey(gtRasterTypeGeoKey, rasterPixelIsArea); rt {
+	case rasterPixelIsArea:
+	case rasterPixelIsPoint:
+		x0, y0 = x0-sx/2, y0+sy/2
+	default:
+		return nil, fmt.Errorf("tilegram: unsupported GeoTIFF raster type %g", rt)
+	}
+	return &geom.Bounds{
+		Min: geom.Point{X: x0, Y: y0 - float64(height)*sy},
+		Max: geom.Point{X: x0 + float64(width)*sx, Y: y0},
+	}, nil
+}
+
+// readTIFFDir reads the first image file directory
+// of a TIFF file of the given size.
+func readTIFFDir(r io.ReaderAt, size int64) (*tiffDir, error) {
+	var head [8]byte
+	if _, err := r.ReadAt(head[:], 0); err != nil {
+		return nil, fmt.Errorf("tilegram: reading GeoTIFF: %v", err)
+	}
+	t := &tiffDir{nums: make(map[uint16][]float64), ascii: make(map[uint16]string), size: size}
+	switch string(head[:2]) {
+	case "II":
+		t.bo = binary.LittleEndian
+	case "MM":
+		t.bo = binary.BigEndian
+	default:
+		return nil, errors.New("tilegram: not a TIFF file")
+	}
+	switch t.bo.Uint16(head[2:]) {
+	case 42:
+	case 43:
+		return nil, errors.New("tilegram: BigTIFF files are not supported")
+	default:
+		return nil, errors.New("tilegram: not a TIFF file")
+	}
+	off := int64(t.bo.Uint32(head[4:]))
+	var n [2]byte
+	if _, err := r.ReadAt(n[:], off); err != nil {
+		return nil, fmt.Errorf("tilegram: reading GeoTIFF: %v", err)
+	}
+	entries := make([]byte, 12*int(t.bo.Uint16(n[:])))
+	if _, err := r.ReadAt(entries, off+2); err != nil {
+		return nil, fmt.Errorf("tilegram: reading GeoTIFF: %v", err)
+	}
+	for len(entries) > 0 {
+		e := entries[:12]
+		entries = entries[12:]
+		tag, typ, count := t.bo.Uint16(e), t.bo.Uint16(e[2:]), int64(t.bo.Uint32(e[4:]))
+		size, ok := tiffTypeSizes[typ]
+		if !ok {
+			continue
+		}
+		data := e[8:12]
+		if int64(size)*count > 4 {
+			var err error
+			if data, err = t.read(r, float64(t.bo.Uint32(e[8:])), float64(int64(size)*count)); err != nil {
+				return nil, err
+			}
+		}
+		if typ == 2 {
+			t.ascii[tag] = strings.TrimRight(string(data[:count]), "\x00")
+			continue
+		}
+		v := make([]float64, count)
+		for i := range v {
+			d := data[i*size:]
+			switch typ {
+			case 1, 7:
+				v[i] = float64(d[0])
+			case 6:
+				v[i] = float64(int8(d[0]))
+			case 3:
+				v[i] = float64(t.bo.Uint16(d))
+			case 8:
+				v[i] = float64(int16(t.bo.Uint16(d)))
+			case 4:
+				v[i] = float64(t.bo.Uint32(d))
+			case 9:
+				v[i] = float64(int32(t.bo.Uint32(d)))
+			case 5:
+				v[i] = float64(t.bo.Uint32(d)) / float64(t.bo.Uint32(d[4:]))
+			case 10:
+				v[i] = float64(int32(t.bo.Uint32(d))) / float64(int32(t.bo.Uint32(d[4:])))
+			case 11:
+				v[i] = float64(math.Float32frombits(t.bo.Uint32(d)))
+			case 12:
+				v[i] = math.Float64frombits(t.bo.Uint64(d))
+			}
+		}
+		t.nums[tag] = v
+	}
+	return t, nil
+}
+
+// tiffSampleReader returns a function that reads a sample
+// with the given number of bits and TIFF sample format.
+func tiffSampleReader(bo binary.ByteOrder, bits, format int) (func([]byte) float64, error) {
+	switch {
+	case format == 1 && bits == 8:
+		return func(b []byte) float64 { return float64(b[0]) }, nil
+	case format == 1 && bits == 16:
+		return func(b []byte) float64 { return float64(bo.Uint16(b)) }, nil
+	case format == 1 && bits == 32:
+		return func(b []byte) float64 { return float64(bo.Uint32(b)) }, nil
+	case format == 2 && bits == 8:
+		return func(b []byte) float64 { return float64(int8(b[0])) }, nil
+	case format == 2 && bits == 16:
+		return func(b []byte) float64 { return float64(int16(bo.Uint16(b))) }, nil
+	case format == 2 && bits == 32:
+		return func(b []byte) float64 { return float64(int32(bo.Uint32(b))) }, nil
+	case format == 3 && bits == 32:
+		return func(b []byte) float64 { return float64(math.Float32frombits(bo.Uint32(b))) }, nil
+	case format == 3 && bits == 64:
+		return func(b []byte) float64 { return math.Float64frombits(bo.Uint64(b)) }, nil
+	}
+	return nil, fmt.Errorf("tilegram: unsupported GeoTIFF sample format %d with %d bits", format, bits)
+}
+
+// undoHorizontalDifferencing reverses TIFF predictor 2 on a row of
+// integer samples with the given size in bytes.
+func undoHorizontalDifferencing(row []byte, bo binary.ByteOrder, size int) {
+	for i := size; i+size <= len(row); i += size {
+		switch size {
+		case 1:
+			row[i] += row[i-1]
+		case 2:
+			bo.PutUint16(row[i:], bo.Uint16(row[i:])+bo.Uint16(row[i-2:]))
+		case 4:
+			bo.PutUint32(row[i:], bo.Uint32(row[i:])+bo.Uint32(row[i-4:]))
+		}
+	}
+}
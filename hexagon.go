@@ -20,6 +20,10 @@ type Hexagram struct {
 	// r is the radius of each hexagon.
 	r float64
 
+	// origin is the center of a hexagon in the primary hexagon
+	// lattice. The secondary lattice is offset by (-1.5r, -r).
+	origin geom.Point
+
 	b *geom.Bounds
 }
 
@@ -31,6 +35,11 @@ type Hex struct {
 	// Data holds the data points that are assigned to this Hex.
 	Data []Grouper
 
+	// Assigned, if not empty, is the group of this Hex, overriding
+	// the group calculated from Data. It is used when tiles
+	// are assigned to groups by hand.
+	Assigned string
+
 	// i is the index of this Hex in its containing Hexagram
 	i int
 
@@ -49,9 +58,13 @@ func (h *Hex) Weight() float64 {
 }
 
 // Group returns the group which has the most weight among
-// the data items in the receiver. If the receiver does not
-// have any data items, the group will be "".
+// the data items in the receiver, unless the receiver has
+// been assigned to a different group. If the receiver does not
+// have any data items or an assigned group, the group will be "".
 func (h *Hex) Group() string {
+	if h.Assigned != "" {
+		return h.Assigned
+	}
 	groupWeights := make(map[string]float64)
 	for _, d := range h.Data {
 		groupWeights[d.Group()] += d.Weight()
@@ -97,25 +110,68 @@ func (h *Hex) Geom() geom.Polygon {
 
 // NewHexagram creates a new hexagonal tile map, where bounds is the
 // geometric boundary for the tiles, and r is the radius of each
-// hexagonal tile.
+// hexagonal tile. Areas are planar, so data in longitudes and latitudes
+// should first be projected; see Features.EqualArea.
 func NewHexagram(data []Grouper, r float64) (*Hexagram, error) {
-	o := Hexagram{
-		index: rtree.NewTree(25, 50),
-		r:     r,
-		b:     geom.NewBounds(),
+	dataIndex, bbox := indexData(data)
+	return newHexagram(data, bbox.Min, hexCenters(dataIndex, bbox, r), r)
+}
+
+// NewHexagramCount creates a new hexagonal tile map with approximately
+// n tiles. The hexagon radius is chosen by searching for the
+// radius that results in the number of tiles closest to n.
+func NewHexagramCount(data []Grouper, n int) (*Hexagram, error) {
+	if n <= 0 {
+		return nil, errors.New("tilegram: number of hexagons must be positive")
+	}
+	dataIndex, bbox := indexData(data)
+	var area float64
+	for _, d := range data {
+		area += d.Area()
+	}
+	// The area of a hexagon is 3√3/2 r².
+	r := math.Sqrt(area / (float64(n) * 1.5 * math.Sqrt(3)))
+	var bestCenters []geom.Point
+	var bestR float64
+	for iter := 0; iter < 20; iter++ {
+		centers := hexCenters(dataIndex, bbox, r)
+		if bestCenters == nil || absInt(len(centers)-n) < absInt(len(bestCenters)-n) {
+			bestCenters, bestR = centers, r
+		}
+		if len(centers) == n || len(centers) == 0 {
+			break
+		}
+		// The number of hexagons is roughly proportional to 1/r².
+		r *= math.Sqrt(float64(len(centers)) / float64(n))
+	}
+	return newHexagram(data, bbox.Min, bestCenters, bestR)
+}
+
+func absInt(i int) int {
+	if i < 0 {
+		return -i
 	}
+	return i
+}
 
+// indexData creates a spatial index of data and returns it along
+// with the combined bounds of data.
+func indexData(data []Grouper) (*rtree.Rtree, *geom.Bounds) {
 	dataIndex := rtree.NewTree(25, 50)
 	bbox := geom.NewBounds()
 	for _, d := range data {
 		bbox.Extend(d.Bounds())
 		dataIndex.Insert(d)
 	}
+	return dataIndex, bbox
+}
 
+// hexCenters returns the centers of the hexagons of radius r
+// that cover the data in dataIndex, which has bounds bbox.
+func hexCenters(dataIndex *rtree.Rtree, bbox *geom.Bounds, r float64) []geom.Point {
+	var o []geom.Point
 	dx := 3 * r
 	dy := r * math.Sqrt(3)
-	var i int
-	var haveHexagons bool // have we added any hexagons
 	xstart := []float64{bbox.Min.X, bbox.Min.X - 1.5*r}
 	ystart := []float64{bbox.Min.Y, bbox.Min.Y - r}
 	for j, xmin := range xstart {
@@ -126,22 +182,36 @@ func NewHexagram(data []Grouper, r float64) (*Hexagram, error) {
 				if len(dataIndex.SearchIntersect(p.Bounds())) == 0 {
 					continue
 				}
-				h := &Hex{
-					Point: p,
-					i:     i,
-					r:     r,
-				}
-				i++
-				o.hexes = append(o.hexes, h)
-				o.index.Insert(h)
-				o.b.Extend(h.Bounds())
-				haveHexagons = true
+				o = append(o, p)
 			}
 		}
 	}
-	if !haveHexagons {
+	return o
+}
+
+// newHexagram creates a new hexagonal tile map with hexagons of
+// radius r at the given centers and allocates data to them, where
+// origin is the origin of the hexagon lattice.
+func newHexagram(data []Grouper, origin geom.Point, centers []geom.Point, r float64) (*Hexagram, error) {
+	if len(centers) == 0 {
 		return nil, errors.New("tilegram: no hexagons of given radius fit within given bounds")
 	}
+	o := Hexagram{
+		index:  rtree.NewTree(25, 50),
+		r:      r,
+		origin: origin,
+		b:      geom.NewBounds(),
+	}
+	for i, p := range centers {
+		h := &Hex{
+			Point: p,
+			i:     i,
+			r:     r,
+		}
+		o.hexes = append(o.hexes, h)
+		o.index.Insert(h)
+		o.b.Extend(h.Bounds())
+	}
 	for _, d := range data {
 		o.add(d)
 	}
@@ -178,6 +248,11 @@ func (h *Hexagram) Hexes() []*Hex {
 	return h.hexes
 }
 
+// Radius returns the radius of the hexagons in the receiver.
+func (h *Hexagram) Radius() float64 {
+	return h.r
+}
+
 // Bounds returns the bounding box of the receiver.
 func (h *Hexagram) Bounds() *geom.Bounds {
 	return h.b
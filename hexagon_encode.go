@@ -0,0 +1,107 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/index/rtree"
+)
+
+// hexagramFileVersion is the version of the hexagram file format
+// written by Hexagram.Encode.
+const hexagramFileVersion = 1
+
+// hexagramFile is the serialized form of a Hexagram.
+type hexagramFile struct {
+	Version int        `json:"version"`
+	Radius  float64    `json:"radius"`
+	Origin  [2]float64 `json:"origin"`
+	Tiles   []hexFile  `json:"tiles"`
+}
+
+// hexFile is the serialized form of a Hex.
+type hexFile struct {
+	X     float64 `json:"x"`
+	Y     float64 `json:"y"`
+	Group string  `json:"group"`
+
+	// Data holds the weight of the data in the tile by group.
+	Data map[string]float64 `json:"data,omitempty"`
+}
+
+// Encode writes the receiver to w in JSON format so that it can be
+// read by DecodeHexagram. For each tile, the format holds the location,
+// the group, and the weight of the data in the tile by group.
+// The geometry of the data is not stored.
+func (h *Hexagram) Encode(w io.Writer) error {
+	f := hexagramFile{
+		Version: hexagramFileVersion,
+		Radius:  h.r,
+		Origin:  [2]float64{h.origin.X, h.origin.Y},
+		Tiles:   make([]hexFile, len(h.hexes)),
+	}
+	for i, hh := range h.hexes {
+		t := hexFile{X: hh.X, Y: hh.Y, Group: hh.Group()}
+		for _, d := range hh.Data {
+			if t.Data == nil {
+				t.Data = make(map[string]float64)
+			}
+			t.Data[d.Group()] += d.Weight()
+		}
+		f.Tiles[i] = t
+	}
+	e := json.NewEncoder(w)
+	e.SetIndent("", " ")
+	return e.Encode(f)
+}
+
+// DecodeHexagram reads a hexagram that was written by Hexagram.Encode.
+// Because the data geometry is not stored, each data item in the result
+// takes the geometry of the tile it is in. Tiles whose group differs
+// from the group with the most weight in the tile are assigned to
+// their stored group.
+func DecodeHexagram(r io.Reader) (*Hexagram, error) {
+	var f hexagramFile
+	if err := json.NewDecoder(r).Decode(&f); err != nil {
+		return nil, err
+	}
+	if f.Version != hexagramFileVersion {
+		return nil, fmt.Errorf("tilegram: unsupported hexagram file version %d", f.Version)
+	}
+	if f.Radius <= 0 {
+		return nil, errors.New("tilegram: hexagram radius must be positive")
+	}
+	if len(f.Tiles) == 0 {
+		return nil, errors.New("tilegram: hexagram has no tiles")
+	}
+	o := &Hexagram{
+		index:  rtree.NewTree(25, 50),
+		r:      f.Radius,
+		origin: geom.Point{X: f.Origin[0], Y: f.Origin[1]},
+		b:      geom.NewBounds(),
+	}
+	for i, t := range f.Tiles {
+		h := &Hex{
+			Point: geom.Point{X: t.X, Y: t.Y},
+			i:     i,
+			r:     f.Radius,
+		}
+		for g, w := range t.Data {
+			h.Data = append(h.Data, &Data{Polygonal: h.Geom(), W: w, G: g})
+		}
+		if h.Group() != t.Group {
+			h.Assigned = t.Group
+		}
+		o.hexes = append(o.hexes, h)
+		o.index.Insert(h)
+		o.b.Extend(h.Bounds())
+	}
+	return o, nil
+}
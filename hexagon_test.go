@@ -0,0 +1,49 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestNewHexagramCount(t *testing.T) {
+	for _, n := range []int{5, 20, 100} {
+		h, err := NewHexagramCount(testDensity().Groupers(), n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Len() < n*3/4 || h.Len() > n*5/4 {
+			t.Errorf("want about %d hexagons, have %d", n, h.Len())
+		}
+	}
+}
+
+func TestHexagramEncode(t *testing.T) {
+	h, err := NewHexagram(testDensity().Groupers(), 0.3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.hexes[0].Assigned = "c"
+	var buf bytes.Buffer
+	if err := h.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	h2, err := DecodeHexagram(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h2.Len() != h.Len() || h2.Radius() != h.Radius() {
+		t.Fatalf("have %d tiles of radius %g, want %d of radius %g", h2.Len(), h2.Radius(), h.Len(), h.Radius())
+	}
+	for i, hh := range h.Hexes() {
+		hh2 := h2.Hexes()[i]
+		if hh2.Point != hh.Point || hh2.Group() != hh.Group() || math.Abs(hh2.Weight()-hh.Weight()) > 1e-10 {
+			t.Errorf("tile %d: have %v %s %g, want %v %s %g", i, hh2.Point, hh2.Group(), hh2.Weight(),
+				hh.Point, hh.Group(), hh.Weight())
+		}
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/ctessum/geom"
+)
+
+// LayoutStats describes the displacement of the symbols in a Dorling
+// or Demers cartogram from their origins.
+type LayoutStats struct {
+	// MeanDisplacement and MaxDisplacement are the mean and maximum
+	// distances between the centers of the symbols and their origins.
+	MeanDisplacement, MaxDisplacement float64
+
+	// MeanRelativeDisplacement is the mean of the displacement of each
+	// symbol divided by its size: the radius of a circle or half of
+	// the side of a square.
+	MeanRelativeDisplacement float64
+
+	// Overlaps is the number of pairs of symbols that still overlap.
+	Overlaps int
+}
+
+// layoutAttraction is the fraction of the distance back to its origin
+// that each symbol moves in each iteration, at the start. It decreases
+// to zero by half way through the iterations so that the remaining
+// iterations only separate overlapping symbols.
+const layoutAttraction = 0.1
+
+// layoutRelaxation is the multiple of their overlap by which pairs of
+// overlapping symbols are pushed apart. Pushing them further than
+// needed to just touch spreads out dense clusters of symbols, such as
+// those of the block groups in a city, in far fewer iterations.
+const layoutRelaxation = 1.9
+
+// layoutOrigins returns the centroid of each item of data and the area
+// of its symbol, for symbols with a total area of the given fraction
+// of the total area of data. name is the type of cartogram, for
+// error messages.
+func layoutOrigins(data []Grouper, fill float64, name string) (origins []geom.Point, areas []float64, err error) {
+	if len(data) == 0 {
+		return nil, nil, fmt.Errorf("tilegram: no data for %s cartogram", name)
+	}
+	if fill <= 0 {
+		return nil, nil, fmt.Errorf("tilegram: %s fill must be positive", name)
+	}
+	var totalArea, totalWeight float64
+	for _, d := range data {
+		totalArea += d.Area()
+		totalWeight += d.Weight()
+	}
+	if totalWeight <= 0 || totalArea <= 0 {
+		return nil, nil, fmt.Errorf("tilegram: %s cartogram data must have positive weight and area", name)
+	}
+	origins = make([]geom.Point, len(data))
+	areas = make([]float64, len(data))
+	for i, d := range data {
+		var a float64
+		a, origins[i] = polygonMoments(d.Polygons())
+		if a == 0 {
+			b := d.Bounds()
+			origins[i] = geom.Point{X: (b.Min.X + b.Max.X) / 2, Y: (b.Min.Y + b.Max.Y) / 2}
+		}
+		areas[i] = fill * totalArea * d.Weight() / totalWeight
+	}
+	return origins, areas, nil
+}
+
+// layoutAttract moves each of the n symbols, whose center is returned
+// by center, the given fraction of the distance back to its origin.
+func layoutAttract(n int, center func(int) *geom.Point, origins []geom.Point, fraction float64) {
+	for i := 0; i < n; i++ {
+		c := center(i)
+		c.X += fraction * (origins[i].X - c.X)
+		c.Y += fraction * (origins[i].Y - c.Y)
+	}
+}
+
+// layoutDisplacement returns the statistics, other than Overlaps, of the
+// displacement of n symbols from their origins, where center and size
+// return the center and size of each symbol.
+func layoutDisplacement(n int, center func(int) *geom.Point, size func(int) float64, origins []geom.Point) LayoutStats {
+	var s LayoutStats
+	for i := 0; i < n; i++ {
+		c := center(i)
+		d := math.Hypot(c.X-origins[i].X, c.Y-origins[i].Y)
+		s.MeanDisplacement += d
+		s.MaxDisplacement = math.Max(s.MaxDisplacement, d)
+		if size(i) > 0 {
+			s.MeanRelativeDisplacement += d / size(i)
+		}
+	}
+	s.MeanDisplacement /= float64(n)
+	s.MeanRelativeDisplacement /= float64(n)
+	return s
+}
+
+// gridPairs calls f, in order, for each pair i < j of the n symbols
+// whose centers are in the same or adjacent cells of a grid with the
+// given cell size, which must be at least the largest offset, along
+// either axis, between the centers of overlapping symbols. The grid
+// is not updated if f moves the symbols.
+func gridPairs(n int, center func(int) *geom.Point, size float64, f func(i, j int)) {
+	if !(size > 0) {
+		return
+	}
+	g := newSymbolGrid(n, center, size)
+	for i := 0; i < n; i++ {
+		g.near(center(i), func(j int) {
+			if j > i {
+				f(i, j)
+			}
+		})
+	}
+}
+
+// symbolGrid indexes the centers of symbols by the cells of a grid,
+// as for gridPairs.
+type symbolGrid struct {
+	size  float64
+	cells map[[2]int][]int
+}
+
+// newSymbolGrid returns an index of the centers of n symbols in a grid
+// with the given cell size, which must be positive.
+func newSymbolGrid(n int, center func(int) *geom.Point, size float64) *symbolGrid {
+	g := &symbolGrid{size: size, cells: make(map[[2]int][]int)}
+	for i := 0; i < n; i++ {
+		k := g.cell(center(i))
+		g.cells[k] = append(g.cells[k], i)
+	}
+	return g
+}
+
+// cell returns the cell of the grid that contains p.
+func (g *symbolGrid) cell(p *geom.Point) [2]int {
+	return [2]int{int(math.Floor(p.X / g.size)), int(math.Floor(p.Y / g.size))}
+}
+
+// near calls f for each symbol whose center is in the same cell
+// as p or an adjacent one.
+func (g *symbolGrid) near(p *geom.Point, f func(j int)) {
+	k := g.cell(p)
+	for x := k[0] - 1; x <= k[0]+1; x++ {
+		for y := k[1] - 1; y <= k[1]+1; y++ {
+			for _, j := range g.cells[[2]int{x, y}] {
+				f(j)
+			}
+		}
+	}
+}
+
+// move updates the index after the center of symbol i
+// moves from old to p.
+func (g *symbolGrid) move(i int, old, p *geom.Point) {
+	from, to := g.cell(old), g.cell(p)
+	if from == to {
+		return
+	}
+	s := g.cells[from]
+	for k, j := range s {
+		if j == i {
+			g.cells[from] = append(s[:k], s[k+1:]...)
+			break
+		}
+	}
+	g.cells[to] = append(g.cells[to], i)
+}
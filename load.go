@@ -0,0 +1,293 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/geojson"
+	"github.com/ctessum/geom/encoding/shp"
+	"github.com/ctessum/geom/proj"
+)
+
+// Features holds a set of polygonal features along with the weight and
+// group of each. It implements the PolygonDensity interface so it can be
+// used directly as input to NewCartogram, and its Groupers method
+// returns the same features as input for NewHexagram.
+type Features struct {
+	// Polygons holds the geometry of each feature.
+	Polygons []geom.Polygonal
+
+	// Weights holds the weight of each feature, e.g., population count.
+	Weights []float64
+
+	// Groups holds the group of each feature, e.g., county name.
+	Groups []string
+
+	// SR is the spatial reference of Polygons, or nil if it is not
+	// known. See EqualArea for how to handle features whose
+	// coordinates are longitudes and latitudes.
+	SR *proj.SR
+}
+
+// Len implements the PolygonDensity interface.
+func (f *Features) Len() int { return len(f.Polygons) }
+
+// Polygon implements the PolygonDensity interface.
+func (f *Features) Polygon(i int) geom.Polygonal { return f.Polygons[i] }
+
+// Density implements the PolygonDensity interface. It returns
+// the weight of feature i divided by its area, or zero
+// if the feature has no area.
+func (f *Features) Density(i int) float64 {
+	a := f.Polygons[i].Area()
+	if a == 0 {
+		return 0
+	}
+	return f.Weights[i] / a
+}
+
+// Groupers returns the receiver's features in the form
+// required by NewHexagram.
+func (f *Features) Groupers() []Grouper {
+	o := make([]Grouper, f.Len())
+	for i, p := range f.Polygons {
+		o[i] = &Data{
+			Polygonal: p,
+			W:         f.Weights[i],
+			G:         f.Groups[i],
+		}
+	}
+	return o
+}
+
+// Transform returns a copy of the receiver where the geometry
+// has been transformed to match cartogram c, which may be a Cartogram
+// or a RubberSheet. Weights and groups are unchanged, so the result can
+// be used to create a Hexagram from the cartogram-transformed features.
+func (f *Features) Transform(c Transformer) *Features {
+	var polys []geom.Polygon
+	cuts := make([]int, f.Len()+1)
+	for i, p := range f.Polygons {
+		polys = append(polys, p.Polygons()...)
+		cuts[i+1] = len(polys)
+	}
+	polys = c.TransformPolygons(polys)
+
+	o := &Features{
+		Polygons: make([]geom.Polygonal, f.Len()),
+		Weights:  append([]float64(nil), f.Weights...),
+		Groups:   append([]string(nil), f.Groups...),
+		SR:       f.SR,
+	}
+	for i, p := range f.Polygons {
+		if _, ok := p.(geom.Polygon); ok {
+			o.Polygons[i] = polys[cuts[i]]
+		} else {
+			o.Polygons[i] = geom.MultiPolygon(polys[cuts[i]:cuts[i+1]])
+		}
+	}
+	return o
+}
+
+// ReadFeatures reads polygon features from the given file, where
+// weightField and groupField are the names of the attributes holding the
+// weight and group of each feature. If groupField is empty, all features
+// will be assigned to the same group. Files ending in ".shp" are read as
+// shapefiles and files ending in ".json" or ".geojson" are read as
+// GeoJSON FeatureCollections. The spatial reference of a shapefile is
+// read from its .prj file, if it has one that can be parsed. That of
+// GeoJSON is longitude and latitude on the WGS84 datum, as RFC 7946
+// requires, unless the coordinates are out of range for longitude and
+// latitude, in which case it is not known. Set the SR field of the
+// result to override it.
+func ReadFeatures(filename, weightField, groupField string) (*Features, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".shp":
+		return ReadShapefile(filename, weightField, groupField)
+	case ".json", ".geojson":
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return ReadGeoJSON(f, weightField, groupField)
+	default:
+		return nil, fmt.Errorf("tilegram: unsupported file type %s", filename)
+	}
+}
+
+// ReadShapefile reads polygon features from the shapefile with the
+// given name. See ReadFeatures for more information.
+func ReadShapefile(filename, weightField, groupField string) (*Features, error) {
+	d, err := shp.NewDecoder(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+
+	fieldNames := []string{weightField}
+	if groupField != "" {
+		fieldNames = append(fieldNames, groupField)
+	}
+	o := new(Features)
+	for {
+		g, fields, more := d.DecodeRowFields(fieldNames...)
+		if !more {
+			break
+		}
+		wStr, ok := fields[weightField]
+		if !ok {
+			return nil, fmt.Errorf("tilegram: shapefile %s has no field %s", filename, weightField)
+		}
+		w, err := strconv.ParseFloat(strings.TrimSpace(wStr), 64)
+		if err != nil {
+			return nil, fmt.Errorf("tilegram: parsing field %s in %s: %v", weightField, filename, err)
+		}
+		var group string
+		if groupField != "" {
+			if group, ok = fields[groupField]; !ok {
+				return nil, fmt.Errorf("tilegram: shapefile %s has no field %s", filename, groupField)
+			}
+		}
+		if err := o.add(g, w, group); err != nil {
+			return nil, err
+		}
+	}
+	if err = d.Error(); err != nil {
+		return nil, err
+	}
+	// A missing or unsupported .prj file leaves the spatial
+	// reference unknown rather than preventing the features from
+	// being used.
+	if sr, err := d.SR(); err == nil {
+		o.SR = sr
+	}
+	return o, nil
+}
+
+type geoJSONFeatureCollection struct {
+	Type     string            `json:"type"`
+	Features []*geoJSONFeature `json:"features"`
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   *geojson.Geometry      `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// DecodeGeoJSON reads a GeoJSON FeatureCollection, returning the
+// geometry, of any type, and the properties of each feature.
+func DecodeGeoJSON(r io.Reader) ([]geom.Geom, []map[string]interface{}, error) {
+	var fc geoJSONFeatureCollection
+	if err := json.NewDecoder(r).Decode(&fc); err != nil {
+		return nil, nil, err
+	}
+	if fc.Type != "FeatureCollection" {
+		return nil, nil, fmt.Errorf("tilegram: GeoJSON type is %s, not FeatureCollection", fc.Type)
+	}
+	geoms := make([]geom.Geom, len(fc.Features))
+	props := make([]map[string]interface{}, len(fc.Features))
+	for i, f := range fc.Features {
+		if f.Geometry == nil {
+			return nil, nil, fmt.Errorf("tilegram: GeoJSON feature %d has no geometry", i)
+		}
+		g, err := geojson.Decode(f.Geometry)
+		if err != nil {
+			return nil, nil, fmt.Errorf("tilegram: GeoJSON feature %d: %v", i, err)
+		}
+		geoms[i], props[i] = g, f.Properties
+	}
+	return geoms, props, nil
+}
+
+// ReadGeoJSON reads polygon features from a GeoJSON FeatureCollection.
+// See ReadFeatures for more information.
+func ReadGeoJSON(r io.Reader, weightField, groupField string) (*Features, error) {
+	geoms, props, err := DecodeGeoJSON(r)
+	if err != nil {
+		return nil, err
+	}
+	o := new(Features)
+	for i, g := range geoms {
+		w, err := propertyFloat(props[i], weightField)
+		if err != nil {
+			return nil, fmt.Errorf("tilegram: GeoJSON feature %d: %v", i, err)
+		}
+		var group string
+		if groupField != "" {
+			v, ok := props[i][groupField]
+			if !ok {
+				return nil, fmt.Errorf("tilegram: GeoJSON feature %d has no property %s", i, groupField)
+			}
+			group = fmt.Sprint(v)
+		}
+		if err := o.add(g, w, group); err != nil {
+			return nil, err
+		}
+	}
+	if o.SR, err = GeoJSONReference(geoms); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// GeoJSONReference returns the spatial reference of GeoJSON geometry,
+// as described for ReadFeatures: longitude and latitude on the WGS84
+// datum, or nil if any coordinates are out of range for them.
+func GeoJSONReference(geoms []geom.Geom) (*proj.SR, error) {
+	// GeoJSON coordinates are longitudes and latitudes on the WGS84
+	// datum, but files with projected coordinates, such as the outputs
+	// of this package, are common, so coordinates outside the range of
+	// longitude and latitude leave the spatial reference unknown.
+	if len(geoms) == 0 {
+		return nil, nil
+	}
+	b := geom.NewBounds()
+	for _, g := range geoms {
+		b.Extend(g.Bounds())
+	}
+	if !(b.Min.X >= -180 && b.Max.X <= 180 && b.Min.Y >= -90 && b.Max.Y <= 90) {
+		return nil, nil
+	}
+	return proj.Parse(LonLatWGS84)
+}
+
+// propertyFloat returns the value of property name as a float,
+// whether it is stored as a number or a string.
+func propertyFloat(props map[string]interface{}, name string) (float64, error) {
+	v, ok := props[name]
+	if !ok {
+		return 0, fmt.Errorf("no property %s", name)
+	}
+	switch vv := v.(type) {
+	case float64:
+		return vv, nil
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(vv), 64)
+	default:
+		return 0, fmt.Errorf("property %s has invalid type %T", name, v)
+	}
+}
+
+// add adds a feature to the receiver.
+func (f *Features) add(g geom.Geom, weight float64, group string) error {
+	p, ok := g.(geom.Polygonal)
+	if !ok {
+		return fmt.Errorf("tilegram: geometry type %T is not polygonal", g)
+	}
+	f.Polygons = append(f.Polygons, p)
+	f.Weights = append(f.Weights, weight)
+	f.Groups = append(f.Groups, group)
+	return nil
+}
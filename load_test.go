@@ -0,0 +1,112 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+func TestReadShapefile(t *testing.T) {
+	f, err := ReadFeatures("testdata/WA_Population_2010.shp", "population", "county")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Len() != 4771 {
+		t.Errorf("have %d features, want 4771", f.Len())
+	}
+	var sum float64
+	for i := 0; i < f.Len(); i++ {
+		sum += f.Density(i) * f.Polygon(i).Area()
+		if f.Groups[i] == "" {
+			t.Errorf("feature %d has no group", i)
+		}
+	}
+	if want := 6724540.; math.Abs(sum-want) > 1 {
+		t.Errorf("total population: have %g, want %g", sum, want)
+	}
+	if g := f.Groupers(); len(g) != f.Len() {
+		t.Errorf("have %d groupers, want %d", len(g), f.Len())
+	}
+	// The features are projected, so they are used as they are.
+	if f.SR == nil || IsGeographic(f.SR) {
+		t.Errorf("spatial reference: %+v", f.SR)
+	}
+	if p, err := f.EqualArea(); err != nil || p != f {
+		t.Errorf("projected features changed: %v", err)
+	}
+
+	if _, err := ReadShapefile("testdata/WA_Population_2010.shp", "xxx", "county"); err == nil {
+		t.Error("missing weight field should cause an error")
+	}
+}
+
+func TestDecodeGeoJSON(t *testing.T) {
+	geoms := []geom.Geom{
+		geom.Point{X: 1, Y: 2},
+		geom.LineString{{X: 0, Y: 0}, {X: 1, Y: 1}},
+	}
+	props := []map[string]interface{}{{"name": "a"}, {"name": "b", "n": 2.0}}
+	var buf bytes.Buffer
+	if err := EncodeGeoJSON(&buf, geoms, props); err != nil {
+		t.Fatal(err)
+	}
+	g, p, err := DecodeGeoJSON(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(g, geoms) || !reflect.DeepEqual(p, props) {
+		t.Errorf("have %v %v, want %v %v", g, p, geoms, props)
+	}
+	if err := EncodeGeoJSON(&buf, geoms, props[:1]); err == nil {
+		t.Error("no error for missing properties")
+	}
+}
+
+func TestReadGeoJSON(t *testing.T) {
+	const in = `{"type":"FeatureCollection","features":[
+{"type":"Feature","properties":{"pop":10,"state":"A"},
+	"geometry":{"type":"Polygon","coordinates":[[[0,0],[2,0],[2,2],[0,2],[0,0]]]}},
+{"type":"Feature","properties":{"pop":"6","state":"B"},
+	"geometry":{"type":"MultiPolygon","coordinates":[[[[2,0],[3,0],[3,1],[2,1],[2,0]]],[[[2,1],[3,1],[3,2],[2,2],[2,1]]]]}}
+]}`
+	f, err := ReadGeoJSON(strings.NewReader(in), "pop", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Len() != 2 {
+		t.Fatalf("have %d features, want 2", f.Len())
+	}
+	if d := f.Density(0); d != 2.5 {
+		t.Errorf("density 0: have %g, want 2.5", d)
+	}
+	if d := f.Density(1); d != 3 {
+		t.Errorf("density 1: have %g, want 3", d)
+	}
+	if f.Groups[1] != "B" {
+		t.Errorf("group 1: have %s, want B", f.Groups[1])
+	}
+	if _, ok := f.Polygons[1].(geom.MultiPolygon); !ok {
+		t.Errorf("geometry 1 should be a MultiPolygon but is %T", f.Polygons[1])
+	}
+	if !IsGeographic(f.SR) {
+		t.Errorf("spatial reference %+v is not longitude and latitude", f.SR)
+	}
+
+	// Coordinates outside the range of longitude and latitude
+	// must be projected, in an unknown spatial reference.
+	f, err = ReadGeoJSON(strings.NewReader(strings.Replace(in, "[2,0],[3,0]", "[2,0],[300,0]", 1)), "pop", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.SR != nil {
+		t.Errorf("spatial reference of projected input: have %+v, want nil", f.SR)
+	}
+}
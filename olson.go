@@ -0,0 +1,205 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"container/heap"
+	"math"
+
+	"github.com/ctessum/geom"
+)
+
+// NonContiguous is a non-contiguous cartogram, where each shape is
+// scaled in place around an anchor point so that its area is proportional
+// to its density times its area, leaving gaps between the shapes.
+type NonContiguous struct {
+	// Polygons holds the scaled shapes, in the order of the input.
+	Polygons []geom.Polygonal
+
+	// Anchors holds the point of each shape that stays fixed,
+	// and Scales the factor by which its lengths are multiplied.
+	Anchors []geom.Point
+	Scales  []float64
+}
+
+// An Anchor returns the point of a shape that stays fixed
+// when it is scaled in a NonContiguous cartogram.
+type Anchor func(geom.Polygonal) geom.Point
+
+// CentroidAnchor is an Anchor that returns the centroid of the shape.
+// It is the default. The centroid of a shape that is not convex may be
+// outside of it, in which case the scaled shape is moved away from its
+// original location.
+func CentroidAnchor(p geom.Polygonal) geom.Point {
+	_, c := polygonMoments(p.Polygons())
+	return c
+}
+
+// PoleAnchor returns an Anchor that returns the pole of inaccessibility
+// of the shape, the point inside of it that is farthest from its edges,
+// which keeps a scaled shape that is not convex inside its original
+// outline. The pole is found to within the given fraction of the
+// smaller dimension of the bounds of the shape, using the algorithm of
+// the article below. PoleAnchor panics if precision is not positive
+// and finite.
+//
+// Garcia-Castellanos, D., & Lombardo, U. (2007). Poles of inaccessibility:
+// A calculation algorithm for the remotest places on earth. Scottish
+// Geographical Journal, 123(3), 227–233. http://doi.org/10.1080/14702540801897809
+func PoleAnchor(precision float64) Anchor {
+	if !(precision > 0) || math.IsInf(precision, 1) {
+		panic("tilegram: pole precision must be positive and finite")
+	}
+	return func(p geom.Polygonal) geom.Point {
+		var rings []geom.Path
+		for _, poly := range p.Polygons() {
+			rings = append(rings, poly...)
+		}
+		return poleOfInaccessibility(rings, precision)
+	}
+}
+
+// WithAnchor sets the Anchor of each shape in a NonContiguous
+// cartogram. It has no effect on other types of cartograms.
+func WithAnchor(a Anchor) Option {
+	return func(o *options) { o.anchor = a }
+}
+
+// WithReferenceDensity sets the density at which shapes in a
+// NonContiguous cartogram keep their size, which by default is the
+// maximum density of the input shapes, so that all of the other shapes
+// shrink. To keep the size of shape i, use shapes.Density(i). It has no
+// effect on other types of cartograms.
+func WithReferenceDensity(d float64) Option {
+	return func(o *options) { o.referenceDensity = d }
+}
+
+// NewNonContiguous creates a non-contiguous cartogram from shapes,
+// using the algorithm described in the article below. The area of each
+// shape is multiplied by its density divided by the reference density
+// set by WithReferenceDensity, and shapes with zero or negative density
+// are scaled to a point. The anchor of each shape is set by WithAnchor.
+//
+// Olson, J. M. (1976). Noncontiguous area cartograms. The Professional
+// Geographer, 28(4), 371–380. http://doi.org/10.1111/j.0033-0124.1976.00371.x
+func NewNonContiguous(shapes PolygonDensity, opts ...Option) *NonContiguous {
+	o := newOptions(opts)
+	n := shapes.Len()
+	ref := o.referenceDensity
+	if ref == 0 {
+		for i := 0; i < n; i++ {
+			ref = math.Max(ref, shapes.Density(i))
+		}
+	}
+
+	c := &NonContiguous{
+		Polygons: make([]geom.Polygonal, n),
+		Anchors:  make([]geom.Point, n),
+		Scales:   make([]float64, n),
+	}
+	for i := 0; i < n; i++ {
+		p := shapes.Polygon(i)
+		c.Anchors[i] = o.anchor(p)
+		if d := shapes.Density(i); d > 0 && ref > 0 {
+			c.Scales[i] = math.Sqrt(d / ref)
+		}
+		c.Polygons[i] = c.Scale(i, p).(geom.Polygonal)
+	}
+	return c
+}
+
+// Scale returns a copy of g, such as the cities within a state, scaled
+// in the same way as shape i.
+func (c *NonContiguous) Scale(i int, g geom.Geom) geom.Geom {
+	a, s := c.Anchors[i], c.Scales[i]
+	return transformGeoms([]geom.Geom{g}, func(paths []geom.Path, _ []int) []geom.Path {
+		o := make([]geom.Path, len(paths))
+		for j, p := range paths {
+			o[j] = make(geom.Path, len(p))
+			for k, pt := range p {
+				o[j][k] = geom.Point{X: a.X + s*(pt.X-a.X), Y: a.Y + s*(pt.Y-a.Y)}
+			}
+		}
+		return o
+	})[0]
+}
+
+// poleCell is a square cell searched for the pole of inaccessibility.
+type poleCell struct {
+	center geom.Point
+
+	// half is half of the width of the cell, dist is the signed distance
+	// from its center to the nearest edge, which is positive inside, and
+	// max is the largest distance that any point in the cell can have.
+	half, dist, max float64
+}
+
+func newPoleCell(center geom.Point, half float64, rings []geom.Path) poleCell {
+	d := math.Inf(1)
+	for _, r := range rings {
+		for i, a := range r {
+			d = math.Min(d, segmentDistance(center, a, r[(i+1)%len(r)]))
+		}
+	}
+	if !pointInPolygon(center, rings) {
+		d = -d
+	}
+	return poleCell{center: center, half: half, dist: d, max: d + half*math.Sqrt2}
+}
+
+// poleQueue is a priority queue of cells with the
+// largest possible distance first.
+type poleQueue []poleCell
+
+func (q poleQueue) Len() int            { return len(q) }
+func (q poleQueue) Less(i, j int) bool  { return q[i].max > q[j].max }
+func (q poleQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *poleQueue) Push(x interface{}) { *q = append(*q, x.(poleCell)) }
+func (q *poleQueue) Pop() interface{} {
+	c := (*q)[len(*q)-1]
+	*q = (*q)[:len(*q)-1]
+	return c
+}
+
+// poleOfInaccessibility returns the point inside the polygon with the
+// given rings that is farthest from its edges, to within the given
+// fraction of the smaller dimension of its bounds. Cells covering the
+// polygon are repeatedly split into four, starting with those that
+// could contain the farthest point, until no cell could contain a
+// point that is farther than the best so far by more than the
+// precision.
+func poleOfInaccessibility(rings []geom.Path, precision float64) geom.Point {
+	b := geom.Polygon(rings).Bounds()
+	size := math.Min(b.Max.X-b.Min.X, b.Max.Y-b.Min.Y)
+	if !(size > 0) {
+		return b.Min
+	}
+	tolerance := precision * size
+
+	var q poleQueue
+	half := size / 2
+	for x := b.Min.X; x < b.Max.X; x += size {
+		for y := b.Min.Y; y < b.Max.Y; y += size {
+			q = append(q, newPoleCell(geom.Point{X: x + half, Y: y + half}, half, rings))
+		}
+	}
+	heap.Init(&q)
+
+	best := newPoleCell(CentroidAnchor(geom.Polygon(rings)), 0, rings)
+	for q.Len() > 0 {
+		c := heap.Pop(&q).(poleCell)
+		if c.dist > best.dist {
+			best = c
+		}
+		if c.max-best.dist <= tolerance {
+			continue
+		}
+		h := c.half / 2
+		for _, d := range [][2]float64{{-h, -h}, {h, -h}, {-h, h}, {h, h}} {
+			heap.Push(&q, newPoleCell(geom.Point{X: c.center.X + d[0], Y: c.center.Y + d[1]}, h, rings))
+		}
+	}
+	return best.center
+}
@@ -0,0 +1,74 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+func TestNewNonContiguous(t *testing.T) {
+	f := testDensity()
+	c := NewNonContiguous(f)
+
+	// The dense center square keeps its size and the others
+	// shrink around their centroids.
+	if !reflect.DeepEqual(c.Polygons[0], f.Polygons[0]) {
+		t.Errorf("center: have %v, want %v", c.Polygons[0], f.Polygons[0])
+	}
+	p := c.Polygons[1].(geom.Polygon)
+	if a := p.Area(); math.Abs(a-0.1) > 1e-12 {
+		t.Errorf("area: have %g, want 0.1", a)
+	}
+	if _, cent := polygonMoments([]geom.Polygon{p}); math.Abs(cent.X-0.5) > 1e-12 || math.Abs(cent.Y-1.5) > 1e-12 {
+		t.Errorf("centroid: have %v, want (0.5, 1.5)", cent)
+	}
+	if s := c.Scales[1]; math.Abs(s-math.Sqrt(0.1)) > 1e-12 {
+		t.Errorf("scale: have %g, want %g", s, math.Sqrt(0.1))
+	}
+
+	// Cities are scaled with the shapes that contain them.
+	if have, want := c.Scale(1, geom.Point{X: 0, Y: 1.5}), (geom.Point{X: 0.5 - 0.5*c.Scales[1], Y: 1.5}); have != want {
+		t.Errorf("Scale: have %v, want %v", have, want)
+	}
+
+	c = NewNonContiguous(f, WithReferenceDensity(f.Density(1)))
+	if a := c.Polygons[0].(geom.Polygon).Area(); math.Abs(a-10) > 1e-12 {
+		t.Errorf("reference area: have %g, want 10", a)
+	}
+	if !reflect.DeepEqual(c.Polygons[1], f.Polygons[1]) {
+		t.Errorf("reference: have %v, want %v", c.Polygons[1], f.Polygons[1])
+	}
+}
+
+func TestPoleAnchor(t *testing.T) {
+	// A U shape whose centroid, (1.5, 1.36), is in the gap between its
+	// arms. Its poles are where the arms meet the base, at distance
+	// √2/(1+√2) from the edges.
+	u := geom.Polygon{{{X: 0, Y: 0}, {X: 3, Y: 0}, {X: 3, Y: 3}, {X: 2, Y: 3},
+		{X: 2, Y: 1}, {X: 1, Y: 1}, {X: 1, Y: 3}, {X: 0, Y: 3}}}
+	if p := CentroidAnchor(u); pointInPolygon(p, u) {
+		t.Errorf("centroid %v is inside", p)
+	}
+	p := PoleAnchor(0.001)(u)
+	want := math.Sqrt2 / (1 + math.Sqrt2)
+	if d := newPoleCell(p, 0, u).dist; math.Abs(d-want) > 0.003 {
+		t.Errorf("pole %v is %g from the edges, want %g", p, d, want)
+	}
+	for _, precision := range []float64{0, -0.1, math.NaN(), math.Inf(1)} {
+		t.Run(fmt.Sprint(precision), func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("no panic")
+				}
+			}()
+			PoleAnchor(precision)
+		})
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"math"
+
+	"github.com/ctessum/geom"
+)
+
+// pin marks the vertices of the grid cells covered by the polygons of
+// shapes with the given indices as pinned, as for WithPinned, and
+// returns shapes with the density of those polygons replaced by avg.
+func (c *Cartogram) pin(shapes PolygonDensity, indices []int, avg float64) PolygonDensity {
+	w := c.cols + 1
+	c.pinned = make([]bool, w*(c.rows+1))
+	p := pinnedDensity{PolygonDensity: shapes, pinned: make(map[int]bool), avg: avg}
+	for _, k := range indices {
+		if k < 0 || k >= shapes.Len() {
+			panic("tilegram: pinned polygon index out of range")
+		}
+		p.pinned[k] = true
+		cv := c.rasterize(shapes.Polygon(k))
+		for j := 0; j < cv.h; j++ {
+			for i := 0; i < cv.w; i++ {
+				if cv.frac[j*cv.w+i] == 0 {
+					continue
+				}
+				jj, ii := cv.j0+j, cv.i0+i
+				c.pinned[jj*w+ii] = true
+				c.pinned[jj*w+ii+1] = true
+				c.pinned[(jj+1)*w+ii] = true
+				c.pinned[(jj+1)*w+ii+1] = true
+			}
+		}
+	}
+	return p
+}
+
+// pinnedDensity is a PolygonDensity whose pinned
+// polygons have density avg.
+type pinnedDensity struct {
+	PolygonDensity
+	pinned map[int]bool
+	avg    float64
+}
+
+// Density implements the PolygonDensity interface.
+func (p pinnedDensity) Density(i int) float64 {
+	if p.pinned[i] {
+		return p.avg
+	}
+	return p.PolygonDensity.Density(i)
+}
+
+// AreaReport describes how closely the areas of cartogram-transformed
+// polygons match their weights.
+type AreaReport struct {
+	// Errors holds the relative area error of each polygon: its
+	// transformed area divided by its target area, minus one. The target
+	// area of a pinned polygon is its original area, and the polygons
+	// that are not pinned share their total transformed area in
+	// proportion to their weights, which are their densities times
+	// their original areas. The error of a polygon with no weight is NaN.
+	Errors []float64
+
+	// MeanError and MaxError are the mean and maximum of the absolute
+	// errors of the polygons that are not pinned and have weight.
+	MeanError, MaxError float64
+}
+
+// NewAreaReport returns a report on the areas of shapes after they have
+// been transformed to transformed by a cartogram that pinned the
+// polygons with the given indices, as for WithPinned. Comparing it with
+// the report for a cartogram created without pinning shows how much
+// the pinning costs in area error elsewhere.
+func NewAreaReport(shapes PolygonDensity, transformed []geom.Polygonal, pinned ...int) *AreaReport {
+	if len(transformed) != shapes.Len() {
+		panic("tilegram: numbers of shapes and transformed polygons differ")
+	}
+	isPinned := make(map[int]bool)
+	for _, k := range pinned {
+		isPinned[k] = true
+	}
+	var area, weight float64
+	for i, p := range transformed {
+		if !isPinned[i] {
+			area += p.Area()
+			weight += shapes.Density(i) * shapes.Polygon(i).Area()
+		}
+	}
+	o := &AreaReport{Errors: make([]float64, len(transformed))}
+	var n int
+	for i, p := range transformed {
+		a := shapes.Polygon(i).Area()
+		if isPinned[i] {
+			o.Errors[i] = p.Area()/a - 1
+			continue
+		}
+		target := shapes.Density(i) * a * area / weight
+		if target == 0 {
+			o.Errors[i] = math.NaN()
+			continue
+		}
+		o.Errors[i] = p.Area()/target - 1
+		e := math.Abs(o.Errors[i])
+		o.MeanError += e
+		o.MaxError = math.Max(o.MaxError, e)
+		n++
+	}
+	if n > 0 {
+		o.MeanError /= float64(n)
+	}
+	return o
+}
@@ -0,0 +1,44 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestWithPinned(t *testing.T) {
+	f := testDensity()
+	free := NewCartogram(f, 1, 30, 30)
+	freeReport := NewAreaReport(f, f.Transform(free).Polygons)
+	free.Destroy()
+
+	// The square to the left of the dense center is pinned.
+	c := NewCartogram(f, 1, 30, 30, WithPinned(1))
+	g := f.Transform(c)
+	c.Destroy()
+	if !reflect.DeepEqual(g.Polygons[1], f.Polygons[1]) {
+		t.Errorf("pinned polygon moved: have %v, want %v", g.Polygons[1], f.Polygons[1])
+	}
+	if a := g.Polygons[0].Area(); a <= 1 {
+		t.Errorf("center area %g did not grow", a)
+	}
+
+	r := NewAreaReport(f, g.Polygons, 1)
+	if r.Errors[1] != 0 {
+		t.Errorf("pinned polygon error: have %g, want 0", r.Errors[1])
+	}
+	// The center can't push the pinned square away, so the other
+	// squares are less accurate.
+	if r.MeanError <= freeReport.MeanError || r.MaxError <= freeReport.MaxError {
+		t.Errorf("pinned errors %+v are not more than free errors %+v", r, freeReport)
+	}
+	for i, e := range r.Errors {
+		if i != 1 && math.Abs(e) > r.MaxError {
+			t.Errorf("polygon %d error %g is more than the maximum %g", i, e, r.MaxError)
+		}
+	}
+}
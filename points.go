@@ -0,0 +1,203 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"math"
+
+	"github.com/ctessum/geom"
+)
+
+// PointWeight defines weighted point inputs for cartogram creation.
+type PointWeight interface {
+	Len() int
+	Point(int) geom.Point
+	Weight(int) float64
+}
+
+// Points holds weighted points, e.g., geocoded customer locations.
+// It implements the PointWeight interface.
+type Points struct {
+	Points  []geom.Point
+	Weights []float64
+}
+
+// Len returns the number of points in the receiver.
+func (p *Points) Len() int { return len(p.Points) }
+
+// Point returns point i.
+func (p *Points) Point(i int) geom.Point { return p.Points[i] }
+
+// Weight returns the weight of point i.
+func (p *Points) Weight(i int) float64 { return p.Weights[i] }
+
+// A Kernel is a radially symmetric kernel for kernel density
+// estimation.
+type Kernel struct {
+	// Profile returns the relative density of the kernel at distance
+	// u, in units of the bandwidth, from its center. It does not need to
+	// be normalized.
+	Profile func(u float64) float64
+
+	// Support is the distance, in units of the bandwidth, beyond
+	// which Profile is zero or negligible.
+	Support float64
+}
+
+// Kernels for use with WithKernel.
+var (
+	// GaussianKernel is a Gaussian kernel whose standard
+	// deviation is the bandwidth.
+	GaussianKernel = Kernel{
+		Profile: func(u float64) float64 { return math.Exp(-u * u / 2) },
+		Support: 4,
+	}
+
+	// EpanechnikovKernel is an Epanechnikov kernel with
+	// radius equal to the bandwidth.
+	EpanechnikovKernel = Kernel{
+		Profile: func(u float64) float64 { return math.Max(0, 1-u*u) },
+		Support: 1,
+	}
+
+	// QuarticKernel is a quartic (biweight) kernel with
+	// radius equal to the bandwidth.
+	QuarticKernel = Kernel{
+		Profile: func(u float64) float64 {
+			if u >= 1 {
+				return 0
+			}
+			return (1 - u*u) * (1 - u*u)
+		},
+		Support: 1,
+	}
+)
+
+// WithKernel sets the kernel used by NewPointCartogram. The default
+// is GaussianKernel.
+func WithKernel(k Kernel) Option {
+	return func(o *options) { o.kernel = k }
+}
+
+// minPointDensity is the fraction of the average density of a point
+// cartogram to which the density of grid cells is raised if it is
+// lower, because the diffusion velocity, the density gradient divided
+// by the density, is undefined where the density is zero.
+const minPointDensity = 1e-9
+
+// NewPointCartogram creates a cartogram from weighted points, with the
+// given margin added to each border of the bounds of the points and
+// the given numbers of rows and columns. The density grid is calculated
+// by kernel density estimation using the given bandwidth, in map units,
+// and the kernel set by WithKernel. The weight of each point is spread
+// over the grid cells within the support of the kernel so that all of
+// it remains within the grid.
+//
+// The background density set by WithBackground or WithMask is added to
+// the estimated density of every cell, where the average density
+// passed to the Background is the total weight of the points divided
+// by the area of the grid and the minimum density is the lowest
+// positive estimated density of any cell. With a zero background, as
+// set by FixedDensity(0), cells beyond the support of every kernel
+// would have no density, so the density of every cell is raised to at
+// least a billionth of the average. The other options are as for
+// NewCartogram.
+//
+// NewPointCartogram panics if there are no points or their total
+// weight is not positive.
+func NewPointCartogram(points PointWeight, margin float64, rows, cols int, bandwidth float64, opts ...Option) *Cartogram {
+	if bandwidth <= 0 {
+		panic("tilegram: bandwidth must be positive")
+	}
+	if points.Len() == 0 {
+		panic("tilegram: no points")
+	}
+	o := newOptions(opts)
+	b := geom.NewBounds()
+	for i := 0; i < points.Len(); i++ {
+		b.Extend(points.Point(i).Bounds())
+	}
+	b.Min.X -= margin
+	b.Min.Y -= margin
+	b.Max.X += margin
+	b.Max.Y += margin
+	c := newGrid(b, rows, cols)
+
+	kde := make([]float64, rows*cols)
+	var total float64
+	for i := 0; i < points.Len(); i++ {
+		total += points.Weight(i)
+	}
+	if !(total > 0) || math.IsInf(total, 0) {
+		panic("tilegram: the total weight of the points must be positive and finite")
+	}
+	for i := 0; i < points.Len(); i++ {
+		c.addKernel(kde, points.Point(i), points.Weight(i), o.kernel, bandwidth)
+	}
+	minDens := math.Inf(1)
+	for _, d := range kde {
+		if d > 0 && d < minDens {
+			minDens = d
+		}
+	}
+	avgDens := total / ((b.Max.X - b.Min.X) * (b.Max.Y - b.Min.Y))
+
+	m, _ := c.backgroundDensity(o, avgDens, minDens)
+	for j := 0; j < rows; j++ {
+		for i := 0; i < cols; i++ {
+			m.Set(j, i, math.Max(m.At(j, i)+kde[j*cols+i], minPointDensity*avgDens))
+		}
+	}
+	blendDensity(m, o.strength)
+	c.dens = m
+	c.diffuse()
+	return c
+}
+
+// addKernel adds the density of a point at p with weight w to the
+// row-major density grid dens, using kernel k with the given bandwidth.
+// The kernel is evaluated at cell centers and normalized so that the
+// total weight added to the grid is w. Points whose kernel does not
+// reach any cell center are assigned to the cell they are in, and
+// points whose kernel does not overlap the grid are ignored.
+func (c *Cartogram) addKernel(dens []float64, p geom.Point, w float64, k Kernel, bandwidth float64) {
+	gx := (p.X - c.b.Min.X) / c.dx
+	gy := (p.Y - c.b.Min.Y) / c.dy
+	r := k.Support * bandwidth
+	i0 := int(math.Max(0, math.Floor(gx-r/c.dx)))
+	i1 := int(math.Min(float64(c.cols-1), math.Ceil(gx+r/c.dx)))
+	j0 := int(math.Max(0, math.Floor(gy-r/c.dy)))
+	j1 := int(math.Min(float64(c.rows-1), math.Ceil(gy+r/c.dy)))
+	if i0 > i1 || j0 > j1 {
+		return
+	}
+
+	vals := make([]float64, (i1-i0+1)*(j1-j0+1))
+	var sum float64
+	for j := j0; j <= j1; j++ {
+		for i := i0; i <= i1; i++ {
+			u := math.Hypot((float64(i)+0.5-gx)*c.dx, (float64(j)+0.5-gy)*c.dy) / bandwidth
+			if u > k.Support {
+				continue
+			}
+			v := k.Profile(u)
+			vals[(j-j0)*(i1-i0+1)+i-i0] = v
+			sum += v
+		}
+	}
+	cellArea := c.dx * c.dy
+	if sum <= 0 {
+		i, j := int(math.Floor(gx)), int(math.Floor(gy))
+		if i >= 0 && i < c.cols && j >= 0 && j < c.rows {
+			dens[j*c.cols+i] += w / cellArea
+		}
+		return
+	}
+	for j := j0; j <= j1; j++ {
+		for i := i0; i <= i1; i++ {
+			dens[j*c.cols+i] += w * vals[(j-j0)*(i1-i0+1)+i-i0] / sum / cellArea
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+func TestNewPointCartogram(t *testing.T) {
+	points := &Points{
+		Points:  []geom.Point{{X: 0, Y: 0}, {X: 3, Y: 0}, {X: 0, Y: 3}, {X: 3, Y: 3}, {X: 1.5, Y: 1.5}},
+		Weights: []float64{1, 1, 1, 1, 20},
+	}
+	for _, k := range []Kernel{GaussianKernel, EpanechnikovKernel, QuarticKernel} {
+		c := NewPointCartogram(points, 1, 25, 25, 0.5, WithKernel(k), WithBackground(FixedDensity(0)))
+
+		// All of the weight is kept within the grid, and the cells
+		// beyond the kernels are raised to the minimum density.
+		var total float64
+		cols, rows := c.Dims()
+		for j := 0; j < rows; j++ {
+			for i := 0; i < cols; i++ {
+				if !(c.Z(i, j) > 0) {
+					t.Errorf("density at (%d, %d) is %g", i, j, c.Z(i, j))
+				}
+				total += c.Z(i, j) * c.dx * c.dy
+			}
+		}
+		if math.Abs(total-24) > 24*minPointDensity+1e-9 {
+			t.Errorf("total weight: have %g, want 24", total)
+		}
+		// The heavy point is at the center of cell (12, 12).
+		if center, corner := c.Z(12, 12), c.Z(0, 0); center <= corner {
+			t.Errorf("density at center %g is not greater than at corner %g", center, corner)
+		}
+
+		// Points far from any point stay finite.
+		if p := c.TransformPoint(geom.Point{X: -0.9, Y: 3.9}); math.IsNaN(p.X) || math.IsNaN(p.Y) || math.IsInf(p.X, 0) || math.IsInf(p.Y, 0) {
+			t.Errorf("point in the corner moved to %v", p)
+		}
+
+		// Points near the center spread out.
+		p := c.TransformPoint(geom.Point{X: 1.5, Y: 1.9})
+		if math.IsNaN(p.X) || math.IsNaN(p.Y) || math.IsInf(p.X, 0) || math.IsInf(p.Y, 0) {
+			t.Errorf("point near center moved to %v", p)
+		} else if p.Y <= 1.9 {
+			t.Errorf("point near center moved from 1.9 to %g, not away from center", p.Y)
+		}
+		c.Destroy()
+	}
+}
+
+func TestNewPointCartogramInvalid(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		points *Points
+	}{
+		{name: "empty", points: &Points{}},
+		{name: "zero weight", points: &Points{Points: []geom.Point{{X: 0, Y: 0}, {X: 1, Y: 1}}, Weights: []float64{0, 0}}},
+		{name: "NaN weight", points: &Points{Points: []geom.Point{{X: 0, Y: 0}}, Weights: []float64{math.NaN()}}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("no panic")
+				}
+			}()
+			NewPointCartogram(test.points, 1, 10, 10, 0.5)
+		})
+	}
+}
+
+func TestAddKernelNarrow(t *testing.T) {
+	c := newGrid(&geom.Bounds{Min: geom.Point{X: 0, Y: 0}, Max: geom.Point{X: 4, Y: 4}}, 4, 4)
+	dens := make([]float64, 16)
+	// The bandwidth is too small to reach any cell center.
+	c.addKernel(dens, geom.Point{X: 2.1, Y: 1.1}, 3, EpanechnikovKernel, 0.01)
+	if dens[1*4+2] != 3 {
+		t.Errorf("narrow kernel: %v", dens)
+	}
+	// Points whose kernel is outside the grid are ignored.
+	c.addKernel(dens, geom.Point{X: 10, Y: 10}, 3, EpanechnikovKernel, 1)
+	var sum float64
+	for _, d := range dens {
+		sum += d
+	}
+	if sum != 3 {
+		t.Errorf("outside point: total weight %g, want 3", sum)
+	}
+}
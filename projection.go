@@ -0,0 +1,158 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/proj"
+)
+
+// LonLatWGS84 is the proj4 definition of longitude and latitude on the
+// WGS84 datum, the spatial reference of GeoJSON.
+const LonLatWGS84 = "+proj=longlat +datum=WGS84"
+
+// IsGeographic returns whether sr is a geographic spatial reference,
+// whose coordinates are longitudes and latitudes in degrees. The planar
+// areas of polygons in such coordinates are not proportional to their
+// true areas, so they must be projected, for example with EqualArea,
+// before being used to create a cartogram or hexagram.
+func IsGeographic(sr *proj.SR) bool {
+	return sr != nil && (sr.Name == "longlat" || sr.Name == "latlong")
+}
+
+// EqualAreaProjection returns an Albers equal-area conic projection,
+// in meters on the WGS84 datum, suited to features within bounds b,
+// whose X and Y coordinates are longitudes and latitudes in degrees.
+// The central meridian and the latitude of origin are at the center of
+// b, and the standard parallels are one sixth of the way in from the
+// southern and northern edges, which keeps shapes undistorted near the
+// middle of b. If b straddles the equator, the parallel farther from
+// the equator is used as the only standard parallel.
+func EqualAreaProjection(b *geom.Bounds) (*proj.SR, error) {
+	def, err := equalAreaDefinition(b)
+	if err != nil {
+		return nil, err
+	}
+	return proj.Parse(def)
+}
+
+// equalAreaDefinition returns the proj4 definition of the
+// EqualAreaProjection for bounds b.
+func equalAreaDefinition(b *geom.Bounds) (string, error) {
+	lat1 := b.Min.Y + (b.Max.Y-b.Min.Y)/6
+	lat2 := b.Max.Y - (b.Max.Y-b.Min.Y)/6
+	if lat1 < 0 && lat2 > 0 {
+		// The standard parallels must not be symmetric about
+		// the equator.
+		if -lat1 > lat2 {
+			lat2 = lat1
+		} else {
+			lat1 = lat2
+		}
+	}
+	if lat1 == 0 && lat2 == 0 {
+		return "", errors.New("tilegram: no equal-area projection for features on the equator with no height")
+	}
+	return fmt.Sprintf("+proj=aea +lat_1=%g +lat_2=%g +lat_0=%g +lon_0=%g +x_0=0 +y_0=0 +datum=WGS84 +units=m +no_defs",
+		lat1, lat2, (b.Min.Y+b.Max.Y)/2, (b.Min.X+b.Max.X)/2), nil
+}
+
+// EqualArea returns the receiver if its spatial reference is not
+// geographic, as reported by IsGeographic, or otherwise a copy of it
+// projected to the EqualAreaProjection for its bounds, so that the
+// areas used by NewCartogram and NewHexagram are proportional to
+// true areas. Use Project on the result, or ProjectTiles on tiles
+// created from it, to transform them back to longitudes and latitudes.
+func (f *Features) EqualArea() (*Features, error) {
+	def, err := f.EqualAreaDefinition()
+	switch {
+	case err != nil:
+		return nil, err
+	case def == "":
+		return f, nil
+	}
+	sr, err := proj.Parse(def)
+	if err != nil {
+		return nil, err
+	}
+	return f.Project(sr)
+}
+
+// EqualAreaDefinition returns the proj4 definition of the projection
+// that EqualArea transforms the receiver to, or an empty string if the
+// receiver's spatial reference is not geographic. It can be stored
+// with a cartogram created from the projected features, such as in its
+// Projection field, so that other features can be projected to match.
+func (f *Features) EqualAreaDefinition() (string, error) {
+	if !IsGeographic(f.SR) {
+		return "", nil
+	}
+	return equalAreaDefinition(marginBounds(f, 0))
+}
+
+// Project returns a copy of the receiver with its polygons transformed
+// from its spatial reference to sr, and with its SR field set to sr.
+// It returns an error if the receiver's spatial reference is not known.
+func (f *Features) Project(sr *proj.SR) (*Features, error) {
+	if f.SR == nil {
+		return nil, errors.New("tilegram: the spatial reference of the features is not known")
+	}
+	t, err := f.SR.NewTransform(sr)
+	if err != nil {
+		return nil, err
+	}
+	o := &Features{
+		Polygons: make([]geom.Polygonal, f.Len()),
+		Weights:  append([]float64(nil), f.Weights...),
+		Groups:   append([]string(nil), f.Groups...),
+		SR:       sr,
+	}
+	for i, p := range f.Polygons {
+		if o.Polygons[i], err = projectPolygonal(p, t); err != nil {
+			return nil, fmt.Errorf("tilegram: projecting feature %d: %v", i, err)
+		}
+	}
+	return o, nil
+}
+
+// ProjectTiles transforms the geometry of tiles, such as those returned
+// by Hexagram.Tiles, in place from spatial reference from to to.
+func ProjectTiles(tiles []Tile, from, to *proj.SR) error {
+	t, err := from.NewTransform(to)
+	if err != nil {
+		return err
+	}
+	for i := range tiles {
+		if tiles[i].Geom, err = projectPolygonal(tiles[i].Geom, t); err != nil {
+			return fmt.Errorf("tilegram: projecting tile %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// projectPolygonal returns p transformed by t, checking that
+// every vertex is finite, which it may not be if p lies outside
+// the domain of a projection.
+func projectPolygonal(p geom.Polygonal, t proj.Transformer) (geom.Polygonal, error) {
+	g, err := p.Transform(t)
+	if err != nil {
+		return nil, err
+	}
+	o := g.(geom.Polygonal)
+	for _, pp := range o.Polygons() {
+		for _, r := range pp {
+			for _, pt := range r {
+				if math.IsNaN(pt.X) || math.IsNaN(pt.Y) || math.IsInf(pt.X, 0) || math.IsInf(pt.Y, 0) {
+					return nil, fmt.Errorf("vertex %v is outside the projection", pt)
+				}
+			}
+		}
+	}
+	return o, nil
+}
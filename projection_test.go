@@ -0,0 +1,97 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/proj"
+)
+
+func TestEqualArea(t *testing.T) {
+	lonLat, err := proj.Parse("+proj=longlat +datum=WGS84")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sq := func(x, y float64) geom.Polygon {
+		return geom.Polygon{{{X: x, Y: y}, {X: x + 1, Y: y}, {X: x + 1, Y: y + 1}, {X: x, Y: y + 1}, {X: x, Y: y}}}
+	}
+	// One-degree squares at the equator and at 60°N.
+	f := &Features{
+		Polygons: []geom.Polygonal{sq(-100, 0), sq(-100, 60)},
+		Weights:  []float64{1, 1},
+		Groups:   []string{"a", "b"},
+		SR:       lonLat,
+	}
+	if !IsGeographic(f.SR) {
+		t.Fatal("longlat is not geographic")
+	}
+	p, err := f.EqualArea()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsGeographic(p.SR) {
+		t.Error("projection is geographic")
+	}
+
+	// A one-degree square at the equator covers about 12,300 km², and
+	// the area of one at 60°N is smaller by the cosine of its latitude.
+	a0, a60 := p.Polygons[0].Area(), p.Polygons[1].Area()
+	if want := 1.23e10; math.Abs(a0-want) > 0.01*want {
+		t.Errorf("equatorial area: have %g, want about %g", a0, want)
+	}
+	if want := math.Cos(60.5*math.Pi/180) / math.Cos(0.5*math.Pi/180); math.Abs(a60/a0-want) > 0.01*want {
+		t.Errorf("area ratio: have %g, want about %g", a60/a0, want)
+	}
+	if d0, d60 := p.Density(0), p.Density(1); d60 <= d0 {
+		t.Errorf("density at 60°N %g is not more than at the equator %g", d60, d0)
+	}
+
+	back, err := p.Project(lonLat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, pg := range back.Polygons {
+		for k, pt := range pg.(geom.Polygon)[0] {
+			want := f.Polygons[i].(geom.Polygon)[0][k]
+			if math.Abs(pt.X-want.X) > 1e-6 || math.Abs(pt.Y-want.Y) > 1e-6 {
+				t.Errorf("polygon %d vertex %d: have %v, want %v", i, k, pt, want)
+			}
+		}
+	}
+
+	tiles := p.Tiles()
+	if err := ProjectTiles(tiles, p.SR, lonLat); err != nil {
+		t.Fatal(err)
+	}
+	if b := tiles[1].Geom.Bounds(); math.Abs(b.Min.Y-60) > 1e-6 || math.Abs(b.Max.X+99) > 1e-6 {
+		t.Errorf("tile bounds: %v", b)
+	}
+
+	// Features that are already projected are unchanged.
+	if q, err := p.EqualArea(); err != nil || q != p {
+		t.Errorf("projected features changed: %v", err)
+	}
+	if _, err := (&Features{}).Project(lonLat); err == nil {
+		t.Error("no error projecting features with no spatial reference")
+	}
+}
+
+func TestEqualAreaProjectionEquator(t *testing.T) {
+	// Standard parallels symmetric about the equator would give a
+	// degenerate cone.
+	sr, err := EqualAreaProjection(&geom.Bounds{Min: geom.Point{X: 10, Y: -6}, Max: geom.Point{X: 12, Y: 6}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sr == nil || IsGeographic(sr) {
+		t.Errorf("have %+v", sr)
+	}
+	if _, err := EqualAreaProjection(&geom.Bounds{Min: geom.Point{X: 10}, Max: geom.Point{X: 12}}); err == nil {
+		t.Error("no error for zero height at the equator")
+	}
+}
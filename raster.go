@@ -0,0 +1,68 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"errors"
+	"math"
+
+	"github.com/ctessum/geom"
+	"gonum.org/v1/gonum/mat"
+)
+
+// NewRasterCartogram creates a cartogram directly from a density grid,
+// such as a gridded population product, instead of from polygons.
+// Row 0 of dens is at the bottom (minimum y) edge of bounds b and
+// column 0 is at the left (minimum x) edge, so that each element holds
+// the density of the grid cell it covers. Because all cells have the
+// same area, the values can equally be counts per cell. Use ReadGeoTIFF
+// to read a density grid from a file.
+//
+// Elements of dens that are NaN are treated as not covered by any input
+// and are assigned the background density set by WithBackground or
+// WithMask, where the average density passed to the Background is the
+// average of the other elements and the minimum density is the lowest
+// positive one. The other options are as for NewCartogram.
+// NewRasterCartogram returns an error if every element of
+// dens is NaN.
+func NewRasterCartogram(dens mat.Matrix, b *geom.Bounds, opts ...Option) (*Cartogram, error) {
+	o := newOptions(opts)
+	rows, cols := dens.Dims()
+	c := newGrid(&geom.Bounds{Min: b.Min, Max: b.Max}, rows, cols)
+
+	var avgDens float64
+	var n int
+	minDens := math.Inf(1)
+	for j := 0; j < rows; j++ {
+		for i := 0; i < cols; i++ {
+			d := dens.At(j, i)
+			if math.IsNaN(d) {
+				continue
+			}
+			avgDens += d
+			n++
+			if d > 0 && d < minDens {
+				minDens = d
+			}
+		}
+	}
+	if n == 0 {
+		return nil, errors.New("tilegram: density grid has no values that are not NaN")
+	}
+	avgDens /= float64(n)
+
+	m, _ := c.backgroundDensity(o, avgDens, minDens)
+	for j := 0; j < rows; j++ {
+		for i := 0; i < cols; i++ {
+			if d := dens.At(j, i); !math.IsNaN(d) {
+				m.Set(j, i, d)
+			}
+		}
+	}
+	blendDensity(m, o.strength)
+	c.dens = m
+	c.diffuse()
+	return c, nil
+}
@@ -0,0 +1,340 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"gonum.org/v1/gonum/mat"
+)
+
+func TestNewRasterCartogram(t *testing.T) {
+	dens := mat.NewDense(20, 30, nil)
+	for j := 0; j < 20; j++ {
+		for i := 0; i < 30; i++ {
+			dens.Set(j, i, 1)
+		}
+	}
+	dens.Set(10, 15, 50)
+	dens.Set(0, 0, math.NaN())
+	b := &geom.Bounds{Min: geom.Point{X: 100, Y: 200}, Max: geom.Point{X: 130, Y: 220}}
+	c, err := NewRasterCartogram(dens, b, WithBackground(FixedDensity(7)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	if cols, rows := c.Dims(); cols != 30 || rows != 20 {
+		t.Errorf("dims: have %d×%d, want 30×20", cols, rows)
+	}
+	if c.X(15) != 115 || c.Y(10) != 210 {
+		t.Errorf("cell (15, 10) is at (%g, %g), want (115, 210)", c.X(15), c.Y(10))
+	}
+	if c.Z(15, 10) != 50 || c.Z(0, 0) != 7 || c.Z(1, 0) != 1 {
+		t.Errorf("densities: have %g, %g, %g; want 50, 7, 1", c.Z(15, 10), c.Z(0, 0), c.Z(1, 0))
+	}
+	// Points near the dense cell move away from it.
+	if p := c.TransformPoint(geom.Point{X: 117.5, Y: 210.5}); p.X <= 117.5 {
+		t.Errorf("point near dense cell moved from 117.5 to %g", p.X)
+	}
+	if b.Min.X != 100 {
+		t.Error("bounds were modified")
+	}
+
+	nan := mat.NewDense(2, 2, []float64{math.NaN(), math.NaN(), math.NaN(), math.NaN()})
+	if _, err := NewRasterCartogram(nan, b); err == nil {
+		t.Error("no error for a grid with no values")
+	}
+}
+
+// testByteOrder is a byte order that can append values to slices.
+type testByteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// testTIFFEntry is a field in a TIFF file written by writeTestTIFF.
+type testTIFFEntry struct {
+	tag, typ uint16
+	data     []byte // Encoded values.
+	count    int
+}
+
+// writeTestTIFF writes a TIFF file with one image file directory
+// holding entries, followed by chunks as the strip or tile data.
+// The offsets of the chunks are written to offsetTag and their
+// lengths to countTag.
+func writeTestTIFF(bo testByteOrder, entries []testTIFFEntry, offsetTag, countTag uint16, chunks [][]byte) []byte {
+	var buf bytes.Buffer
+	if bo == testByteOrder(binary.LittleEndian) {
+		buf.WriteString("II")
+	} else {
+		buf.WriteString("MM")
+	}
+	binary.Write(&buf, bo, uint16(42))
+	binary.Write(&buf, bo, uint32(8))
+
+	var offsets, counts []byte
+	pos := uint32(0)
+	for _, c := range chunks {
+		offsets = bo.AppendUint32(offsets, pos)
+		counts = bo.AppendUint32(counts, uint32(len(c)))
+		pos += uint32(len(c))
+	}
+	entries = append(entries,
+		testTIFFEntry{tag: offsetTag, typ: 4, data: offsets, count: len(chunks)},
+		testTIFFEntry{tag: countTag, typ: 4, data: counts, count: len(chunks)})
+
+	// Field data that don't fit in an entry follow the directory,
+	// and the chunks follow the field data.
+	dataStart := uint32(8 + 2 + 12*len(entries) + 4)
+	chunkStart := dataStart
+	for _, e := range entries {
+		if len(e.data) > 4 {
+			chunkStart += uint32(len(e.data))
+		}
+	}
+	for i := range chunks {
+		bo.PutUint32(offsets[4*i:], bo.Uint32(offsets[4*i:])+chunkStart)
+	}
+
+	binary.Write(&buf, bo, uint16(len(entries)))
+	next := dataStart
+	var extra []byte
+	for _, e := range entries {
+		binary.Write(&buf, bo, e.tag)
+		binary.Write(&buf, bo, e.typ)
+		binary.Write(&buf, bo, uint32(e.count))
+		if len(e.data) > 4 {
+			binary.Write(&buf, bo, next)
+			next += uint32(len(e.data))
+			extra = append(extra, e.data...)
+		} else {
+			v := make([]byte, 4)
+			copy(v, e.data)
+			buf.Write(v)
+		}
+	}
+	binary.Write(&buf, bo, uint32(0))
+	buf.Write(extra)
+	for _, c := range chunks {
+		buf.Write(c)
+	}
+	return buf.Bytes()
+}
+
+// testTIFFShort returns an entry with a single SHORT value.
+func testTIFFShort(bo testByteOrder, tag uint16, v uint16) testTIFFEntry {
+	return testTIFFEntry{tag: tag, typ: 3, data: bo.AppendUint16(nil, v), count: 1}
+}
+
+// testTIFFShorts returns an entry with SHORT values.
+func testTIFFShorts(bo testByteOrder, tag uint16, v ...uint16) testTIFFEntry {
+	var b []byte
+	for _, s := range v {
+		b = bo.AppendUint16(b, s)
+	}
+	return testTIFFEntry{tag: tag, typ: 3, data: b, count: len(v)}
+}
+
+// testTIFFDoubles returns an entry with DOUBLE values.
+func testTIFFDoubles(bo testByteOrder, tag uint16, v ...float64) testTIFFEntry {
+	var b []byte
+	for _, f := range v {
+		b = bo.AppendUint64(b, math.Float64bits(f))
+	}
+	return testTIFFEntry{tag: tag, typ: 12, data: b, count: len(v)}
+}
+
+func TestReadGeoTIFF(t *testing.T) {
+	// The raster is 3 columns by 4 rows, with values 10*row + column
+	// counting from the top-left corner.
+	const width, height = 3, 4
+	georef := func(bo testByteOrder) []testTIFFEntry {
+		return []testTIFFEntry{
+			testTIFFDoubles(bo, geoModelPixelScale, 10, 5, 0),
+			testTIFFDoubles(bo, geoModelTiepoint, 0, 0, 0, 1000, 2000, 0),
+		}
+	}
+	check := func(t *testing.T, tif []byte, noData bool) {
+		m, b, err := ReadGeoTIFF(bytes.NewReader(tif))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := geom.Bounds{Min: geom.Point{X: 1000, Y: 1980}, Max: geom.Point{X: 1030, Y: 2000}}
+		if *b != want {
+			t.Errorf("bounds: have %v, want %v", b, want)
+		}
+		if r, c := m.Dims(); r != height || c != width {
+			t.Fatalf("dims: have %d×%d, want %d×%d", r, c, height, width)
+		}
+		for row := 0; row < height; row++ {
+			for col := 0; col < width; col++ {
+				want := float64(10*row + col)
+				if noData && row == 1 && col == 1 {
+					want = math.NaN()
+				}
+				// Row 0 of the matrix is the bottom of the raster.
+				have := m.At(height-1-row, col)
+				if have != want && !(math.IsNaN(have) && math.IsNaN(want)) {
+					t.Errorf("raster (%d, %d): have %g, want %g", row, col, have, want)
+				}
+			}
+		}
+	}
+
+	t.Run("float32 strips", func(t *testing.T) {
+		bo := binary.LittleEndian
+		var strips [][]byte
+		for row := 0; row < height; row += 3 {
+			var s []byte
+			for r := row; r < row+3 && r < height; r++ {
+				for col := 0; col < width; col++ {
+					s = bo.AppendUint32(s, math.Float32bits(float32(10*r+col)))
+				}
+			}
+			strips = append(strips, s)
+		}
+		noData := []byte("11\x00")
+		entries := append(georef(bo),
+			testTIFFShort(bo, tiffImageWidth, width),
+			testTIFFShort(bo, tiffImageLength, height),
+			testTIFFShort(bo, tiffBitsPerSample, 32),
+			testTIFFShort(bo, tiffSampleFormat, 3),
+			testTIFFShort(bo, tiffRowsPerStrip, 3),
+			testTIFFEntry{tag: gdalNoData, typ: 2, data: noData, count: len(noData)},
+		)
+		check(t, writeTestTIFF(bo, entries, tiffStripOffsets, tiffStripByteCounts, strips), true)
+	})
+
+	t.Run("deflate uint16 tiles", func(t *testing.T) {
+		bo := binary.BigEndian
+		const tile = 2
+		var tiles [][]byte
+		for ty := 0; ty < height; ty += tile {
+			for tx := 0; tx < width; tx += tile {
+				var raw []byte
+				for r := ty; r < ty+tile; r++ {
+					prev := uint16(0)
+					for c := tx; c < tx+tile; c++ {
+						v := uint16(10*r + c)
+						if c >= width {
+							v = 0 // Padding.
+						}
+						// Horizontal differencing predictor.
+						raw = bo.AppendUint16(raw, v-prev)
+						prev = v
+					}
+				}
+				var z bytes.Buffer
+				zw := zlib.NewWriter(&z)
+				zw.Write(raw)
+				zw.Close()
+				tiles = append(tiles, z.Bytes())
+			}
+		}
+		entries := append(georef(bo),
+			testTIFFShort(bo, tiffImageWidth, width),
+			testTIFFShort(bo, tiffImageLength, height),
+			testTIFFShort(bo, tiffBitsPerSample, 16),
+			testTIFFShort(bo, tiffCompression, tiffCompressionFlate),
+			testTIFFShort(bo, tiffPredictor, 2),
+			testTIFFShort(bo, tiffTileWidth, tile),
+			testTIFFShort(bo, tiffTileLength, tile),
+		)
+		check(t, writeTestTIFF(bo, entries, tiffTileOffsets, tiffTileByteCounts, tiles), false)
+	})
+
+	t.Run("raster type", func(t *testing.T) {
+		bo := binary.LittleEndian
+		strip := make([]byte, width*height)
+		for _, test := range []struct {
+			name string
+			typ  uint16
+			want *geom.Bounds
+		}{
+			{name: "area", typ: rasterPixelIsArea, want: &geom.Bounds{Min: geom.Point{X: 1000, Y: 1980}, Max: geom.Point{X: 1030, Y: 2000}}},
+			// The tie point is the center of the top-left pixel.
+			{name: "point", typ: rasterPixelIsPoint, want: &geom.Bounds{Min: geom.Point{X: 995, Y: 1982.5}, Max: geom.Point{X: 1025, Y: 2002.5}}},
+			{name: "unknown", typ: 3},
+		} {
+			t.Run(test.name, func(t *testing.T) {
+				entries := append(georef(bo),
+					testTIFFShort(bo, tiffImageWidth, width),
+					testTIFFShort(bo, tiffImageLength, height),
+					testTIFFShort(bo, tiffBitsPerSample, 8),
+					// Version 1.1.0 with two keys, GTModelTypeGeoKey
+					// and GTRasterTypeGeoKey.
+					testTIFFShorts(bo, geoKeyDirectory, 1, 1, 0, 2, 1024, 0, 1, 1, gtRasterTypeGeoKey, 0, 1, test.typ),
+				)
+				_, b, err := ReadGeoTIFF(bytes.NewReader(writeTestTIFF(bo, entries, tiffStripOffsets, tiffStripByteCounts, [][]byte{strip})))
+				switch {
+				case test.want == nil:
+					if err == nil {
+						t.Error("no error")
+					}
+				case err != nil:
+					t.Fatal(err)
+				case *b != *test.want:
+					t.Errorf("bounds: have %v, want %v", b, test.want)
+				}
+			})
+		}
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		bo := binary.LittleEndian
+		long := func(tag uint16, v uint32) testTIFFEntry {
+			return testTIFFEntry{tag: tag, typ: 4, data: bo.AppendUint32(nil, v), count: 1}
+		}
+		for name, entries := range map[string][]testTIFFEntry{
+			// The field claims far more values than the file holds.
+			"field count": {
+				testTIFFShort(bo, tiffImageWidth, 1),
+				{tag: geoModelPixelScale, typ: 12, data: make([]byte, 16), count: 1 << 28},
+			},
+			"strip byte count": append(georef(bo),
+				testTIFFShort(bo, tiffImageWidth, 1),
+				testTIFFShort(bo, tiffImageLength, 1),
+				testTIFFShort(bo, tiffBitsPerSample, 8),
+				long(tiffStripOffsets, 8),
+				long(tiffStripByteCounts, 0xfffffff0)),
+			"strip offset": append(georef(bo),
+				testTIFFShort(bo, tiffImageWidth, 1),
+				testTIFFShort(bo, tiffImageLength, 1),
+				testTIFFShort(bo, tiffBitsPerSample, 8),
+				long(tiffStripOffsets, 0xfffffff0),
+				long(tiffStripByteCounts, 1)),
+			"dimensions": append(georef(bo),
+				long(tiffImageWidth, 0xffffffff),
+				long(tiffImageLength, 0xffffffff),
+				testTIFFShort(bo, tiffBitsPerSample, 8)),
+		} {
+			// The chunk tags are unused, so the entries above are read.
+			tif := writeTestTIFF(bo, entries, 65000, 65001, [][]byte{{1}})
+			if _, _, err := ReadGeoTIFF(bytes.NewReader(tif)); err == nil {
+				t.Errorf("%s: no error", name)
+			}
+		}
+	})
+
+	t.Run("not georeferenced", func(t *testing.T) {
+		bo := binary.LittleEndian
+		entries := []testTIFFEntry{
+			testTIFFShort(bo, tiffImageWidth, 1),
+			testTIFFShort(bo, tiffImageLength, 1),
+			testTIFFShort(bo, tiffBitsPerSample, 8),
+		}
+		tif := writeTestTIFF(bo, entries, tiffStripOffsets, tiffStripByteCounts, [][]byte{{1}})
+		if _, _, err := ReadGeoTIFF(bytes.NewReader(tif)); err == nil {
+			t.Error("no error")
+		}
+	})
+}
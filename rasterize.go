@@ -0,0 +1,274 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"math"
+	"runtime"
+	"sync"
+
+	"github.com/ctessum/geom"
+	"gonum.org/v1/gonum/mat"
+)
+
+// coverage holds the fraction of each cell in a block of grid cells
+// that is covered by a polygon.
+type coverage struct {
+	// i0 and j0 are the column and row of the first cell in the block,
+	// and w and h are the numbers of columns and rows in it.
+	i0, j0, w, h int
+
+	// frac holds the covered fraction of each cell in the block,
+	// by row.
+	frac []float64
+}
+
+// addCoverage adds v to the cells of density grid m in proportion
+// to the fraction of each cell covered by p.
+func (c *Cartogram) addCoverage(m *mat.Dense, p geom.Polygonal, v float64) {
+	c.rasterize(p).addTo(m, v)
+}
+
+// addShapes adds the density of each of shapes, minus the background
+// density, to the cells of density grid m in proportion to the fraction
+// of each cell covered by the shape. Shapes are rasterized in parallel,
+// but their contributions are added in order so that the results do
+// not depend on scheduling. No more shapes are rasterized ahead of the
+// one being added than there are workers, so that the coverage of
+// only that many shapes is held at once.
+func (c *Cartogram) addShapes(m *mat.Dense, shapes PolygonDensity, background float64) {
+	n := shapes.Len()
+	covers := make([]*coverage, n)
+	done := make([]chan struct{}, n)
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	workers := runtime.GOMAXPROCS(0)
+	window := make(chan struct{}, workers)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				covers[i] = c.rasterize(shapes.Polygon(i))
+				close(done[i])
+			}
+		}()
+	}
+	go func() {
+		for i := 0; i < n; i++ {
+			window <- struct{}{}
+			next <- i
+		}
+		close(next)
+	}()
+	for i := 0; i < n; i++ {
+		<-done[i]
+		covers[i].addTo(m, shapes.Density(i)-background)
+		covers[i] = nil
+		<-window
+	}
+	wg.Wait()
+}
+
+// addTo adds v to the cells of m in proportion to the
+// fraction of each cell covered.
+func (cv *coverage) addTo(m *mat.Dense, v float64) {
+	for j := 0; j < cv.h; j++ {
+		for i := 0; i < cv.w; i++ {
+			if f := cv.frac[j*cv.w+i]; f != 0 {
+				m.Set(cv.j0+j, cv.i0+i, m.At(cv.j0+j, cv.i0+i)+v*f)
+			}
+		}
+	}
+}
+
+// rasterize calculates the exact fraction of each grid cell
+// that is covered by p. Within each polygon in p, rings that are
+// inside an odd number of other rings are treated as holes.
+//
+// Each edge of p is split where it crosses grid lines, and each piece
+// adds its signed height to the cells to its right, in proportion to
+// how much of its cell is to its right. Summing these contributions
+// along each row gives the area covered in each cell.
+func (c *Cartogram) rasterize(p geom.Polygonal) *coverage {
+	b := p.Bounds()
+	toGridX := func(x float64) float64 { return (x - c.b.Min.X) / c.dx }
+	toGridY := func(y float64) float64 { return (y - c.b.Min.Y) / c.dy }
+	clamp := func(v float64, max int) int { return int(math.Max(0, math.Min(float64(max), v))) }
+	cv := &coverage{
+		i0: clamp(math.Floor(toGridX(b.Min.X)), c.cols),
+		j0: clamp(math.Floor(toGridY(b.Min.Y)), c.rows),
+	}
+	cv.w = clamp(math.Ceil(toGridX(b.Max.X)), c.cols) - cv.i0
+	cv.h = clamp(math.Ceil(toGridY(b.Max.Y)), c.rows) - cv.j0
+	if cv.w <= 0 || cv.h <= 0 {
+		return cv
+	}
+	r := &rasterizer{
+		coverage: cv,
+		cols:     float64(c.cols),
+		stride:   cv.w + 2,
+		acc:      make([]float64, (cv.w+2)*cv.h),
+	}
+	for _, poly := range p.Polygons() {
+		bounds := make([]*geom.Bounds, len(poly))
+		for k, ring := range poly {
+			bounds[k] = geom.NewBounds()
+			for _, pt := range ring {
+				bounds[k].Extend(pt.Bounds())
+			}
+		}
+		for k, ring := range poly {
+			if len(ring) < 3 {
+				continue
+			}
+			// Rings are normalized so that each contributes positively
+			// to the area it encloses, and holes negatively.
+			f := -1.0
+			if ringArea(ring) < 0 {
+				f = 1
+			}
+			for kk, other := range poly {
+				if kk != k && len(other) >= 3 && bounds[kk].Overlaps(bounds[k]) && ringInRing(ring, other) {
+					f = -f
+				}
+			}
+			prev := ring[len(ring)-1]
+			for _, pt := range ring {
+				r.addEdge(toGridX(prev.X), toGridY(prev.Y), toGridX(pt.X), toGridY(pt.Y), f)
+				prev = pt
+			}
+		}
+	}
+
+	cv.frac = make([]float64, cv.w*cv.h)
+	for j := 0; j < cv.h; j++ {
+		var sum float64
+		for i := 0; i < cv.w; i++ {
+			sum += r.acc[j*r.stride+i]
+			cv.frac[j*cv.w+i] = sum
+		}
+	}
+	return cv
+}
+
+// rasterizer accumulates the contributions of polygon
+// edges to a coverage.
+type rasterizer struct {
+	*coverage
+
+	// cols is the number of columns in the whole grid.
+	cols float64
+
+	// acc holds the contributions of edge pieces to each cell,
+	// by row, with stride elements per row.
+	acc    []float64
+	stride int
+}
+
+// addEdge adds the edge from (x0, y0) to (x1, y1), in grid units,
+// scaled by f.
+func (r *rasterizer) addEdge(x0, y0, x1, y1, f float64) {
+	if y0 == y1 {
+		return
+	}
+	if y0 > y1 {
+		x0, y0, x1, y1 = x1, y1, x0, y0
+		f = -f
+	}
+	slope := (x1 - x0) / (y1 - y0)
+	row0 := math.Max(math.Floor(y0), float64(r.j0))
+	row1 := math.Min(math.Ceil(y1), float64(r.j0+r.h))
+	for row := row0; row < row1; row++ {
+		ya, yb := math.Max(y0, row), math.Min(y1, row+1)
+		if yb <= ya {
+			continue
+		}
+		r.addRowSegment(int(row), x0+(ya-y0)*slope, ya, x0+(yb-y0)*slope, yb, f)
+	}
+}
+
+// addRowSegment adds a segment that lies within a single row,
+// splitting it where it crosses column boundaries.
+func (r *rasterizer) addRowSegment(row int, xa, ya, xb, yb, f float64) {
+	px, py := xa, ya
+	switch {
+	case xb > xa:
+		k := math.Max(math.Floor(xa)+1, 0)
+		for ; k < xb && k <= r.cols; k++ {
+			y := ya + (k-xa)*(yb-ya)/(xb-xa)
+			r.addPiece(row, (px+k)/2, y-py, f)
+			px, py = k, y
+		}
+	case xb < xa:
+		k := math.Min(math.Ceil(xa)-1, r.cols)
+		for ; k > xb && k >= 0; k-- {
+			y := ya + (k-xa)*(yb-ya)/(xb-xa)
+			r.addPiece(row, (px+k)/2, y-py, f)
+			px, py = k, y
+		}
+	}
+	r.addPiece(row, (px+xb)/2, yb-py, f)
+}
+
+// addPiece adds a piece of an edge with height dy, scaled by f, whose
+// horizontal midpoint xm lies within a single column. Pieces to the
+// left of the grid cover whole cells, and pieces to the
+// right of it cover none.
+func (r *rasterizer) addPiece(row int, xm, dy, f float64) {
+	if xm >= r.cols {
+		return
+	}
+	xm = math.Max(xm, 0)
+	i := math.Floor(xm)
+	frac := xm - i
+	k := (row-r.j0)*r.stride + int(i) - r.i0
+	r.acc[k] += f * dy * (1 - frac)
+	r.acc[k+1] += f * dy * frac
+}
+
+// ringArea returns the signed area of ring r, which is positive
+// if r is counter-clockwise.
+func ringArea(r geom.Path) float64 {
+	var a float64
+	prev := r[len(r)-1]
+	for _, p := range r {
+		a += prev.X*p.Y - p.X*prev.Y
+		prev = p
+	}
+	return a / 2
+}
+
+// ringInRing returns whether ring r is inside ring other, which
+// it may touch. It checks the first vertex of r that is not also
+// a vertex of other.
+func ringInRing(r, other geom.Path) bool {
+	vertices := make(map[geom.Point]bool, len(other))
+	for _, p := range other {
+		vertices[p] = true
+	}
+	for _, p := range r {
+		if !vertices[p] {
+			return pointInRing(p, other)
+		}
+	}
+	return false
+}
+
+// pointInRing returns whether p is inside ring r.
+func pointInRing(p geom.Point, r geom.Path) bool {
+	in := false
+	prev := r[len(r)-1]
+	for _, q := range r {
+		if (q.Y > p.Y) != (prev.Y > p.Y) && p.X < (prev.X-q.X)*(p.Y-q.Y)/(prev.Y-q.Y)+q.X {
+			in = !in
+		}
+		prev = q
+	}
+	return in
+}
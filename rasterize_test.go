@@ -0,0 +1,177 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"math"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"gonum.org/v1/gonum/mat"
+)
+
+func TestRasterize(t *testing.T) {
+	// The grid has 10×8 unit cells starting at (-2, -1).
+	c := newGrid(&geom.Bounds{Min: geom.Point{X: -2, Y: -1}, Max: geom.Point{X: 8, Y: 7}}, 8, 10)
+	square := func(x0, y0, x1, y1 float64) geom.Path {
+		return geom.Path{{X: x0, Y: y0}, {X: x1, Y: y0}, {X: x1, Y: y1}, {X: x0, Y: y1}}
+	}
+	reverse := func(p geom.Path) geom.Path {
+		o := make(geom.Path, len(p))
+		for i, pt := range p {
+			o[len(p)-1-i] = pt
+		}
+		return o
+	}
+	for _, test := range []struct {
+		name string
+		p    geom.Polygonal
+	}{
+		{name: "square", p: geom.Polygon{square(0.25, 0.5, 2.75, 1.5)}},
+		{name: "clockwise", p: geom.Polygon{reverse(square(0.25, 0.5, 2.75, 1.5))}},
+		{name: "triangle", p: geom.Polygon{{{X: 0.1, Y: 0.2}, {X: 5.3, Y: 1.1}, {X: 2.2, Y: 4.9}}}},
+		{name: "hole", p: geom.Polygon{square(-0.5, -0.5, 4.5, 4.5), square(1.2, 1.3, 2.7, 2.9)}},
+		{name: "hole same direction", p: geom.Polygon{square(-0.5, -0.5, 4.5, 4.5), reverse(square(1.2, 1.3, 2.7, 2.9))}},
+		{name: "touching rings", p: geom.Polygon{square(0, 0, 1.5, 1.5), square(1.5, 1.5, 3.2, 2.5)}},
+		{name: "closed ring", p: geom.Polygon{append(square(1, 1, 3.5, 2), geom.Point{X: 1, Y: 1})}},
+		{name: "outside grid", p: geom.Polygon{{{X: -5, Y: -4}, {X: 12, Y: 2.5}, {X: 3, Y: 11}}}},
+		{name: "multipolygon", p: geom.MultiPolygon{{square(0, 0, 1.5, 1.5)}, {square(3.1, 3.2, 6.6, 5.9)}}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cv := c.rasterize(test.p)
+			// Compare with the fraction of sample points in
+			// each cell that are in the polygon.
+			const n = 40
+			for j := 0; j < c.rows; j++ {
+				for i := 0; i < c.cols; i++ {
+					var in int
+					for sy := 0; sy < n; sy++ {
+						for sx := 0; sx < n; sx++ {
+							p := geom.Point{X: c.X(i) + (float64(sx)+0.5)/n, Y: c.Y(j) + (float64(sy)+0.5)/n}
+							if testPointInPolygonal(p, test.p) {
+								in++
+							}
+						}
+					}
+					want := float64(in) / (n * n)
+					var have float64
+					if i >= cv.i0 && i < cv.i0+cv.w && j >= cv.j0 && j < cv.j0+cv.h {
+						have = cv.frac[(j-cv.j0)*cv.w+i-cv.i0]
+					}
+					if math.Abs(have-want) > 0.03 {
+						t.Errorf("cell (%d, %d): have %.3f, want %.3f", i, j, have, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRasterizeExact(t *testing.T) {
+	c := newGrid(&geom.Bounds{Min: geom.Point{X: 0, Y: 0}, Max: geom.Point{X: 4, Y: 4}}, 4, 4)
+	// A triangle covering half of cell (1, 1).
+	cv := c.rasterize(geom.Polygon{{{X: 1, Y: 1}, {X: 2, Y: 1}, {X: 2, Y: 2}}})
+	if cv.w != 1 || cv.h != 1 || math.Abs(cv.frac[0]-0.5) > 1e-12 {
+		t.Errorf("triangle: %+v", cv)
+	}
+	// Coverage of a polygon inside the grid sums to its area.
+	p := geom.Polygon{{{X: 0.3, Y: 0.1}, {X: 3.7, Y: 0.9}, {X: 2.9, Y: 3.95}, {X: 1.1, Y: 2.2}}}
+	var sum float64
+	for _, f := range c.rasterize(p).frac {
+		sum += f
+	}
+	if want := math.Abs(ringArea(p[0])); math.Abs(sum-want) > 1e-12 {
+		t.Errorf("total coverage: have %g, want %g", sum, want)
+	}
+}
+
+// testPointInPolygonal returns whether p is in polygon g,
+// treating rings within an odd number of other rings as holes.
+func testPointInPolygonal(p geom.Point, g geom.Polygonal) bool {
+	for _, poly := range g.Polygons() {
+		var in bool
+		for _, r := range poly {
+			if pointInRing(p, r) {
+				in = !in
+			}
+		}
+		if in {
+			return true
+		}
+	}
+	return false
+}
+
+// countingShapes counts the shapes whose polygons have been read
+// but whose densities have not.
+type countingShapes struct {
+	*Features
+	mu            sync.Mutex
+	pending, max  int
+	densityCalled int
+}
+
+func (s *countingShapes) Polygon(i int) geom.Polygonal {
+	s.mu.Lock()
+	s.pending++
+	if s.pending > s.max {
+		s.max = s.pending
+	}
+	s.mu.Unlock()
+	return s.Features.Polygon(i)
+}
+
+func (s *countingShapes) Density(i int) float64 {
+	s.mu.Lock()
+	s.pending--
+	s.densityCalled++
+	s.mu.Unlock()
+	return s.Features.Density(i)
+}
+
+func TestAddShapesLookahead(t *testing.T) {
+	f := &Features{}
+	for i := 0; i < 1000; i++ {
+		x := float64(i % 40)
+		y := float64(i / 40)
+		f.Polygons = append(f.Polygons, geom.Polygon{{{X: x, Y: y}, {X: x + 1, Y: y}, {X: x + 1, Y: y + 1}, {X: x, Y: y + 1}}})
+		f.Weights = append(f.Weights, 1)
+		f.Groups = append(f.Groups, "")
+	}
+	c := newGrid(marginBounds(f, 0), 25, 40)
+	m := mat.NewDense(25, 40, nil)
+	s := &countingShapes{Features: f}
+	c.addShapes(m, s, 0)
+	if s.densityCalled != 1000 {
+		t.Errorf("added %d shapes, want 1000", s.densityCalled)
+	}
+	if workers := runtime.GOMAXPROCS(0); s.max > workers {
+		t.Errorf("%d shapes were rasterized ahead of the one being added, want at most %d", s.max, workers)
+	}
+	for j := 0; j < 25; j++ {
+		for i := 0; i < 40; i++ {
+			if math.Abs(m.At(j, i)-1) > 1e-12 {
+				t.Fatalf("density at (%d, %d): have %g, want 1", i, j, m.At(j, i))
+			}
+		}
+	}
+}
+
+func BenchmarkDensityGrid(b *testing.B) {
+	f, err := ReadShapefile("testdata/WA_Population_2010.shp", "population", "county")
+	if err != nil {
+		b.Fatal(err)
+	}
+	o := newOptions(nil)
+	avg, min := densityStats(f)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c := newGrid(marginBounds(f, 0), 512, 1024)
+		m, background := c.backgroundDensity(o, avg, min)
+		c.addShapes(m, f, background)
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"math"
+	"runtime"
+	"sync"
+
+	"github.com/ctessum/geom"
+)
+
+// RubberSheet is a contiguous cartogram created by moving polygon
+// vertices directly, instead of by diffusion on a grid. It needs no
+// grid, so it is fast for coarse datasets with few polygons, such as
+// the states of a country, and it can be used to check the accuracy of
+// a diffusion Cartogram. The time taken by each iteration is
+// proportional to the number of polygons times the number of vertices.
+type RubberSheet struct {
+	steps []rubberSheetStep
+}
+
+// rubberSheetStep holds the forces applied in
+// one rubber-sheet iteration.
+type rubberSheetStep struct {
+	// centroids, radii and masses hold the centroid of each polygon,
+	// the radius of a circle with its current area, and the difference
+	// between the radii of circles with its desired and current areas.
+	centroids []geom.Point
+	radii     []float64
+	masses    []float64
+
+	// reduction is the force reduction factor, which damps the forces
+	// when the areas are far from their desired values.
+	reduction float64
+}
+
+// NewRubberSheet creates a cartogram from shapes using the algorithm
+// described in the article below. It makes at most the given number of
+// iterations, stopping early when the mean, across shapes, of the ratio
+// of the larger to the smaller of each shape's area and desired area is
+// at most 1+tolerance. The desired area of each shape is its share of the
+// total area in proportion to its density times its area, which must be
+// positive.
+//
+// Dougenik, J. A., Chrisman, N. R., & Niemeyer, D. R. (1985). An
+// algorithm to construct continuous area cartograms. The Professional
+// Geographer, 37(1), 75–81. http://doi.org/10.1111/j.0033-0124.1985.00075.x
+func NewRubberSheet(shapes PolygonDensity, iterations int, tolerance float64) *RubberSheet {
+	n := shapes.Len()
+	polys := make([][]geom.Polygon, n)
+	values := make([]float64, n)
+	var totalValue float64
+	for i := range polys {
+		for _, p := range shapes.Polygon(i).Polygons() {
+			pp := make(geom.Polygon, len(p))
+			for j, r := range p {
+				pp[j] = append(geom.Path(nil), r...)
+			}
+			polys[i] = append(polys[i], pp)
+		}
+		a, _ := polygonMoments(polys[i])
+		values[i] = shapes.Density(i) * a
+		totalValue += values[i]
+	}
+
+	r := new(RubberSheet)
+	for it := 0; it < iterations; it++ {
+		s := rubberSheetStep{
+			centroids: make([]geom.Point, n),
+			radii:     make([]float64, n),
+			masses:    make([]float64, n),
+		}
+		areas := make([]float64, n)
+		var totalArea float64
+		for i, p := range polys {
+			areas[i], s.centroids[i] = polygonMoments(p)
+			totalArea += areas[i]
+		}
+		var sizeError float64
+		for i, a := range areas {
+			desired := totalArea * values[i] / totalValue
+			s.radii[i] = math.Sqrt(a / math.Pi)
+			s.masses[i] = math.Sqrt(desired/math.Pi) - s.radii[i]
+			sizeError += math.Max(a, desired) / math.Min(a, desired)
+		}
+		sizeError /= float64(n)
+		if sizeError <= 1+tolerance {
+			break
+		}
+		s.reduction = 1 / (1 + sizeError)
+		r.steps = append(r.steps, s)
+
+		var paths []geom.Path
+		for _, p := range polys {
+			for _, pp := range p {
+				paths = append(paths, pp...)
+			}
+		}
+		parallelPoints(paths, s.apply)
+	}
+	return r
+}
+
+// Iterations returns the number of iterations made
+// to create the receiver.
+func (r *RubberSheet) Iterations() int { return len(r.steps) }
+
+// apply moves p in place by the forces of the receiver.
+func (s *rubberSheetStep) apply(p geom.Path) {
+	for k, pt := range p {
+		var dx, dy float64
+		for i, c := range s.centroids {
+			d := math.Hypot(pt.X-c.X, pt.Y-c.Y)
+			if d == 0 || s.radii[i] == 0 {
+				continue
+			}
+			var f float64
+			if d > s.radii[i] {
+				f = s.masses[i] * s.radii[i] / d
+			} else {
+				q := d / s.radii[i]
+				f = s.masses[i] * q * q * (4 - 3*q)
+			}
+			dx += f * (pt.X - c.X) / d
+			dy += f * (pt.Y - c.Y) / d
+		}
+		p[k] = geom.Point{X: pt.X + s.reduction*dx, Y: pt.Y + s.reduction*dy}
+	}
+}
+
+// parallelPoints calls f in parallel on pieces of paths, which
+// it may modify in place.
+func parallelPoints(paths []geom.Path, f func(geom.Path)) {
+	var wg sync.WaitGroup
+	next := make(chan geom.Path)
+	for w := 0; w < runtime.GOMAXPROCS(0); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range next {
+				f(p)
+			}
+		}()
+	}
+	const chunk = 256
+	for _, p := range paths {
+		for len(p) > 0 {
+			n := len(p)
+			if n > chunk {
+				n = chunk
+			}
+			next <- p[:n]
+			p = p[n:]
+		}
+	}
+	close(next)
+	wg.Wait()
+}
+
+// TransformPoint moves a point to match the cartogram.
+func (r *RubberSheet) TransformPoint(p geom.Point) geom.Point {
+	return r.TransformPath(geom.Path{p})[0]
+}
+
+// TransformPath moves the vertices of a path to match the cartogram.
+func (r *RubberSheet) TransformPath(p geom.Path) geom.Path {
+	return r.transformPaths([]geom.Path{p}, nil)[0]
+}
+
+// TransformPolygons moves the vertices of polygons
+// to match the cartogram.
+func (r *RubberSheet) TransformPolygons(p []geom.Polygon) []geom.Polygon {
+	var rings []geom.Path
+	for _, poly := range p {
+		rings = append(rings, poly...)
+	}
+	rings = r.transformPaths(rings, nil)
+	o := make([]geom.Polygon, len(p))
+	var k int
+	for i, poly := range p {
+		o[i] = make(geom.Polygon, len(poly))
+		k += copy(o[i], rings[k:k+len(poly)])
+	}
+	return o
+}
+
+// Transform returns g transformed to match the cartogram, as
+// for Cartogram.Transform.
+func (r *RubberSheet) Transform(g geom.Geom) geom.Geom {
+	return r.TransformGeoms([]geom.Geom{g})[0]
+}
+
+// TransformGeoms is like Transform, but for multiple geometries.
+func (r *RubberSheet) TransformGeoms(g []geom.Geom) []geom.Geom {
+	return transformGeoms(g, r.transformPaths)
+}
+
+// transformPaths returns transformed copies of paths. Each point is
+// transformed independently, so the rings of polygons need no special
+// treatment and polygon is ignored.
+func (r *RubberSheet) transformPaths(paths []geom.Path, polygon []int) []geom.Path {
+	o := make([]geom.Path, len(paths))
+	for i, p := range paths {
+		o[i] = append(geom.Path(nil), p...)
+	}
+	for k := range r.steps {
+		parallelPoints(o, r.steps[k].apply)
+	}
+	return o
+}
+
+// polygonMoments returns the area and centroid of the polygons
+// in p. Within each polygon, rings that are inside an odd number
+// of other rings are treated as holes.
+func polygonMoments(p []geom.Polygon) (area float64, centroid geom.Point) {
+	var cx, cy float64
+	for _, poly := range p {
+		for k, ring := range poly {
+			if len(ring) < 3 {
+				continue
+			}
+			f := 1.0
+			for kk, other := range poly {
+				if kk != k && len(other) >= 3 && ringInRing(ring, other) {
+					f = -f
+				}
+			}
+			var a, x, y float64
+			prev := ring[len(ring)-1]
+			for _, pt := range ring {
+				cross := prev.X*pt.Y - pt.X*prev.Y
+				a += cross
+				x += (prev.X + pt.X) * cross
+				y += (prev.Y + pt.Y) * cross
+				prev = pt
+			}
+			// a is twice the signed area of the ring, and x/(3a) and
+			// y/(3a) are the coordinates of its centroid.
+			if a < 0 {
+				a, x, y = -a, -x, -y
+			}
+			area += f * a / 2
+			cx += f * x / 6
+			cy += f * y / 6
+		}
+	}
+	if area == 0 {
+		return 0, geom.Point{}
+	}
+	return area, geom.Point{X: cx / area, Y: cy / area}
+}
@@ -0,0 +1,72 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+func TestNewRubberSheet(t *testing.T) {
+	f := testDensity()
+	// meanSizeError returns the mean ratio of the larger to the smaller
+	// of each feature's area and desired area.
+	meanSizeError := func(f *Features) float64 {
+		var totalArea, totalWeight, e float64
+		for i, p := range f.Polygons {
+			totalArea += p.Area()
+			totalWeight += f.Weights[i]
+		}
+		for i, p := range f.Polygons {
+			a, desired := p.Area(), totalArea*f.Weights[i]/totalWeight
+			e += math.Max(a, desired) / math.Min(a, desired)
+		}
+		return e / float64(f.Len())
+	}
+	before := meanSizeError(f)
+
+	r := NewRubberSheet(f, 50, 0.01)
+	if r.Iterations() == 0 || r.Iterations() > 50 {
+		t.Fatalf("iterations: have %d, want 1–50", r.Iterations())
+	}
+	carto := f.Transform(r)
+	if e := meanSizeError(carto); e > 1.05 || e >= before {
+		t.Errorf("mean size error: have %g, was %g", e, before)
+	}
+
+	// The center square shares its corners with its neighbors.
+	center := carto.Polygons[0].(geom.Polygon)[0]
+	left := carto.Polygons[1].(geom.Polygon)[0]
+	if center[0] != left[1] || center[3] != left[2] {
+		t.Errorf("shared vertices differ: %v and %v", center, left)
+	}
+	if p := r.TransformPoint(geom.Point{X: 1, Y: 1}); p != center[0] {
+		t.Errorf("TransformPoint: have %v, want %v", p, center[0])
+	}
+
+	if r := NewRubberSheet(f, 50, before); r.Iterations() != 0 {
+		t.Errorf("iterations within tolerance: have %d, want 0", r.Iterations())
+	}
+}
+
+func TestPolygonMoments(t *testing.T) {
+	// A 4×4 square, with a 2×2 hole whose ring has the same orientation,
+	// and a separate 1×1 square.
+	p := []geom.Polygon{
+		{
+			{{X: 0, Y: 0}, {X: 4, Y: 0}, {X: 4, Y: 4}, {X: 0, Y: 4}},
+			{{X: 2, Y: 1}, {X: 4, Y: 1}, {X: 4, Y: 3}, {X: 2, Y: 3}},
+		},
+		{{{X: 5, Y: 0}, {X: 5, Y: 1}, {X: 6, Y: 1}, {X: 6, Y: 0}}},
+	}
+	area, c := polygonMoments(p)
+	// The moments are 16×(2, 2) - 4×(3, 2) + 1×(5.5, 0.5).
+	want := geom.Point{X: (32 - 12 + 5.5) / 13, Y: (32 - 8 + 0.5) / 13}
+	if area != 13 || math.Abs(c.X-want.X) > 1e-12 || math.Abs(c.Y-want.Y) > 1e-12 {
+		t.Errorf("have area %g, centroid %v; want 13, %v", area, c, want)
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/index/rtree"
+)
+
+// A TopologyError describes two segments of polygon rings that cross
+// each other, or a vertex of a polygon that is inside another polygon.
+type TopologyError struct {
+	// Polygon and Ring are the indices of the polygon and of the ring
+	// within it that hold the first segment, and Vertex is the index
+	// of the vertex at its start. If Inside is true, Vertex is inside
+	// OtherPolygon.
+	Polygon, Ring, Vertex int
+	Inside                bool
+
+	// OtherPolygon, OtherRing and OtherVertex identify the second
+	// segment or, if Inside is true, the segment of OtherPolygon
+	// nearest to the vertex.
+	OtherPolygon, OtherRing, OtherVertex int
+
+	// Point is where the segments cross, or the vertex.
+	Point geom.Point
+}
+
+// Overlap returns whether the error involves different polygons,
+// so that they overlap. Otherwise, the polygon is invalid because a
+// ring intersects itself or another ring of the same polygon.
+func (e TopologyError) Overlap() bool { return e.Polygon != e.OtherPolygon }
+
+func (e TopologyError) Error() string {
+	if e.Overlap() {
+		return fmt.Sprintf("tilegram: polygons %d and %d overlap at %v", e.Polygon, e.OtherPolygon, e.Point)
+	}
+	return fmt.Sprintf("tilegram: polygon %d intersects itself at %v", e.Polygon, e.Point)
+}
+
+// ValidatePolygons checks that polygons p form a valid planar
+// partition, as they should after they are transformed by a cartogram,
+// and returns the segments of their rings that cross and the vertices
+// that are inside other polygons. Because points are transformed
+// independently, small polygons can become self-intersecting and
+// neighboring polygons can overlap where the input vertices along
+// their borders are not shared. Segments that touch without crossing
+// are not reported, and neither are vertices that are shared
+// with the polygon they are in.
+func ValidatePolygons(p []geom.Polygon) []TopologyError {
+	var rings []geom.Path
+	var polys, ringIdx []int
+	for i, poly := range p {
+		for j, ring := range poly {
+			rings = append(rings, ring)
+			polys = append(polys, i)
+			ringIdx = append(ringIdx, j)
+		}
+	}
+	var errs []TopologyError
+	for _, x := range topologyErrors(rings, polys) {
+		errs = append(errs, TopologyError{
+			Polygon: polys[x.ring], Ring: ringIdx[x.ring], Vertex: x.vertex, Inside: x.inside,
+			OtherPolygon: polys[x.otherRing], OtherRing: ringIdx[x.otherRing], OtherVertex: x.otherVertex,
+			Point: x.Point,
+		})
+	}
+	return errs
+}
+
+// topologyError is a point where two ring segments cross or a vertex
+// is inside another polygon.
+type topologyError struct {
+	geom.Point
+
+	// ring and vertex are the indices of the first ring and of the
+	// vertex at the start of the segment in it, or of the vertex that
+	// is inside another polygon if inside is true. otherRing and
+	// otherVertex identify the second segment, or the segment of the
+	// other polygon that is nearest to the vertex.
+	ring, vertex           int
+	inside                 bool
+	otherRing, otherVertex int
+}
+
+// ringSegment is a segment of a ring, for spatial indexing.
+type ringSegment struct {
+	a, b geom.Point
+
+	// id orders the segments so that each pair is checked once, and
+	// ring and vertex are as for topologyError.
+	id, ring, vertex int
+}
+
+func (s *ringSegment) Bounds() *geom.Bounds {
+	b := s.a.Bounds()
+	b.Extend(s.b.Bounds())
+	return b
+}
+
+// ringPolygon is a polygon made up of consecutive rings,
+// for spatial indexing.
+type ringPolygon struct {
+	// rings holds the indices of the first ring and of the
+	// ring after the last.
+	rings [2]int
+	b     *geom.Bounds
+}
+
+func (p *ringPolygon) Bounds() *geom.Bounds { return p.b }
+
+// topologyErrors returns the topology errors in rings, where
+// polygon holds the index of the polygon that each ring is in and
+// the rings of each polygon are consecutive. Rings are implicitly closed.
+func topologyErrors(rings []geom.Path, polygon []int) []topologyError {
+	segIndex := rtree.NewTree(25, 50)
+	polyIndex := rtree.NewTree(25, 50)
+	var segs []*ringSegment
+	var polys []*ringPolygon
+	vertexPolys := make(map[geom.Point][]int)
+	for r, ring := range rings {
+		if r == 0 || polygon[r] != polygon[r-1] {
+			polys = append(polys, &ringPolygon{rings: [2]int{r, r}, b: geom.NewBounds()})
+		}
+		poly := polys[len(polys)-1]
+		poly.rings[1] = r + 1
+		for i, a := range ring {
+			poly.b.Extend(a.Bounds())
+			if vp := vertexPolys[a]; len(vp) == 0 || vp[len(vp)-1] != polygon[r] {
+				vertexPolys[a] = append(vp, polygon[r])
+			}
+			b := ring[(i+1)%len(ring)]
+			if a == b {
+				continue
+			}
+			s := &ringSegment{a: a, b: b, id: len(segs), ring: r, vertex: i}
+			segs = append(segs, s)
+			segIndex.Insert(s)
+		}
+	}
+	for _, p := range polys {
+		polyIndex.Insert(p)
+	}
+
+	var o []topologyError
+	for _, s := range segs {
+		for _, item := range segIndex.SearchIntersect(s.Bounds()) {
+			t := item.(*ringSegment)
+			if t.id <= s.id {
+				continue
+			}
+			if p, ok := segmentsCross(s.a, s.b, t.a, t.b); ok {
+				o = append(o, topologyError{Point: p, ring: s.ring, vertex: s.vertex, otherRing: t.ring, otherVertex: t.vertex})
+			}
+		}
+	}
+	for r, ring := range rings {
+		for i, v := range ring {
+			if i > 0 && i == len(ring)-1 && v == ring[0] {
+				break
+			}
+			for _, item := range polyIndex.SearchIntersect(v.Bounds()) {
+				p := item.(*ringPolygon)
+				q := polygon[p.rings[0]]
+				if q == polygon[r] || hasPolygon(vertexPolys[v], q) || !pointInPolygon(v, rings[p.rings[0]:p.rings[1]]) {
+					continue
+				}
+				otherRing, otherVertex := nearestSegment(v, rings, p.rings)
+				o = append(o, topologyError{Point: v, ring: r, vertex: i, inside: true, otherRing: otherRing, otherVertex: otherVertex})
+				break
+			}
+		}
+	}
+	return o
+}
+
+// hasPolygon returns whether polys includes polygon q.
+func hasPolygon(polys []int, q int) bool {
+	for _, p := range polys {
+		if p == q {
+			return true
+		}
+	}
+	return false
+}
+
+// pointInPolygon returns whether p is inside the polygon with the
+// given rings, where rings inside an odd number of
+// other rings are holes.
+func pointInPolygon(p geom.Point, rings []geom.Path) bool {
+	var in bool
+	for _, r := range rings {
+		if len(r) >= 3 && pointInRing(p, r) {
+			in = !in
+		}
+	}
+	return in
+}
+
+// nearestSegment returns the indices of the ring, and of the vertex at
+// the start of the segment in it, of the segment nearest to p among
+// rings[span[0]:span[1]].
+func nearestSegment(p geom.Point, rings []geom.Path, span [2]int) (ring, vertex int) {
+	minDist := math.Inf(1)
+	for r := span[0]; r < span[1]; r++ {
+		for i, a := range rings[r] {
+			b := rings[r][(i+1)%len(rings[r])]
+			if d := segmentDistance(p, a, b); a != b && d < minDist {
+				minDist, ring, vertex = d, r, i
+			}
+		}
+	}
+	return ring, vertex
+}
+
+// segmentsCross returns the point where segments ab and cd cross,
+// if they cross at a point that is not an end point of either.
+func segmentsCross(a, b, c, d geom.Point) (geom.Point, bool) {
+	o1, o2 := orientation(a, b, c), orientation(a, b, d)
+	o3, o4 := orientation(c, d, a), orientation(c, d, b)
+	if o1*o2 >= 0 || o3*o4 >= 0 {
+		return geom.Point{}, false
+	}
+	f := o1 / (o1 - o2)
+	return geom.Point{X: c.X + f*(d.X-c.X), Y: c.Y + f*(d.Y-c.Y)}, true
+}
+
+// orientation returns twice the signed area of triangle abc, which is
+// positive if the points are counter-clockwise.
+func orientation(a, b, c geom.Point) float64 {
+	return (b.X-a.X)*(c.Y-a.Y) - (b.Y-a.Y)*(c.X-a.X)
+}
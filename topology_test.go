@@ -0,0 +1,80 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+func TestValidatePolygons(t *testing.T) {
+	polys := []geom.Polygon{
+		// A bow tie.
+		{{{X: 0, Y: 0}, {X: 1, Y: 1}, {X: 1, Y: 0}, {X: 0, Y: 1}}},
+		// A square that overlaps the next one.
+		{{{X: 2, Y: 0}, {X: 3, Y: 0}, {X: 3, Y: 1}, {X: 2, Y: 1}, {X: 2, Y: 0}}},
+		{{{X: 2.5, Y: 0.7}, {X: 3.5, Y: 0.7}, {X: 3.5, Y: 1.7}, {X: 2.5, Y: 1.7}, {X: 2.5, Y: 0.7}}},
+		// A square that shares an edge with the previous one, and has
+		// a hole that touches its outer ring.
+		{
+			{{X: 3.5, Y: 0.7}, {X: 4.5, Y: 0.7}, {X: 4.5, Y: 1.7}, {X: 3.5, Y: 1.7}},
+			{{X: 3.5, Y: 1.7}, {X: 4, Y: 1.2}, {X: 4, Y: 0.95}},
+		},
+	}
+	errs := ValidatePolygons(polys)
+	want := []TopologyError{
+		{Polygon: 0, Ring: 0, Vertex: 0, OtherPolygon: 0, OtherRing: 0, OtherVertex: 2, Point: geom.Point{X: 0.5, Y: 0.5}},
+		{Polygon: 1, Ring: 0, Vertex: 1, OtherPolygon: 2, OtherRing: 0, OtherVertex: 0, Point: geom.Point{X: 3, Y: 0.7}},
+		{Polygon: 1, Ring: 0, Vertex: 2, OtherPolygon: 2, OtherRing: 0, OtherVertex: 3, Point: geom.Point{X: 2.5, Y: 1}},
+		{Polygon: 1, Ring: 0, Vertex: 2, Inside: true, OtherPolygon: 2, OtherRing: 0, OtherVertex: 0, Point: geom.Point{X: 3, Y: 1}},
+		{Polygon: 2, Ring: 0, Vertex: 0, Inside: true, OtherPolygon: 1, OtherRing: 0, OtherVertex: 2, Point: geom.Point{X: 2.5, Y: 0.7}},
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("have %d errors, want %d: %v", len(errs), len(want), errs)
+	}
+	for _, w := range want {
+		var found bool
+		for _, e := range errs {
+			found = found || e == w
+		}
+		if !found {
+			t.Errorf("missing error %+v in %+v", w, errs)
+		}
+	}
+	if errs[0].Overlap() {
+		t.Errorf("bow tie reported as overlap: %v", errs[0])
+	}
+}
+
+func TestTransformPolygonsRepair(t *testing.T) {
+	c := NewCartogram(testDensity(), 1, 30, 30)
+	defer c.Destroy()
+
+	// The vertex of the upper polygon at (1.5, 1.3) is above the long
+	// upper edge of the lower one, and moves down across it as the dense
+	// square expands.
+	polys := []geom.Polygon{
+		{{{X: 0, Y: 0}, {X: 3, Y: 0}, {X: 3, Y: 1.2}, {X: 0, Y: 1.2}}},
+		{{{X: 3, Y: 1.2}, {X: 3, Y: 3}, {X: 0, Y: 3}, {X: 0, Y: 1.2}, {X: 1.5, Y: 1.3}}},
+	}
+	if errs := ValidatePolygons(polys); len(errs) != 0 {
+		t.Fatalf("invalid input: %v", errs)
+	}
+	errs := ValidatePolygons(c.TransformPolygons(polys))
+	if len(errs) == 0 {
+		t.Fatal("no errors before repair")
+	}
+	for _, e := range errs {
+		if !e.Overlap() || !e.Inside || e.Polygon != 1 || e.Vertex != 4 {
+			t.Errorf("unexpected error before repair: %+v", e)
+		}
+	}
+
+	c.RepairPasses = 10
+	if errs := ValidatePolygons(c.TransformPolygons(polys)); len(errs) != 0 {
+		t.Errorf("errors after repair: %v", errs)
+	}
+}
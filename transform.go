@@ -0,0 +1,174 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"fmt"
+
+	"github.com/ctessum/geom"
+)
+
+// A Transformer transforms geometries to match a cartogram. It is
+// implemented by Cartogram and RubberSheet.
+type Transformer interface {
+	TransformPoint(geom.Point) geom.Point
+	TransformPath(geom.Path) geom.Path
+	TransformPolygons([]geom.Polygon) []geom.Polygon
+	Transform(geom.Geom) geom.Geom
+	TransformGeoms([]geom.Geom) []geom.Geom
+}
+
+// Transform returns g transformed to match the cartogram, with the same
+// geometry type and structure. All of the coordinates in g are
+// transformed together in a single call. Polygon rings and lines
+// are densified according to the receiver's MaxSegment field, and
+// polygons are repaired according to its RepairPasses field. g may be
+// a geom.Point, MultiPoint, LineString, MultiLineString, Polygon,
+// MultiPolygon or GeometryCollection of them; Transform panics
+// for other types.
+func (c *Cartogram) Transform(g geom.Geom) geom.Geom {
+	return c.TransformGeoms([]geom.Geom{g})[0]
+}
+
+// TransformGeoms is like Transform, but transforms all of the
+// coordinates in g together in a single call.
+func (c *Cartogram) TransformGeoms(g []geom.Geom) []geom.Geom {
+	return transformGeoms(g, c.transformPaths)
+}
+
+// transformGeoms transforms g using transformPaths, which is called
+// once with all of the paths in g and the index of the polygon that
+// each path is a ring of, or -1 for paths that are not rings.
+func transformGeoms(g []geom.Geom, transformPaths func(paths []geom.Path, polygon []int) []geom.Path) []geom.Geom {
+	return transformGeomFrames(g, func(paths []geom.Path, polygon []int) [][]geom.Path {
+		return [][]geom.Path{transformPaths(paths, polygon)}
+	})[0]
+}
+
+// transformGeomFrames is like transformGeoms, but transformPaths
+// returns any number of transformed copies of the paths, and a
+// copy of g is returned for each.
+func transformGeomFrames(g []geom.Geom, transformPaths func(paths []geom.Path, polygon []int) [][]geom.Path) [][]geom.Geom {
+	var f geomFlattener
+	for _, gg := range g {
+		f.add(gg)
+	}
+	frames := transformPaths(f.paths, f.polygon)
+	o := make([][]geom.Geom, len(frames))
+	for k, paths := range frames {
+		o[k] = make([]geom.Geom, len(g))
+		for i, gg := range g {
+			o[k][i] = rebuild(gg, &paths)
+		}
+	}
+	return o
+}
+
+// geomFlattener collects the paths that make up geometries.
+type geomFlattener struct {
+	paths []geom.Path
+
+	// polygon holds the index of the polygon that each path is a ring
+	// of, or -1 for paths that are not rings. polygons is the number
+	// of polygons.
+	polygon  []int
+	polygons int
+}
+
+// add adds the paths of g to the receiver. Points are added as
+// paths with a single vertex so that they are not densified.
+func (f *geomFlattener) add(g geom.Geom) {
+	switch t := g.(type) {
+	case geom.Point:
+		f.addPath(geom.Path{t}, -1)
+	case geom.MultiPoint:
+		for _, p := range t {
+			f.addPath(geom.Path{p}, -1)
+		}
+	case geom.LineString:
+		f.addPath(geom.Path(t), -1)
+	case geom.MultiLineString:
+		for _, l := range t {
+			f.addPath(geom.Path(l), -1)
+		}
+	case geom.Polygon:
+		f.addPolygon(t)
+	case geom.MultiPolygon:
+		for _, p := range t {
+			f.addPolygon(p)
+		}
+	case geom.GeometryCollection:
+		for _, gg := range t {
+			f.add(gg)
+		}
+	default:
+		panic(fmt.Sprintf("tilegram: unsupported geometry type %T", g))
+	}
+}
+
+func (f *geomFlattener) addPolygon(p geom.Polygon) {
+	for _, r := range p {
+		f.addPath(r, f.polygons)
+	}
+	f.polygons++
+}
+
+func (f *geomFlattener) addPath(p geom.Path, polygon int) {
+	f.paths = append(f.paths, p)
+	f.polygon = append(f.polygon, polygon)
+}
+
+// rebuild returns a geometry with the same type and structure as g,
+// taking paths in the order they were added by geomFlattener.add
+// from the front of paths and advancing it.
+func rebuild(g geom.Geom, paths *[]geom.Path) geom.Geom {
+	take := func() geom.Path {
+		p := (*paths)[0]
+		*paths = (*paths)[1:]
+		return p
+	}
+	switch t := g.(type) {
+	case geom.Point:
+		return take()[0]
+	case geom.MultiPoint:
+		o := make(geom.MultiPoint, len(t))
+		for i := range t {
+			o[i] = take()[0]
+		}
+		return o
+	case geom.LineString:
+		return geom.LineString(take())
+	case geom.MultiLineString:
+		o := make(geom.MultiLineString, len(t))
+		for i := range t {
+			o[i] = geom.LineString(take())
+		}
+		return o
+	case geom.Polygon:
+		return rebuildPolygon(t, take)
+	case geom.MultiPolygon:
+		o := make(geom.MultiPolygon, len(t))
+		for i, p := range t {
+			o[i] = rebuildPolygon(p, take)
+		}
+		return o
+	case geom.GeometryCollection:
+		o := make(geom.GeometryCollection, len(t))
+		for i, gg := range t {
+			o[i] = rebuild(gg, paths)
+		}
+		return o
+	default:
+		panic(fmt.Sprintf("tilegram: unsupported geometry type %T", g))
+	}
+}
+
+func rebuildPolygon(p geom.Polygon, take func() geom.Path) geom.Polygon {
+	o := make(geom.Polygon, len(p))
+	for i := range p {
+		o[i] = take()
+	}
+	return o
+}
@@ -0,0 +1,80 @@
+// Copyright ©2016 The tilegram Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package tilegram
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+func TestTransform(t *testing.T) {
+	c := NewCartogram(testDensity(), 1, 30, 30)
+	defer c.Destroy()
+
+	sq := testDensity().Polygons[0].(geom.Polygon)
+	g := []geom.Geom{
+		geom.Point{X: 1.5, Y: 1.5},
+		geom.GeometryCollection{
+			geom.MultiPoint{{X: 0, Y: 0}, {X: 3, Y: 3}},
+			geom.LineString{{X: 0, Y: 1.5}, {X: 3, Y: 1.5}},
+			geom.MultiLineString{{{X: 0.5, Y: 0.5}, {X: 2.5, Y: 2.5}}, {{X: 0.5, Y: 2.5}, {X: 2.5, Y: 0.5}}},
+			geom.GeometryCollection{sq},
+		},
+		geom.MultiPolygon{sq, testDensity().Polygons[1].(geom.Polygon)},
+	}
+
+	// The coordinates are transformed in the order they appear.
+	flat := geom.Path{{X: 1.5, Y: 1.5}, {X: 0, Y: 0}, {X: 3, Y: 3}, {X: 0, Y: 1.5}, {X: 3, Y: 1.5},
+		{X: 0.5, Y: 0.5}, {X: 2.5, Y: 2.5}, {X: 0.5, Y: 2.5}, {X: 2.5, Y: 0.5}}
+	flat = append(flat, sq[0]...)
+	flat = append(flat, sq[0]...)
+	flat = append(flat, testDensity().Polygons[1].(geom.Polygon)[0]...)
+	flat = c.TransformPath(flat)
+	take := func(n int) geom.Path {
+		p := flat[:n:n]
+		flat = flat[n:]
+		return p
+	}
+	want := []geom.Geom{
+		take(1)[0],
+		geom.GeometryCollection{
+			geom.MultiPoint(take(2)),
+			geom.LineString(take(2)),
+			geom.MultiLineString{geom.LineString(take(2)), geom.LineString(take(2))},
+			geom.GeometryCollection{geom.Polygon{take(5)}},
+		},
+		geom.MultiPolygon{{take(5)}, {take(5)}},
+	}
+	if have := c.TransformGeoms(g); !reflect.DeepEqual(have, want) {
+		t.Errorf("TransformGeoms:\nhave %v\nwant %v", have, want)
+	}
+	if have := c.Transform(g[0]); have != c.TransformPoint(geom.Point{X: 1.5, Y: 1.5}) {
+		t.Errorf("Transform point: have %v", have)
+	}
+
+	// Lines and rings are densified, but points are not.
+	c.MaxSegment = 1
+	have := c.TransformGeoms(g)
+	gc := have[1].(geom.GeometryCollection)
+	if n := len(gc[0].(geom.MultiPoint)); n != 2 {
+		t.Errorf("densified multipoint has %d points, want 2", n)
+	}
+	// The line is 3 units, or 18 grid cells, long.
+	if n := len(gc[1].(geom.LineString)); n != 19 {
+		t.Errorf("densified line has %d points, want 19", n)
+	}
+	if n := len(have[2].(geom.MultiPolygon)[0][0]); n != 25 {
+		t.Errorf("densified polygon has %d points, want 25", n)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("no panic for unsupported geometry")
+		}
+	}()
+	c.Transform(geom.NewBounds())
+}